@@ -3,15 +3,27 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"tcp-app/storage"
 	"tcp-app/torrent"
+	"tcp-app/tracker"
+)
+
+var (
+	// ErrNoPeers is returned when neither peers nor web seeds were found
+	ErrNoPeers = errors.New("no available peers found")
+	// ErrIncomplete is returned when pieces still failed after retrying
+	ErrIncomplete = errors.New("download incomplete")
 )
 
 type PieceWork struct {
@@ -27,60 +39,87 @@ type PieceResult struct {
 }
 
 func StartDownload(torrentFile string) {
+	if err := StartDownloadWithOptions(torrentFile, Options{}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// StartDownloadWithOptions downloads a torrent, choosing pieces according
+// to opts. It returns an error unless every wanted piece was downloaded.
+func StartDownloadWithOptions(torrentFile string, opts Options) error {
+	return Download(context.Background(), torrentFile, opts)
+}
+
+// Download is StartDownloadWithOptions as a background task: cancelling
+// ctx stops the workers once their current pieces are done and returns
+// ctx's error. Completed pieces are kept, so a later download resumes.
+func Download(ctx context.Context, torrentFile string, opts Options) error {
 	fmt.Println("Starting download for:", torrentFile)
 
 	// Parse torrent file using the torrent package
 	tf, err := torrent.Open(torrentFile)
 	if err != nil {
-		fmt.Printf("Error opening torrent file: %v\n", err)
-		return
+		return fmt.Errorf("error opening torrent file: %v", err)
 	}
 
-	// Mock the list of peers
-	peers := []string{"192.168.68.151:8080"}
-
-	// First, test connection and handshake with peers
-	var activePeers []string
-	for _, peer := range peers {
-		err := TestConnection(peer)
-		if err != nil {
-			fmt.Printf("Peer %s is not available: %v\n", peer, err)
-			continue
-		}
-
-		if err := performHandshake(peer, tf.InfoHash[:]); err != nil {
-			fmt.Printf("Handshake failed with peer %s: %v\n", peer, err)
-			continue
+	d, err := openDownload(&tf, opts)
+	if err != nil {
+		return err
+	}
+	defer closeDownload(d)
+	stopCancel := context.AfterFunc(ctx, d.picker.close)
+	defer stopCancel()
+
+	// Peers learned through PEX are added to the pool while downloading
+	pool := openPool(tf.InfoHash, tf.Private)
+	defer closePool(tf.InfoHash)
+	stopLocal := announceLocal(tf.InfoHash, tf.Private)
+	defer stopLocal()
+
+	// Peers are only looked for when something is left to download. With
+	// local service discovery or the DHT on, the download waits for peers
+	// to turn up.
+	seeds := webSeeds(&tf)
+	if d.picker.wanted() > 0 {
+		connectPeers(&tf, opts, pool)
+		defer announceTrackers(&tf, tracker.EventStopped, 0)
+		if pool.size() == 0 && len(seeds) == 0 && !canDiscover(tf.Private) {
+			return ErrNoPeers
 		}
-
-		activePeers = append(activePeers, peer)
 	}
-
-	if len(activePeers) == 0 {
-		fmt.Println("No available peers found!")
-		return
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// Create channels for the worker pool
+	// Workers stop waiting for peers once every piece is done
+	workCtx, stopWork := context.WithCancel(ctx)
+	defer stopWork()
+	go refreshDHT(workCtx, &tf, pool)
+
+	// Workers take pieces from the picker, which puts pieces that are being
+	// streamed first
 	const numWorkers = 3
-	workQueue := make(chan PieceWork, len(tf.PieceHashes))
+	const maxAttempts = 5
 	results := make(chan PieceResult, len(tf.PieceHashes))
 
-	// Enqueue work
-	for i, hash := range tf.PieceHashes {
-		workQueue <- PieceWork{Index: i, Hash: hash[:], Size: int64(tf.PieceLength)}
-	}
-	close(workQueue) // Close after enqueuing all work
-
-	// Start workers
+	// Start workers; peers and web seeds share the same picker
 	var wg sync.WaitGroup
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			downloadWorker(activePeers[0], workQueue, results, tf.InfoHash[:])
+			downloadWorker(workCtx, pool, d, results)
 		}()
 	}
+	for _, seed := range seeds {
+		for i := 0; i < webSeedWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				webSeedWorker(seed, d, results)
+			}()
+		}
+	}
 
 	// Wait for workers to complete
 	go func() {
@@ -88,72 +127,150 @@ func StartDownload(torrentFile string) {
 		close(results)
 	}()
 
-	// Collect results and merge file
-	piecesByIndex := make(map[int]string)
+	// Collect results, retrying failed pieces; verified pieces go straight
+	// to storage
+	attempts := make(map[int]int)
+	failed := 0
+	remaining := d.picker.wanted()
+	if remaining == 0 {
+		d.picker.close()
+		stopWork()
+	}
 	for result := range results {
-		if result.Error != nil {
-			fmt.Printf("Error downloading piece %d: %v\n", result.Index, result.Error)
-			continue
+		err := result.Error
+		if err == nil {
+			// Validate the piece hash
+			calculatedHash := sha1.Sum(result.Data)
+			if !bytes.Equal(calculatedHash[:], tf.PieceHashes[result.Index][:]) {
+				err = fmt.Errorf("piece %d hash mismatch", result.Index)
+			}
 		}
-		piecesByIndex[result.Index] = string(result.Data)
-		// Validate the piece hash
-		calculatedHash := sha1.Sum(result.Data)
-		if !bytes.Equal(calculatedHash[:], tf.PieceHashes[result.Index][:]) {
-			fmt.Printf("Piece %d hash mismatch!\n", result.Index)
+		if err != nil {
+			fmt.Printf("Error downloading piece %d: %v\n", result.Index, err)
+			attempts[result.Index]++
+			if attempts[result.Index] < maxAttempts {
+				d.picker.retry(result.Index)
+				continue
+			}
+			failed++
+		} else if err := d.complete(result.Index, result.Data); err != nil {
+			fmt.Println(err)
+			failed++
+		} else {
+			fmt.Printf("Successfully downloaded piece %d\n", result.Index)
+		}
+		remaining--
+		if remaining == 0 {
+			d.picker.close()
+			stopWork()
 		}
-		fmt.Printf("Successfully downloaded piece %d\n", result.Index)
 	}
 
-	// Merge pieces into final file
-	if err := tf.MergePieces(tf.Name, piecesByIndex); err != nil {
-		fmt.Printf("Error merging pieces: %v\n", err)
-		return
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Pieces still remaining were never tried: every peer went away
+	if failed+remaining > 0 {
+		return fmt.Errorf("%w: %d pieces failed", ErrIncomplete, failed+remaining)
 	}
 
+	if opts.Storage != storage.KindMemory {
+		wanted := func(index int) bool { return opts.filePriority(index) != PrioritySkip }
+		if err := tf.ApplyAttributes(filepath.Join(opts.OutputDir, tf.Name), wanted); err != nil {
+			return fmt.Errorf("error applying file attributes: %v", err)
+		}
+	}
+
+	announceTrackers(&tf, tracker.EventCompleted, 0)
 	fmt.Println("Download complete!")
+	return nil
 }
 
-func downloadWorker(peer string, work <-chan PieceWork, results chan<- PieceResult, infoHash []byte) {
-	for piece := range work {
-		fmt.Printf("Downloading piece %d from peer %s\n", piece.Index, peer)
-		data, err := requestPieceFromPeer(peer, piece.Index, infoHash)
+// connectPeers adds the peers from the options, the trackers and the DHT
+// that complete a handshake to the pool
+func connectPeers(tf *torrent.TorrentFile, opts Options, pool *peerPool) {
+	peers := append([]string{}, opts.Peers...)
+	peers = append(peers, announceTrackers(tf, tracker.EventStarted, int64(tf.Length))...)
+	peers = append(peers, dhtPeers(tf.InfoHash, tf.Private)...)
 
-		results <- PieceResult{
-			Index: piece.Index,
-			Data:  data,
-			Error: err,
+	// Keep the peers that complete a handshake. They are dialed the way
+	// pieces are requested, so TLS and encryption apply to the check too.
+	for _, peer := range peers {
+		pc, err := dialPeer(peer, tf.InfoHash[:], tf.Private)
+		if err != nil {
+			fmt.Printf("Peer %s is not available: %v\n", peer, err)
+			continue
 		}
+		pc.Close()
+		pool.add(peer)
 	}
 }
 
-func requestPieceFromPeer(address string, pieceIndex int, infoHash []byte) ([]byte, error) {
-	conn, err := net.DialTimeout("tcp", address, 60*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to peer: %v", err)
-	}
-	defer conn.Close()
+// downloadWorker connects to peers from the pool and downloads pieces
+// from them until the picker runs out of work, or no peer is left and
+// none can be discovered before ctx is done
+func downloadWorker(ctx context.Context, pool *peerPool, d *download, results chan<- PieceResult) {
+	infoHash := d.tf.InfoHash[:]
+	var pc *peerConn
+	defer func() {
+		if pc != nil {
+			pc.Close()
+		}
+	}()
 
-	// First perform handshake if not already done
-	if err := performHandshake(address, infoHash); err != nil {
-		return nil, fmt.Errorf("handshake failed: %v", err)
-	}
+	for {
+		if pc == nil {
+			address, ok := pool.pick(ctx)
+			if !ok {
+				return
+			}
+			var err error
+			pc, err = dialPeer(address, infoHash, pool.private)
+			if err != nil {
+				fmt.Printf("Peer %s is not available: %v\n", address, err)
+				pool.remove(address)
+				pc = nil
+				continue
+			}
+		}
+		piece, ok := d.nextWork()
+		if !ok {
+			return
+		}
+
+		fmt.Printf("Downloading piece %d from peer %s\n", piece.Index, pc.address)
+		data, err := pc.requestPiece(piece)
+		d.received(len(data))
+		if err != nil && err != errRejected {
+			// The connection is in an unknown state; redial for the next piece
+			pc.Close()
+			pc = nil
+		}
 
-	// Request the piece
-	message := fmt.Sprintf("Requesting:%x:%d\n", infoHash, pieceIndex)
-	if _, err := conn.Write([]byte(message)); err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
+		results <- PieceResult{
+			Index: piece.Index,
+			Data:  data,
+			Error: err,
+		}
 	}
+}
 
+// readSizedPiece reads a piece sent with an 8-byte size header. The header
+// must announce exactly size bytes, the size of the piece requested.
+func readSizedPiece(r io.Reader, size int64) ([]byte, error) {
 	// Read the piece size first (8 bytes)
 	sizeHeader := make([]byte, 8)
-	if _, err := io.ReadFull(conn, sizeHeader); err != nil {
+	if _, err := io.ReadFull(r, sizeHeader); err != nil {
 		return nil, fmt.Errorf("error reading piece size: %v", err)
 	}
 	pieceSize := binary.BigEndian.Uint64(sizeHeader)
+	if pieceSize != uint64(size) {
+		return nil, fmt.Errorf("peer sent %d bytes for a piece of %d bytes", pieceSize, size)
+	}
 
 	// Read the exact number of bytes for the piece
 	data := make([]byte, pieceSize)
-	if _, err := io.ReadFull(conn, data); err != nil {
+	if _, err := io.ReadFull(r, data); err != nil {
 		return nil, fmt.Errorf("error reading piece data: %v", err)
 	}
 
@@ -187,30 +304,3 @@ func TestConnection(address string) error {
 	fmt.Printf("Received response: %s", response)
 	return nil
 }
-
-func performHandshake(address string, infoHash []byte) error {
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
-	if err != nil {
-		return fmt.Errorf("handshake connection failed: %v", err)
-	}
-	defer conn.Close()
-
-	// Send handshake message
-	handshakeMsg := fmt.Sprintf("HANDSHAKE:%x\n", infoHash)
-	if _, err := conn.Write([]byte(handshakeMsg)); err != nil {
-		return fmt.Errorf("failed to send handshake: %v", err)
-	}
-
-	// Read handshake response
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read handshake response: %v", err)
-	}
-
-	if response != "OK\n" {
-		return fmt.Errorf("invalid handshake response: %s", response)
-	}
-
-	return nil
-}
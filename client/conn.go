@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/peer"
+)
+
+// errRejected is returned when a peer rejects a piece request
+var errRejected = errors.New("request rejected by peer")
+
+// peerConn is a persistent connection to a peer whose extensions were
+// negotiated during the handshake
+type peerConn struct {
+	address  string
+	identity string
+	conn     net.Conn
+	reader   *bufio.Reader
+	infoHash []byte
+	reserved peer.Reserved
+	session  *peer.Session
+	writeMu  sync.Mutex
+
+	haveAll     bool
+	choked      bool
+	allowedFast map[int]bool
+	suggested   []int
+}
+
+// dialPeer connects to a peer and performs the handshake on the same
+// connection that is later used for piece requests. Extensions that share
+// peers are disabled for private torrents.
+func dialPeer(address string, infoHash []byte, private bool) (*peerConn, error) {
+	var hash [20]byte
+	copy(hash[:], infoHash)
+	conn, identity, err := dialSecure(address, hash, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to peer: %v", err)
+	}
+	pc := &peerConn{
+		address:     address,
+		identity:    identity,
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		infoHash:    infoHash,
+		allowedFast: make(map[int]bool),
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	handshakeMsg := fmt.Sprintf("HANDSHAKE:%x:%s\n", infoHash, peer.LocalReserved())
+	if _, err := conn.Write([]byte(handshakeMsg)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send handshake: %v", err)
+	}
+	response, err := pc.reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read handshake response: %v", err)
+	}
+	response = strings.TrimSpace(response)
+	switch {
+	case response == "OK":
+		// Peer does not understand reserved bytes
+	case strings.HasPrefix(response, "OK:"):
+		remote, err := peer.ParseReserved(strings.TrimPrefix(response, "OK:"))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		pc.reserved = peer.LocalReserved().Intersect(remote)
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("invalid handshake response: %s", response)
+	}
+
+	// Fast peers start out choked until told otherwise
+	pc.choked = pc.reserved.SupportsFast()
+
+	if pc.reserved.SupportsExtended() {
+		pc.session = extensions.NewSession(pc, hash)
+		pc.session.ListenPort = listenPort
+		pc.session.Private = private
+		if err := pc.session.SendHandshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send extended handshake: %v", err)
+		}
+	}
+	return pc, nil
+}
+
+// Close closes the underlying connection
+func (pc *peerConn) Close() error {
+	if pc.session != nil {
+		pc.session.Close()
+	}
+	return pc.conn.Close()
+}
+
+// write sends raw bytes to the peer, serialized with extension messages
+func (pc *peerConn) write(data []byte) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	_, err := pc.conn.Write(data)
+	return err
+}
+
+// readMessage reads the next line from the peer and applies any state
+// changes it carries. The trimmed line is returned to the caller.
+func (pc *peerConn) readMessage() (string, error) {
+	line, err := pc.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	name, arg, _ := strings.Cut(line, ":")
+	switch name {
+	case peer.MsgHaveAll:
+		pc.haveAll = true
+	case peer.MsgHaveNone:
+		pc.haveAll = false
+	case peer.MsgChoke:
+		pc.choked = true
+	case peer.MsgUnchoke:
+		pc.choked = false
+	case peer.MsgAllowedFast:
+		if index, err := strconv.Atoi(arg); err == nil {
+			pc.allowedFast[index] = true
+		}
+	case peer.MsgSuggest:
+		if index, err := strconv.Atoi(arg); err == nil {
+			pc.suggested = append(pc.suggested, index)
+		}
+	case peer.MsgExtended:
+		if err := pc.readExtended(arg); err != nil {
+			return "", err
+		}
+	}
+	return line, nil
+}
+
+// requestPiece asks the peer for a single piece and waits for the data.
+// Data of any size but the piece's own is refused, so a peer cannot make
+// us allocate more than a piece.
+func (pc *peerConn) requestPiece(piece PieceWork) ([]byte, error) {
+	pieceIndex := piece.Index
+	pc.conn.SetDeadline(time.Now().Add(60 * time.Second))
+	defer pc.conn.SetDeadline(time.Time{})
+
+	if !pc.reserved.SupportsFast() {
+		return pc.requestPieceLegacy(piece)
+	}
+
+	// While choked only pieces from the allowed fast set may be requested
+	for pc.choked && !pc.allowedFast[pieceIndex] {
+		if _, err := pc.readMessage(); err != nil {
+			return nil, fmt.Errorf("error waiting for unchoke: %v", err)
+		}
+	}
+
+	message := fmt.Sprintf("Requesting:%x:%d\n", pc.infoHash, pieceIndex)
+	if err := pc.write([]byte(message)); err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+
+	for {
+		line, err := pc.readMessage()
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %v", err)
+		}
+		name, arg, _ := strings.Cut(line, ":")
+		switch name {
+		case peer.MsgPiece:
+			fields := strings.Split(arg, ":")
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("malformed piece header: %s", line)
+			}
+			index, err1 := strconv.Atoi(fields[0])
+			size, err2 := strconv.Atoi(fields[1])
+			if err1 != nil || err2 != nil || size < 0 {
+				return nil, fmt.Errorf("malformed piece header: %s", line)
+			}
+			if index != pieceIndex {
+				// A stale response to an earlier request; skip it and keep
+				// waiting
+				if _, err := io.CopyN(io.Discard, pc.reader, int64(size)); err != nil {
+					return nil, fmt.Errorf("error reading piece data: %v", err)
+				}
+				continue
+			}
+			if int64(size) != piece.Size {
+				return nil, fmt.Errorf("peer sent %d bytes for piece %d of %d bytes", size, index, piece.Size)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(pc.reader, data); err != nil {
+				return nil, fmt.Errorf("error reading piece data: %v", err)
+			}
+			return data, nil
+		case peer.MsgReject:
+			if strings.HasSuffix(arg, ":"+strconv.Itoa(pieceIndex)) {
+				return nil, errRejected
+			}
+		case "ERROR":
+			return nil, fmt.Errorf("peer error: %s", line)
+		}
+	}
+}
+
+func (pc *peerConn) requestPieceLegacy(piece PieceWork) ([]byte, error) {
+	message := fmt.Sprintf("Requesting:%x:%d\n", pc.infoHash, piece.Index)
+	if err := pc.write([]byte(message)); err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	return readSizedPiece(pc.reader, piece.Size)
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"tcp-app/dht"
+	"tcp-app/torrent"
+)
+
+// dhtNode is used to find peers when set with SetDHT
+var dhtNode *dht.Server
+
+// SetDHT makes downloads look up and announce peers on the given DHT node
+// in addition to the configured peer list
+func SetDHT(node *dht.Server) {
+	dhtNode = node
+}
+
+// dhtPeers returns the peers the DHT knows for a torrent. When the local
+// server is listening we also announce ourselves so others can find us.
+// Private torrents never use the DHT.
+func dhtPeers(infoHash [20]byte, private bool) []string {
+	if dhtNode == nil || private {
+		return nil
+	}
+	var found []*net.TCPAddr
+	if listenPort > 0 {
+		found = dhtNode.Announce(infoHash, listenPort)
+	} else {
+		found = dhtNode.GetPeers(infoHash)
+	}
+	fmt.Printf("Found %d peers through the DHT\n", len(found))
+
+	peers := make([]string, 0, len(found))
+	for _, addr := range found {
+		peers = append(peers, addr.String())
+	}
+	return peers
+}
+
+// dhtRefreshInterval is how often the DHT is asked again for peers while a
+// download has none
+const dhtRefreshInterval = time.Minute
+
+// refreshDHT adds peers from the DHT whenever the pool runs empty, until
+// ctx is done
+func refreshDHT(ctx context.Context, tf *torrent.TorrentFile, pool *peerPool) {
+	if dhtNode == nil || tf.Private {
+		return
+	}
+	ticker := time.NewTicker(dhtRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if pool.size() > 0 {
+				continue
+			}
+			for _, address := range dhtPeers(tf.InfoHash, tf.Private) {
+				pool.add(address)
+			}
+		}
+	}
+}
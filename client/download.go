@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tcp-app/storage"
+	"tcp-app/torrent"
+)
+
+// download is the state of a torrent being downloaded, shared by the
+// workers fetching pieces and the readers streaming them
+type download struct {
+	tf     *torrent.TorrentFile
+	opts   Options
+	picker *piecePicker
+	store  storage.Storage
+
+	// have holds the pieces readers can use. Pieces shared with skipped
+	// files are only partly written, so they are not marked complete in
+	// storage.
+	mu    sync.Mutex
+	have  map[int]bool
+	ready map[int]chan struct{}
+	done  chan struct{}
+}
+
+var (
+	downloadsMu sync.Mutex
+	downloads   = make(map[[20]byte]*download)
+)
+
+// completionDB remembers verified pieces so downloads resume after restarts
+var completionDB *storage.CompletionDB
+
+// SetCompletionDB sets the database completed pieces are recorded in
+func SetCompletionDB(db *storage.CompletionDB) {
+	completionDB = db
+}
+
+// openDownload opens the storage of a torrent and registers it so its
+// files can be streamed. Data is placed below opts.OutputDir, and pieces
+// completed by an earlier run, or already on disk, are not downloaded
+// again.
+func openDownload(tf *torrent.TorrentFile, opts Options) (*download, error) {
+	layout := tf.StorageLayout(tf.Name)
+	// Storage creates missing files, so look for existing data first
+	existing := existingFiles(opts.OutputDir, layout)
+	store, err := storage.New(opts.Storage, opts.OutputDir, layout)
+	if err != nil {
+		return nil, fmt.Errorf("error opening storage: %v", err)
+	}
+	store = storage.WithCompletionDB(store, completionDB, tf.InfoHash, opts.OutputDir, layout)
+	if opts.Storage != storage.KindMemory {
+		recheck(tf, store, existing)
+	}
+
+	have := make(map[int]bool)
+	priorities := opts.piecePriorities(tf)
+	for index := range priorities {
+		if store.Completed(index) {
+			have[index] = true
+			priorities[index] = PrioritySkip
+		}
+	}
+	if len(have) > 0 {
+		fmt.Printf("Resuming download: %d pieces already complete\n", len(have))
+	}
+
+	d := &download{
+		tf:     tf,
+		opts:   opts,
+		picker: newPiecePicker(priorities, opts.Sequential),
+		store:  store,
+		have:   have,
+		ready:  make(map[int]chan struct{}),
+		done:   make(chan struct{}),
+	}
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	downloads[tf.InfoHash] = d
+	return d, nil
+}
+
+// existingFiles reports which files of a layout are already on disk with
+// their full size. Virtual files always count as present.
+func existingFiles(dir string, layout storage.Layout) []bool {
+	existing := make([]bool, len(layout.Files))
+	for i, f := range layout.Files {
+		info, err := os.Stat(filepath.Join(dir, f.Path))
+		existing[i] = f.Virtual || (err == nil && info.Mode().IsRegular() && info.Size() == f.Length)
+	}
+	return existing
+}
+
+// recheck hashes the pieces that lie entirely in existing files but are
+// not recorded as complete, so data placed there by hand, such as the
+// source of a torrent we created, is seeded instead of downloaded again
+func recheck(tf *torrent.TorrentFile, store storage.Storage, existing []bool) {
+	checked, valid := 0, 0
+	for index := range tf.PieceHashes {
+		if store.Completed(index) {
+			continue
+		}
+		present := true
+		for _, span := range tf.PieceSpans(index) {
+			present = present && existing[span.FileIndex]
+		}
+		if !present {
+			continue
+		}
+		checked++
+		data := make([]byte, tf.PieceSize(index))
+		if _, err := store.ReadAt(index, data, 0); err != nil || sha1.Sum(data) != tf.PieceHashes[index] {
+			continue
+		}
+		if err := store.MarkComplete(index); err != nil {
+			fmt.Printf("Error recording piece %d: %v\n", index, err)
+			continue
+		}
+		valid++
+	}
+	if checked > 0 {
+		fmt.Printf("Checked existing data: %d of %d pieces are valid\n", valid, checked)
+	}
+}
+
+// closeDownload stops the workers, fails readers still waiting for pieces
+// that never arrived and closes the storage
+func closeDownload(d *download) {
+	d.picker.close()
+	close(d.done)
+	downloadsMu.Lock()
+	delete(downloads, d.tf.InfoHash)
+	downloadsMu.Unlock()
+	if err := d.store.Close(); err != nil {
+		fmt.Printf("Error closing storage: %v\n", err)
+	}
+}
+
+// Progress returns how many pieces of a running download are complete,
+// or false if the torrent is not being downloaded
+func Progress(infoHash [20]byte) (done, total int, ok bool) {
+	downloadsMu.Lock()
+	d := downloads[infoHash]
+	downloadsMu.Unlock()
+	if d == nil {
+		return 0, 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.have), len(d.tf.PieceHashes), true
+}
+
+// activeDownloads returns the torrents currently being downloaded
+func activeDownloads() []*download {
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	var list []*download
+	for _, d := range downloads {
+		list = append(list, d)
+	}
+	return list
+}
+
+// nextWork blocks until a piece should be downloaded
+func (d *download) nextWork() (PieceWork, bool) {
+	index, ok := d.picker.next()
+	if !ok {
+		return PieceWork{}, false
+	}
+	hash := d.tf.PieceHashes[index]
+	return PieceWork{Index: index, Hash: hash[:], Size: int64(d.tf.PieceSize(index))}, true
+}
+
+// complete writes a verified piece to storage and wakes readers waiting
+// for it. The parts of the piece that belong to skipped files are dropped.
+func (d *download) complete(index int, data []byte) error {
+	var pos int64
+	whole := true
+	for _, span := range d.tf.PieceSpans(index) {
+		if d.opts.filePriority(span.FileIndex) != PrioritySkip {
+			if _, err := d.store.WriteAt(index, data[pos:pos+span.Length], pos); err != nil {
+				return fmt.Errorf("error writing piece %d: %v", index, err)
+			}
+		} else {
+			whole = false
+		}
+		pos += span.Length
+	}
+	if whole {
+		if err := d.store.MarkComplete(index); err != nil {
+			return fmt.Errorf("error recording piece %d: %v", index, err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.have[index] = true
+	if ch, ok := d.ready[index]; ok {
+		close(ch)
+		delete(d.ready, index)
+	}
+	return nil
+}
+
+// waitPiece blocks until a piece has been downloaded. The piece and the
+// readahead after it are bumped to the front of the queue.
+func (d *download) waitPiece(ctx context.Context, index, readahead int) error {
+	d.mu.Lock()
+	ok := d.have[index]
+	ch := d.ready[index]
+	if !ok && ch == nil {
+		ch = make(chan struct{})
+		d.ready[index] = ch
+	}
+	d.mu.Unlock()
+
+	wanted := make([]int, 0, readahead+1)
+	for i := index; i <= index+readahead; i++ {
+		wanted = append(wanted, i)
+	}
+	d.picker.bump(wanted...)
+	if ok {
+		return nil
+	}
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.done:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.have[index] {
+		return fmt.Errorf("piece %d was not downloaded", index)
+	}
+	return nil
+}
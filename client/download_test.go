@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tcp-app/mse"
+	"tcp-app/server"
+	"tcp-app/tlsauth"
+	"tcp-app/torrent"
+)
+
+// startSeed creates a torrent of size random bytes and seeds it from a
+// server on a free loopback port. It returns the data, the torrent path and
+// the server address.
+func startSeed(t *testing.T, size int) ([]byte, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	writeRandom(t, path, size)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := torrent.CreateOptions{PieceLength: torrent.MinPieceLength}
+	torrentPath, err := torrent.CreateContext(context.Background(), path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := server.Seed(torrentPath, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Unseed(tf.InfoHash) })
+
+	addr := freeAddr(t)
+	go server.StartServer(addr)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("server did not start: %v", err)
+		}
+	}
+	return data, torrentPath, addr
+}
+
+// freeAddr returns a loopback address with a port nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// fetchTorrent downloads the torrent from the peer at addr and returns the data
+func fetchTorrent(t *testing.T, torrentPath, addr string) ([]byte, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out := t.TempDir()
+	err := Download(ctx, torrentPath, Options{OutputDir: out, Peers: []string{addr}})
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(out, "data.bin"))
+}
+
+func TestDownload(t *testing.T) {
+	data, torrentPath, addr := startSeed(t, 5*torrent.MinPieceLength+100)
+	got, err := fetchTorrent(t, torrentPath, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the seed")
+	}
+}
+
+func TestDownloadTLS(t *testing.T) {
+	ca, err := tlsauth.NewCA("swarm", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := func(ca *tlsauth.CA, name string) *tlsauth.Credentials {
+		creds, err := ca.Credentials(name, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return creds
+	}
+	server.SetTLS(credentials(ca, "seed"))
+	t.Cleanup(func() {
+		server.SetTLS(nil)
+		SetTLS(nil)
+	})
+	data, torrentPath, addr := startSeed(t, 3*torrent.MinPieceLength)
+
+	SetTLS(credentials(ca, "downloader"))
+	got, err := fetchTorrent(t, torrentPath, addr)
+	if err != nil {
+		t.Fatalf("download between members of one CA: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the seed")
+	}
+
+	// Outsiders and plaintext peers never get into the pool
+	other, err := tlsauth.NewCA("other", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTLS(credentials(other, "outsider"))
+	if _, err := fetchTorrent(t, torrentPath, addr); !errors.Is(err, ErrNoPeers) {
+		t.Errorf("download with a certificate of another CA returned %v", err)
+	}
+	SetTLS(nil)
+	if _, err := fetchTorrent(t, torrentPath, addr); !errors.Is(err, ErrNoPeers) {
+		t.Errorf("download without TLS returned %v", err)
+	}
+}
+
+func TestDownloadEncryptionRequired(t *testing.T) {
+	server.SetEncryptionPolicy(mse.PolicyRequire)
+	t.Cleanup(func() {
+		server.SetEncryptionPolicy(mse.PolicyPrefer)
+		SetEncryptionPolicy(mse.PolicyPrefer)
+	})
+	data, torrentPath, addr := startSeed(t, 3*torrent.MinPieceLength+7)
+
+	for _, policy := range []mse.Policy{mse.PolicyRequire, mse.PolicyPrefer} {
+		SetEncryptionPolicy(policy)
+		got, err := fetchTorrent(t, torrentPath, addr)
+		if err != nil {
+			t.Fatalf("download with policy %s: %v", policy, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("policy %s: downloaded data differs from the seed", policy)
+		}
+	}
+
+	// A plaintext downloader is refused by the seeder
+	SetEncryptionPolicy(mse.PolicyDisable)
+	if _, err := fetchTorrent(t, torrentPath, addr); !errors.Is(err, ErrNoPeers) {
+		t.Errorf("plaintext download from a seeder requiring encryption returned %v", err)
+	}
+}
+
+func TestDownloadWaitsForDiscoveredPeers(t *testing.T) {
+	if _, err := EnableLSD(true); err != nil {
+		t.Skipf("local service discovery unavailable: %v", err)
+	}
+	t.Cleanup(func() { EnableLSD(false) })
+	data, torrentPath, addr := startSeed(t, 2*torrent.MinPieceLength)
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The download starts without peers; the seed is then announced as if
+	// it was found on the LAN
+	out := t.TempDir()
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		errs <- Download(ctx, torrentPath, Options{OutputDir: out})
+	}()
+	for lookupPool(tf.InfoHash) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLocalPeer(tf.InfoHash, tcpAddr)
+
+	if err := <-errs; err != nil {
+		t.Fatalf("download with a peer found later: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs from the seed: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"tcp-app/mse"
+	"tcp-app/peer"
+)
+
+// encryptionPolicy decides whether outgoing connections must, may or must
+// not use Message Stream Encryption
+var encryptionPolicy = mse.PolicyPrefer
+
+// SetEncryptionPolicy sets the encryption policy for outgoing connections
+func SetEncryptionPolicy(policy mse.Policy) {
+	encryptionPolicy = policy
+}
+
+// dialEncrypted connects to a peer and applies the encryption policy.
+// With PolicyPrefer a peer that fails the encrypted handshake is redialed
+// in plaintext.
+func dialEncrypted(address string, infoHash [20]byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := peer.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := mse.Initiate(conn, infoHash, encryptionPolicy)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if encryptionPolicy != mse.PolicyPrefer {
+		return nil, fmt.Errorf("encryption handshake failed: %v", err)
+	}
+
+	fmt.Printf("Encryption handshake with %s failed, retrying in plaintext: %v\n", address, err)
+	return peer.Dial(address, timeout)
+}
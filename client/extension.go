@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"tcp-app/peer"
+)
+
+// maxExtendedPayload bounds the size of a single extended message
+const maxExtendedPayload = 1 << 20
+
+// extensions holds the extension protocol handlers offered to peers
+var extensions = peer.NewRegistry()
+
+// listenPort is advertised to peers in the extended handshake so they can
+// share our address through peer exchange
+var listenPort int
+
+// SetListenPort sets the port of the local server that seeds our pieces
+func SetListenPort(port int) {
+	listenPort = port
+}
+
+// RegisterExtension adds an extension protocol (BEP 10) handler to every
+// connection the client opens.
+func RegisterExtension(ext peer.Extension) error {
+	return extensions.Register(ext)
+}
+
+// RemoteAddr returns the address of the peer
+func (pc *peerConn) RemoteAddr() net.Addr {
+	return pc.conn.RemoteAddr()
+}
+
+// WriteExtended sends an extended message to the peer
+func (pc *peerConn) WriteExtended(id int, payload []byte) error {
+	header := fmt.Sprintf("%s:%d:%d\n", peer.MsgExtended, id, len(payload))
+	return pc.write(append([]byte(header), payload...))
+}
+
+// readExtended reads the payload announced by an EXTENDED line and hands
+// it to the extension session
+func (pc *peerConn) readExtended(arg string) error {
+	idField, lengthField, _ := strings.Cut(arg, ":")
+	id, err1 := strconv.Atoi(idField)
+	length, err2 := strconv.Atoi(lengthField)
+	if err1 != nil || err2 != nil || length < 0 || length > maxExtendedPayload {
+		return fmt.Errorf("malformed extended message: %s", arg)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(pc.reader, payload); err != nil {
+		return fmt.Errorf("error reading extended payload: %v", err)
+	}
+	if pc.session == nil {
+		return nil
+	}
+	if err := pc.session.HandleMessage(id, payload); err != nil {
+		fmt.Printf("Error handling extended message %d from %s: %v\n", id, pc.address, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"tcp-app/lsd"
+)
+
+var (
+	lsdMu      sync.Mutex
+	lsdService *lsd.Service
+)
+
+// EnableLSD switches Local Service Discovery on or off. While enabled,
+// active public downloads are announced on the LAN and peers found there
+// are added to the download. The running service is returned so seeds can
+// be announced on it too; it is nil once disabled.
+func EnableLSD(enable bool) (*lsd.Service, error) {
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+	if !enable {
+		if lsdService != nil {
+			lsdService.Close()
+			lsdService = nil
+		}
+		return nil, nil
+	}
+	if lsdService != nil {
+		return lsdService, nil
+	}
+	svc, err := lsd.Start(lsd.Config{Port: listenPort, OnPeer: addLocalPeer})
+	if err != nil {
+		return nil, err
+	}
+	lsdService = svc
+	return svc, nil
+}
+
+// announceLocal starts announcing a download on the LAN and returns a
+// function that stops it again
+func announceLocal(infoHash [20]byte, private bool) func() {
+	lsdMu.Lock()
+	svc := lsdService
+	lsdMu.Unlock()
+	if svc == nil || private {
+		return func() {}
+	}
+	svc.Add(infoHash, private)
+	return func() { svc.Remove(infoHash) }
+}
+
+// addLocalPeer feeds a peer discovered on the LAN into the download's pool
+func addLocalPeer(infoHash [20]byte, addr *net.TCPAddr) {
+	pool := lookupPool(infoHash)
+	if pool == nil || pool.private {
+		return
+	}
+	if pool.add(addr.String()) {
+		fmt.Printf("Found local peer %s\n", addr)
+	}
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"fmt"
+
+	"tcp-app/pex"
+)
+
+func init() {
+	RegisterExtension(pex.New(addExchangedPeers))
+}
+
+// addExchangedPeers feeds peers received through PEX into the torrent's pool
+func addExchangedPeers(infoHash [20]byte, peers []pex.Peer) {
+	pool := lookupPool(infoHash)
+	if pool == nil || pool.private {
+		return
+	}
+	for _, p := range peers {
+		if pool.add(p.Addr.String()) {
+			fmt.Printf("Learned peer %s through PEX\n", p.Addr)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// piecePicker hands out pieces to the download workers. Pieces a reader is
+// waiting for are bumped ahead of the rest. Otherwise higher priorities go
+// first, and within a priority pieces are picked in index order for
+// sequential downloads or at random.
+type piecePicker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	priorities []Priority
+	pending    []bool
+	count      int
+	sequential bool
+	urgent     []int
+	closed     bool
+}
+
+// newPiecePicker creates a picker for every piece that is not skipped
+func newPiecePicker(priorities []Priority, sequential bool) *piecePicker {
+	p := &piecePicker{
+		priorities: priorities,
+		pending:    make([]bool, len(priorities)),
+		sequential: sequential,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for i, prio := range priorities {
+		if prio != PrioritySkip {
+			p.pending[i] = true
+			p.count++
+		}
+	}
+	return p
+}
+
+// wanted returns how many pieces the picker was created with
+func (p *piecePicker) wanted() int {
+	n := 0
+	for _, prio := range p.priorities {
+		if prio != PrioritySkip {
+			n++
+		}
+	}
+	return n
+}
+
+// next blocks until a piece is available, returning false once the picker
+// is closed
+func (p *piecePicker) next() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.count == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return 0, false
+	}
+
+	for len(p.urgent) > 0 {
+		index := p.urgent[0]
+		p.urgent = p.urgent[1:]
+		if p.pending[index] {
+			p.take(index)
+			return index, true
+		}
+	}
+
+	best, seen := -1, 0
+	for index, pending := range p.pending {
+		if !pending {
+			continue
+		}
+		switch {
+		case best < 0 || p.priorities[index] > p.priorities[best]:
+			best, seen = index, 1
+		case p.priorities[index] == p.priorities[best] && !p.sequential:
+			// Reservoir sampling keeps the choice uniform
+			seen++
+			if rand.Intn(seen) == 0 {
+				best = index
+			}
+		}
+	}
+	p.take(best)
+	return best, true
+}
+
+func (p *piecePicker) take(index int) {
+	p.pending[index] = false
+	p.count--
+}
+
+// retry puts a piece that failed back up for download
+func (p *piecePicker) retry(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending[index] {
+		return
+	}
+	p.pending[index] = true
+	p.count++
+	p.cond.Signal()
+}
+
+// bump moves pieces to the front of the queue, in the given order. Pieces
+// that are skipped or already being downloaded are left alone.
+func (p *piecePicker) bump(indexes ...int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var urgent []int
+	for _, index := range indexes {
+		if index >= 0 && index < len(p.pending) && p.pending[index] {
+			urgent = append(urgent, index)
+		}
+	}
+	p.urgent = append(urgent, p.urgent...)
+}
+
+// close wakes all workers and makes next return false
+func (p *piecePicker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
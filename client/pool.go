@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// peerPool is the set of known peers for one torrent. It starts with the
+// configured peers and grows as peers are learned through peer exchange,
+// local service discovery and the DHT.
+type peerPool struct {
+	mu      sync.Mutex
+	private bool
+	peers   []string
+	known   map[string]bool
+	next    int
+	// added is closed and replaced whenever a peer is added
+	added chan struct{}
+	// discover reports whether peers may still be discovered
+	discover func() bool
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = make(map[[20]byte]*peerPool)
+)
+
+// openPool creates the peer pool for a torrent being downloaded
+func openPool(infoHash [20]byte, private bool) *peerPool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	pool := &peerPool{
+		private:  private,
+		known:    make(map[string]bool),
+		added:    make(chan struct{}),
+		discover: func() bool { return canDiscover(private) },
+	}
+	pools[infoHash] = pool
+	return pool
+}
+
+// closePool forgets the peer pool of a finished download
+func closePool(infoHash [20]byte) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	delete(pools, infoHash)
+}
+
+func lookupPool(infoHash [20]byte) *peerPool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	return pools[infoHash]
+}
+
+// add inserts a peer address, returning false if it was already known
+func (p *peerPool) add(address string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.known[address] {
+		return false
+	}
+	p.known[address] = true
+	p.peers = append(p.peers, address)
+	close(p.added)
+	p.added = make(chan struct{})
+	return true
+}
+
+// remove drops a peer that could not be reached. It is forgotten, so
+// discovery may add it again later.
+func (p *peerPool) remove(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.known, address)
+	for i, peer := range p.peers {
+		if peer == address {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			break
+		}
+	}
+}
+
+// pick returns the next peer to connect to in round-robin order. While
+// the pool is empty it waits for a peer to be discovered, until ctx is done
+// or nothing can discover peers any more.
+func (p *peerPool) pick(ctx context.Context) (string, bool) {
+	for {
+		p.mu.Lock()
+		if len(p.peers) > 0 {
+			address := p.peers[p.next%len(p.peers)]
+			p.next++
+			p.mu.Unlock()
+			return address, true
+		}
+		added := p.added
+		p.mu.Unlock()
+
+		if !p.discover() {
+			return "", false
+		}
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return "", false
+		}
+	}
+}
+
+// size returns the number of usable peers
+func (p *peerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.peers)
+}
+
+// canDiscover reports whether local service discovery or the DHT can still
+// find peers for a torrent. Private torrents use neither.
+func canDiscover(private bool) bool {
+	if private {
+		return false
+	}
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+	return lsdService != nil || dhtNode != nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoolPick(t *testing.T) {
+	pool := &peerPool{known: make(map[string]bool), added: make(chan struct{})}
+	discovering := true
+	pool.discover = func() bool { return discovering }
+
+	// An empty pool waits for a peer to be discovered
+	picked := make(chan string)
+	go func() {
+		address, _ := pool.pick(context.Background())
+		picked <- address
+	}()
+	select {
+	case address := <-picked:
+		t.Fatalf("pick returned %q from an empty pool", address)
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.add("a:1")
+	if address := <-picked; address != "a:1" {
+		t.Fatalf("picked %q, want a:1", address)
+	}
+
+	// Peers are handed out in turn and known ones are not added twice
+	if pool.add("a:1") {
+		t.Error("a known peer was added again")
+	}
+	pool.add("b:2")
+	var got []string
+	for i := 0; i < 3; i++ {
+		address, _ := pool.pick(context.Background())
+		got = append(got, address)
+	}
+	if got[0] == got[1] || got[0] != got[2] {
+		t.Errorf("picks %v are not round-robin", got)
+	}
+
+	// Removed peers can be discovered again
+	pool.remove("a:1")
+	pool.remove("b:2")
+	if !pool.add("a:1") {
+		t.Error("a removed peer could not be added again")
+	}
+	pool.remove("a:1")
+
+	// Waiting ends with ctx, or at once when nothing can discover peers
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, ok := pool.pick(ctx); ok {
+		t.Error("pick from an empty pool succeeded after ctx was done")
+	}
+	discovering = false
+	start := time.Now()
+	if _, ok := pool.pick(context.Background()); ok || time.Since(start) > time.Second {
+		t.Error("pick waited without any discovery")
+	}
+}
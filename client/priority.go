@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+
+	"tcp-app/storage"
+	"tcp-app/torrent"
+)
+
+// Priority is how urgently a piece or file is wanted
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// ParsePriority parses skip, low, normal or high
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", s)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// Options control which pieces a download fetches and in what order
+type Options struct {
+	// Sequential downloads pieces in index order within each priority
+	// instead of picking them at random
+	Sequential bool
+	// FirstLastFirst fetches the first and last piece of every wanted file
+	// before the rest, which is what media players need to start
+	FirstLastFirst bool
+	// FilePriorities sets the priority of files by index. Files not listed
+	// are normal; skipped files are not written.
+	FilePriorities map[int]Priority
+	// PiecePriorities overrides the priority derived from the files
+	PiecePriorities map[int]Priority
+	// Storage selects where downloaded data is kept, plain files by default
+	Storage storage.Kind
+	// OutputDir is the directory the torrent is written below, the working
+	// directory by default
+	OutputDir string
+	// Peers are contacted in addition to those found through trackers,
+	// the DHT and local service discovery
+	Peers []string
+}
+
+func (o Options) filePriority(index int) Priority {
+	if p, ok := o.FilePriorities[index]; ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// piecePriorities works out the priority of every piece. A piece shared by
+// several files gets the highest priority among them, so the boundaries of
+// wanted files are downloaded even when their neighbours are skipped.
+func (o Options) piecePriorities(tf *torrent.TorrentFile) []Priority {
+	priorities := make([]Priority, len(tf.PieceHashes))
+	if tf.PieceLength == 0 {
+		return priorities
+	}
+	pieceLength := tf.PieceLength
+	for i, f := range tf.Layout() {
+		prio := o.filePriority(i)
+		if prio == PrioritySkip || f.Length == 0 || f.IsPadding() {
+			continue
+		}
+		first := f.Offset / pieceLength
+		last := (f.Offset + f.Length - 1) / pieceLength
+		for index := first; index <= last; index++ {
+			priorities[index] = max(priorities[index], prio)
+		}
+		if o.FirstLastFirst {
+			priorities[first] = PriorityHigh
+			priorities[last] = PriorityHigh
+		}
+	}
+	for index, prio := range o.PiecePriorities {
+		if index >= 0 && index < len(priorities) {
+			priorities[index] = prio
+		}
+	}
+	return priorities
+}
@@ -0,0 +1,26 @@
+package client
+
+import "sync"
+
+// Bytes of piece data received per torrent since the process started
+var (
+	statsMu         sync.Mutex
+	downloadedBytes = make(map[[20]byte]int64)
+)
+
+// Downloaded returns the piece data received for a torrent since the
+// process started, including pieces that failed verification
+func Downloaded(infoHash [20]byte) int64 {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return downloadedBytes[infoHash]
+}
+
+// received accounts for n bytes of piece data fetched for d, waiting for
+// the download rate limit
+func (d *download) received(n int) {
+	downloadLimiter.Wait(n)
+	statsMu.Lock()
+	downloadedBytes[d.tf.InfoHash] += int64(n)
+	statsMu.Unlock()
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tcp-app/torrent"
+)
+
+// streamReadahead is how many pieces after the one being read are bumped
+// along with it
+const streamReadahead = 4
+
+// StartStreamServer serves the files of running downloads over HTTP at
+// /<info hash>/<path>. Reads of regions that have not been downloaded yet
+// block until the pieces arrive.
+func StartStreamServer(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveStream)
+	fmt.Printf("Streaming downloads on %s\n", address)
+	return http.ListenAndServe(address, mux)
+}
+
+func serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		listStreams(w)
+		return
+	}
+
+	hash, filePath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	for _, d := range activeDownloads() {
+		if fmt.Sprintf("%x", d.tf.InfoHash) != hash {
+			continue
+		}
+		for i, f := range d.tf.Layout() {
+			if !streamable(d, i, f) || filepath.ToSlash(d.tf.FilePath(f)) != filePath {
+				continue
+			}
+			reader := &streamReader{ctx: r.Context(), d: d, file: f}
+			http.ServeContent(w, r, filePath, time.Time{}, reader)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// listStreams writes the URL path of every file that can be streamed
+func listStreams(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, d := range activeDownloads() {
+		for i, f := range d.tf.Layout() {
+			if !streamable(d, i, f) {
+				continue
+			}
+			fmt.Fprintf(w, "/%x/%s\n", d.tf.InfoHash, filepath.ToSlash(d.tf.FilePath(f)))
+		}
+	}
+}
+
+// streamable reports whether a file of a download has data to stream
+func streamable(d *download, index int, f torrent.File) bool {
+	return d.opts.filePriority(index) != PrioritySkip && !f.IsPadding() && !f.IsSymlink()
+}
+
+// streamReader reads one file of a download, waiting for missing pieces
+type streamReader struct {
+	ctx  context.Context
+	d    *download
+	file torrent.File
+	pos  int64
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	size := int64(s.file.Length)
+	if s.pos >= size {
+		return 0, io.EOF
+	}
+
+	offset := int64(s.file.Offset) + s.pos
+	pieceLength := int64(s.d.tf.PieceLength)
+	index := int(offset / pieceLength)
+	if err := s.d.waitPiece(s.ctx, index, streamReadahead); err != nil {
+		return 0, err
+	}
+
+	start := offset - int64(index)*pieceLength
+	n := min(int64(len(p)), size-s.pos, int64(s.d.tf.PieceSize(index))-start)
+	read, err := s.d.store.ReadAt(index, p[:n], start)
+	s.pos += int64(read)
+	return read, err
+}
+
+func (s *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += int64(s.file.Length)
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
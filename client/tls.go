@@ -0,0 +1,46 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"tcp-app/peer"
+	"tcp-app/tlsauth"
+)
+
+// tlsCredentials enables the private swarm mode when set: every peer
+// connection must complete mutual TLS against the configured CA
+var tlsCredentials *tlsauth.Credentials
+
+// SetTLS enables mutual TLS for outgoing connections, or disables it when
+// creds is nil. TLS replaces Message Stream Encryption.
+func SetTLS(creds *tlsauth.Credentials) {
+	tlsCredentials = creds
+}
+
+// dialSecure connects to a peer using TLS when configured, or the
+// encryption policy otherwise. The peer identity is empty without TLS.
+func dialSecure(address string, infoHash [20]byte, timeout time.Duration) (net.Conn, string, error) {
+	creds := tlsCredentials
+	if creds == nil {
+		conn, err := dialEncrypted(address, infoHash, timeout)
+		return conn, "", err
+	}
+	conn, err := peer.Dial(address, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	tlsConn, err := creds.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	id, err := tlsauth.PeerIdentity(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, "", err
+	}
+	fmt.Printf("Authenticated peer %s as %s\n", address, id)
+	return tlsConn, id.String(), nil
+}
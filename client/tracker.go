@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"tcp-app/ratelimit"
+	"tcp-app/torrent"
+	"tcp-app/tracker"
+)
+
+// peerID identifies this client to trackers
+var peerID = tracker.NewPeerID()
+
+// announceTimeout bounds each tracker request
+const announceTimeout = 15 * time.Second
+
+// downloadLimiter throttles piece data received from peers and web seeds;
+// nil means unlimited
+var downloadLimiter *ratelimit.Limiter
+
+// SetDownloadLimit limits the data all downloads fetch together to
+// bytesPerSecond. Zero removes the limit.
+func SetDownloadLimit(bytesPerSecond int64) {
+	downloadLimiter = ratelimit.New(bytesPerSecond)
+}
+
+// announceTrackers sends an announce to every tracker of the torrent and
+// returns the peers they know. Trackers that fail are reported and skipped.
+func announceTrackers(tf *torrent.TorrentFile, event string, left int64) []string {
+	var tlsConfig *tls.Config
+	if creds := tlsCredentials; creds != nil {
+		tlsConfig = creds.ClientConfig()
+	}
+	req := tracker.AnnounceRequest{
+		InfoHash:   tf.InfoHash,
+		PeerID:     peerID,
+		Port:       listenPort,
+		Downloaded: Downloaded(tf.InfoHash),
+		Left:       left,
+		Event:      event,
+	}
+
+	var peers []string
+	for _, url := range tf.Trackers() {
+		ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+		resp, err := tracker.Announce(ctx, url, req, tlsConfig)
+		cancel()
+		if err != nil {
+			fmt.Printf("Announce to %s failed: %v\n", url, err)
+			continue
+		}
+		if event == tracker.EventStarted {
+			fmt.Printf("Found %d peers through %s\n", len(resp.Peers), url)
+		}
+		for _, addr := range resp.Peers {
+			peers = append(peers, addr.String())
+		}
+	}
+	return peers
+}
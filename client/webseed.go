@@ -0,0 +1,203 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/torrent"
+)
+
+const (
+	// webSeedWorkers is how many pieces are fetched from one seed at a time
+	webSeedWorkers = 2
+	// webSeedMaxFailures is how many consecutive errors make us drop a seed
+	webSeedMaxFailures = 8
+	webSeedMinBackoff  = time.Second
+	webSeedMaxBackoff  = 60 * time.Second
+)
+
+var webSeedClient = &http.Client{Timeout: 60 * time.Second}
+
+// webSeed is an HTTP source for pieces, either a BEP 19 url-list entry
+// serving the files themselves or a BEP 17 seed serving whole pieces
+type webSeed struct {
+	url   string
+	bep17 bool
+	tf    *torrent.TorrentFile
+
+	mu       sync.Mutex
+	failures int
+	backoff  time.Duration
+}
+
+// webSeeds returns the HTTP seeds listed in a torrent
+func webSeeds(tf *torrent.TorrentFile) []*webSeed {
+	var seeds []*webSeed
+	for _, u := range tf.URLList {
+		seeds = append(seeds, &webSeed{url: u, tf: tf})
+	}
+	for _, u := range tf.HTTPSeeds {
+		seeds = append(seeds, &webSeed{url: u, bep17: true, tf: tf})
+	}
+	return seeds
+}
+
+// webSeedWorker takes pieces from the picker and fetches them from the
+// seed until the download ends or the seed fails too often
+func webSeedWorker(seed *webSeed, d *download, results chan<- PieceResult) {
+	for {
+		piece, ok := d.nextWork()
+		if !ok {
+			return
+		}
+		fmt.Printf("Downloading piece %d from web seed %s\n", piece.Index, seed.url)
+		data, err := seed.fetch(piece)
+		d.received(len(data))
+		results <- PieceResult{Index: piece.Index, Data: data, Error: err}
+		if err == nil {
+			seed.succeeded()
+			continue
+		}
+
+		wait, ok := seed.failed()
+		if !ok {
+			fmt.Printf("Giving up on web seed %s: %v\n", seed.url, err)
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// failed records an error and returns how long to wait before the next
+// request, or false once the seed should no longer be used
+func (s *webSeed) failed() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if s.failures >= webSeedMaxFailures {
+		return 0, false
+	}
+	if s.backoff == 0 {
+		s.backoff = webSeedMinBackoff
+	} else {
+		s.backoff = min(2*s.backoff, webSeedMaxBackoff)
+	}
+	return s.backoff, true
+}
+
+func (s *webSeed) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+	s.backoff = 0
+}
+
+func (s *webSeed) fetch(piece PieceWork) ([]byte, error) {
+	if s.bep17 {
+		return s.fetchPiece(piece)
+	}
+	data := make([]byte, 0, piece.Size)
+	layout := s.tf.Layout()
+	for _, span := range s.tf.PieceSpans(piece.Index) {
+		if layout[span.FileIndex].IsPadding() {
+			data = append(data, make([]byte, span.Length)...)
+			continue
+		}
+		chunk, err := s.fetchRange(s.fileURL(span.FileIndex), span.Offset, span.Length)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// fileURL builds the BEP 19 URL of a file. A seed URL ending in a slash
+// names a directory the torrent's name is appended to; multi-file torrents
+// always live below the seed URL.
+func (s *webSeed) fileURL(fileIndex int) string {
+	if len(s.tf.Files) == 0 {
+		if strings.HasSuffix(s.url, "/") {
+			return s.url + url.PathEscape(s.tf.Name)
+		}
+		return s.url
+	}
+	u := s.url
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	u += url.PathEscape(s.tf.Name)
+	for _, part := range s.tf.Files[fileIndex].Path {
+		u += "/" + url.PathEscape(part)
+	}
+	return u
+}
+
+// fetchRange reads length bytes at offset of a file. Servers that ignore
+// the Range header are tolerated by skipping ahead in the full response.
+func (s *webSeed) fetchRange(fileURL string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web seed url: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := webSeedClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("web seed request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return nil, fmt.Errorf("web seed response too short: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("web seed returned %s", resp.Status)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("error reading web seed data: %v", err)
+	}
+	return data, nil
+}
+
+// fetchPiece requests a whole piece from a BEP 17 seed
+func (s *webSeed) fetchPiece(piece PieceWork) ([]byte, error) {
+	sep := "?"
+	if strings.Contains(s.url, "?") {
+		sep = "&"
+	}
+	u := s.url + sep + "info_hash=" + url.QueryEscape(string(s.tf.InfoHash[:])) +
+		"&piece=" + strconv.Itoa(piece.Index)
+
+	resp, err := webSeedClient.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("web seed request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		// The body holds the number of seconds to wait before retrying
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+		return nil, fmt.Errorf("web seed busy, retry in %s seconds", strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("web seed returned %s", resp.Status)
+	}
+
+	data := make([]byte, piece.Size)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("error reading web seed data: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"tcp-app/torrent"
+)
+
+// writeRandom creates a file of size random bytes
+func writeRandom(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTorrent hashes path with small pieces so pieces cross file ends
+func createTorrent(t *testing.T, path string, align bool) torrent.TorrentFile {
+	t.Helper()
+	opts := torrent.CreateOptions{PieceLength: torrent.MinPieceLength, Align: align}
+	tf, err := torrent.CreateTorrentContext(context.Background(), path, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+// rangeServer serves the files below dir and records the Range headers of
+// the requests it gets
+type rangeServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newRangeServer(t *testing.T, dir string) *rangeServer {
+	s := &rangeServer{}
+	files := http.FileServer(http.Dir(dir))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fetchAll fetches every piece from seed and checks it against its hash
+func fetchAll(t *testing.T, seed *webSeed) {
+	t.Helper()
+	for i, hash := range seed.tf.PieceHashes {
+		data, err := seed.fetch(PieceWork{Index: i, Hash: hash[:], Size: int64(seed.tf.PieceSize(i))})
+		if err != nil {
+			t.Fatalf("piece %d: %v", i, err)
+		}
+		if sha1.Sum(data) != hash {
+			t.Fatalf("piece %d does not match its hash", i)
+		}
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.bin")
+	writeRandom(t, path, 3*torrent.MinPieceLength+1234)
+	tf := createTorrent(t, path, false)
+	srv := newRangeServer(t, dir)
+
+	// A URL ending in a slash names the directory holding the file
+	fetchAll(t, &webSeed{url: srv.URL + "/", tf: &tf})
+	// Otherwise it is the file itself
+	fetchAll(t, &webSeed{url: srv.URL + "/image.bin", tf: &tf})
+
+	for _, r := range srv.ranges {
+		if !strings.HasPrefix(r, "bytes=") {
+			t.Errorf("request without a byte range: %q", r)
+		}
+	}
+	// The short last piece asks for exactly the bytes that remain
+	last := len(tf.PieceHashes) - 1
+	want := fmt.Sprintf("bytes=%d-%d", last*tf.PieceLength, tf.Length-1)
+	if got := srv.ranges[last]; got != want {
+		t.Errorf("last piece requested %q, want %q", got, want)
+	}
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "release")
+	writeRandom(t, filepath.Join(root, "a.bin"), torrent.MinPieceLength+100)
+	writeRandom(t, filepath.Join(root, "docs", "read me.txt"), 500)
+	writeRandom(t, filepath.Join(root, "z.bin"), 2*torrent.MinPieceLength)
+
+	for _, align := range []bool{false, true} {
+		tf := createTorrent(t, root, align)
+		srv := newRangeServer(t, dir)
+		fetchAll(t, &webSeed{url: srv.URL, tf: &tf})
+
+		for _, r := range srv.ranges {
+			if r == "" {
+				t.Errorf("align=%v: request without a byte range", align)
+			}
+		}
+		// Pieces crossing file ends need one request per file touched, but
+		// padding files are never requested
+		spans := 0
+		for i := range tf.PieceHashes {
+			for _, span := range tf.PieceSpans(i) {
+				if !tf.Layout()[span.FileIndex].IsPadding() {
+					spans++
+				}
+			}
+		}
+		if len(srv.ranges) != spans {
+			t.Errorf("align=%v: %d requests for %d file spans", align, len(srv.ranges), spans)
+		}
+	}
+}
+
+func TestWebSeedIgnoringRange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.bin")
+	writeRandom(t, path, 2*torrent.MinPieceLength+10)
+	tf := createTorrent(t, path, false)
+
+	// A server that always sends the whole file with 200 OK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := os.ReadFile(path)
+		w.Write(data)
+	}))
+	defer srv.Close()
+	fetchAll(t, &webSeed{url: srv.URL, tf: &tf})
+}
+
+func TestWebSeedErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.bin")
+	writeRandom(t, path, torrent.MinPieceLength)
+	tf := createTorrent(t, path, false)
+	srv := newRangeServer(t, t.TempDir())
+
+	seed := &webSeed{url: srv.URL + "/", tf: &tf}
+	if _, err := seed.fetch(PieceWork{Index: 0, Size: int64(tf.PieceSize(0))}); err == nil {
+		t.Fatal("fetching a missing file succeeded")
+	}
+
+	// Errors back off exponentially until the seed is dropped
+	var waits []int64
+	for {
+		wait, ok := seed.failed()
+		if !ok {
+			break
+		}
+		waits = append(waits, int64(wait))
+	}
+	if len(waits) != webSeedMaxFailures-1 {
+		t.Fatalf("seed dropped after %d failures, want %d", len(waits)+1, webSeedMaxFailures)
+	}
+	for i := 1; i < len(waits); i++ {
+		if waits[i] < waits[i-1] || waits[i] > int64(webSeedMaxBackoff) {
+			t.Errorf("backoff %d is %d after %d", i, waits[i], waits[i-1])
+		}
+	}
+	seed.succeeded()
+	if wait, ok := seed.failed(); !ok || wait != webSeedMinBackoff {
+		t.Errorf("after a success the backoff is %v, %v", wait, ok)
+	}
+}
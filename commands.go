@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"tcp-app/client"
+	"tcp-app/mse"
+	"tcp-app/server"
+	"tcp-app/storage"
+	"tcp-app/tlsauth"
+	"tcp-app/torrent"
+	"tcp-app/tracker"
+)
+
+// policyInterval is how often seed checks its seeding policy
+const policyInterval = 5 * time.Second
+
+// defaultPeerAddress is where seed listens for peers unless --listen says
+// otherwise. The DHT already uses UDP port 6881.
+const defaultPeerAddress = ":6882"
+
+// nodeConfig holds the flags shared by the commands that talk to peers
+type nodeConfig struct {
+	listen       string
+	downloadRate int64
+	uploadRate   int64
+	dht          bool
+	lsd          bool
+	encryption   *mse.Policy
+	tls          *tlsauth.Credentials
+	// stateDir holds the completion database and the DHT routing table.
+	// Empty means the user's cache directory, see defaultStateDir.
+	stateDir string
+}
+
+// parseNodeFlags takes the peer networking flags out of args and returns
+// the remaining arguments for the command itself
+func parseNodeFlags(args []string) (nodeConfig, []string, error) {
+	var node nodeConfig
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("%s needs a value", args[i])
+			}
+			i++
+			return args[i], nil
+		}
+		switch args[i] {
+		case "--dht":
+			node.dht = true
+		case "--lsd":
+			node.lsd = true
+		case "--listen":
+			address, err := value()
+			if err != nil {
+				return node, nil, err
+			}
+			node.listen = address
+		case "--max-download-rate", "--max-upload-rate":
+			flag := args[i]
+			v, err := value()
+			if err != nil {
+				return node, nil, err
+			}
+			rate, err := parseSize(v)
+			if err != nil {
+				return node, nil, err
+			}
+			if flag == "--max-download-rate" {
+				node.downloadRate = int64(rate)
+			} else {
+				node.uploadRate = int64(rate)
+			}
+		case "--encryption":
+			v, err := value()
+			if err != nil {
+				return node, nil, err
+			}
+			policy, err := mse.ParsePolicy(v)
+			if err != nil {
+				return node, nil, err
+			}
+			node.encryption = &policy
+		case "--tls":
+			if i+3 >= len(args) {
+				return node, nil, fmt.Errorf("--tls needs a CA, certificate and key file")
+			}
+			creds, err := tlsauth.Load(args[i+1], args[i+2], args[i+3])
+			if err != nil {
+				return node, nil, fmt.Errorf("failed to load TLS credentials: %v", err)
+			}
+			node.tls = creds
+			i += 3
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return node, rest, nil
+}
+
+// start applies the configuration to the client and server and starts the
+// discovery services asked for. The returned function stops them.
+func (node nodeConfig) start() (func(), error) {
+	stateDir := node.stateDir
+	if stateDir == "" {
+		stateDir = defaultStateDir()
+	}
+	if stateDir == "" {
+		fmt.Println("Piece completion will not be remembered: no cache directory")
+	} else if db, err := storage.OpenCompletionDB(filepath.Join(stateDir, "completion")); err != nil {
+		fmt.Printf("Piece completion will not be remembered: %v\n", err)
+	} else {
+		client.SetCompletionDB(db)
+		server.SetCompletionDB(db)
+	}
+	if node.encryption != nil {
+		server.SetEncryptionPolicy(*node.encryption)
+		client.SetEncryptionPolicy(*node.encryption)
+	}
+	if node.tls != nil {
+		server.SetTLS(node.tls)
+		client.SetTLS(node.tls)
+	}
+	client.SetDownloadLimit(node.downloadRate)
+	server.SetUploadLimit(node.uploadRate)
+	if node.listen != "" {
+		port, err := listenPort(node.listen)
+		if err != nil {
+			return nil, err
+		}
+		client.SetListenPort(port)
+	}
+
+	stopDHT := func() {}
+	if node.dht {
+		stopDHT = joinDHT(stateDir)
+	}
+	if node.lsd {
+		if err := enableLSD(true); err != nil {
+			fmt.Printf("Local service discovery disabled: %v\n", err)
+		}
+	}
+	return func() {
+		enableLSD(false)
+		stopDHT()
+	}, nil
+}
+
+// defaultStateDir returns where the completion database and DHT routing
+// table live unless configured otherwise: tcp-app in the user's cache
+// directory, or "" when there is none
+func defaultStateDir() string {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cache, "tcp-app")
+}
+
+// runCreate creates a torrent and returns the exit code
+func runCreate(args []string) int {
+	if len(args) < 1 {
+		fmt.Println("Usage: create [file|dir] [web-seed-url...] [--piece-length size] [--align] [--tracker url]")
+		return 2
+	}
+	opts, err := parseCreateOptions(args[1:])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	opts.Progress = hashProgressPrinter()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	torrentFileName, err := torrent.CreateContext(ctx, args[0], opts)
+	fmt.Println()
+	if err != nil {
+		fmt.Printf("Failed to create torrent file: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Torrent file created successfully: %s\n", torrentFileName)
+	return 0
+}
+
+// runDownload downloads a torrent and returns the exit code. With --listen
+// the server runs too, so the port announced to trackers is reachable.
+func runDownload(args []string) int {
+	node, rest, err := parseNodeFlags(args)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if len(rest) < 1 {
+		fmt.Println("Usage: download [torrent-file] [--output dir] [--peer address ...] [--sequential] [--first-last]")
+		fmt.Println("                [--file index=priority ...] [--storage kind] [--listen address] [--dht] [--lsd]")
+		fmt.Println("                [--max-download-rate rate] [--max-upload-rate rate] [--encryption policy] [--tls ca cert key]")
+		return 2
+	}
+	opts, err := parseDownloadOptions(rest[1:])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	stop, err := node.start()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer stop()
+	if node.listen != "" {
+		go func() {
+			if err := server.StartServer(node.listen); err != nil {
+				fmt.Printf("Server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	if err := client.StartDownloadWithOptions(rest[0], opts); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// runSeed serves a torrent until interrupted or until its seeding policy
+// is reached, and returns the exit code
+func runSeed(args []string) int {
+	node, rest, err := parseNodeFlags(args)
+	var policy server.SeedPolicy
+	if err == nil {
+		policy, rest, err = takePolicyFlags(rest)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	var positional []string
+	webSeedAddress := ""
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case "--storage", "--webseed":
+			if i+1 >= len(rest) {
+				fmt.Printf("%s needs a value\n", rest[i])
+				return 2
+			}
+			if rest[i] == "--webseed" {
+				webSeedAddress = rest[i+1]
+			} else {
+				kind, err := storage.ParseKind(rest[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return 2
+				}
+				server.SetStorage(kind)
+			}
+			i++
+		default:
+			positional = append(positional, rest[i])
+		}
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		fmt.Println("Usage: seed [torrent-file] [path] [--listen address] [--storage kind] [--webseed address]")
+		fmt.Println("            [--max-upload-rate rate] [--dht] [--lsd] [--encryption policy] [--tls ca cert key]")
+		fmt.Println("            [--ratio ratio] [--seed-time duration] [--idle-time duration]")
+		return 2
+	}
+	if node.listen == "" {
+		node.listen = defaultPeerAddress
+	}
+	stop, err := node.start()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer stop()
+
+	dataPath := ""
+	if len(positional) == 2 {
+		dataPath = positional[1]
+	}
+	tf, err := server.Seed(positional[0], dataPath)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	errs := make(chan error, 3)
+	go func() { errs <- server.StartServer(node.listen) }()
+	if webSeedAddress != "" {
+		go func() { errs <- server.StartWebSeed(webSeedAddress) }()
+	}
+	if !policy.IsZero() {
+		go func() { errs <- seedUntil(tf, policy) }()
+	}
+	return waitInterrupt(errs)
+}
+
+// takePolicyFlags removes the seeding policy flags from args and returns
+// the policy they set, which has no limits if they are absent
+func takePolicyFlags(args []string) (server.SeedPolicy, []string, error) {
+	var policy server.SeedPolicy
+	value, args, err := takeFlag(args, "--ratio", "0")
+	if err != nil {
+		return policy, nil, err
+	}
+	policy.Ratio, err = strconv.ParseFloat(value, 64)
+	if err != nil || policy.Ratio < 0 {
+		return policy, nil, fmt.Errorf("invalid --ratio %q", value)
+	}
+	durations := []struct {
+		flag     string
+		duration *time.Duration
+	}{
+		{"--seed-time", &policy.SeedTime},
+		{"--idle-time", &policy.IdleTime},
+	}
+	for _, f := range durations {
+		value, rest, err := takeFlag(args, f.flag, "0s")
+		if err != nil {
+			return policy, nil, err
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return policy, nil, fmt.Errorf("invalid %s %q", f.flag, value)
+		}
+		*f.duration, args = duration, rest
+	}
+	return policy, args, nil
+}
+
+// seedUntil returns once the torrent seeded by this process has reached
+// policy, and stops seeding it. Seeding time and the ratio count from the
+// start of the process.
+func seedUntil(tf torrent.TorrentFile, policy server.SeedPolicy) error {
+	start := time.Now()
+	ticker := time.NewTicker(policyInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		idleSince := start
+		if last := server.LastUpload(tf.InfoHash); last.After(idleSince) {
+			idleSince = last
+		}
+		reason := policy.Reached(server.SeedStats{
+			Uploaded: server.Uploaded(tf.InfoHash),
+			Size:     int64(tf.Length),
+			Seeding:  time.Since(start),
+			Idle:     time.Since(idleSince),
+		})
+		if reason != "" {
+			fmt.Printf("Stopping: %s\n", reason)
+			server.Unseed(tf.InfoHash)
+			return nil
+		}
+	}
+	return nil
+}
+
+// runTracker runs an HTTP tracker until interrupted and returns the exit
+// code
+func runTracker(args []string) int {
+	address := ":8080"
+	var creds *tlsauth.Credentials
+	var trusted []*net.IPNet
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--listen" && i+1 < len(args):
+			address = args[i+1]
+			i++
+		case args[i] == "--trusted-proxy" && i+1 < len(args):
+			network, err := parseNetwork(args[i+1])
+			if err != nil {
+				fmt.Println(err)
+				return 2
+			}
+			trusted = append(trusted, network)
+			i++
+		case args[i] == "--tls" && i+3 < len(args):
+			var err error
+			creds, err = tlsauth.Load(args[i+1], args[i+2], args[i+3])
+			if err != nil {
+				fmt.Printf("Failed to load TLS credentials: %v\n", err)
+				return 2
+			}
+			i += 3
+		default:
+			fmt.Println("Usage: tracker [--listen address] [--tls ca cert key] [--trusted-proxy cidr ...]")
+			return 2
+		}
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- tracker.ListenAndServe(address, creds, trusted) }()
+	return waitInterrupt(errs)
+}
+
+// parseNetwork parses a CIDR network, or a single address as a network of
+// one
+func parseNetwork(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// waitInterrupt blocks until Ctrl-C, which is a clean exit, or until a
+// server fails. A nil error from errs also exits cleanly.
+func waitInterrupt(errs <-chan error) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		fmt.Println("Exiting...")
+		return 0
+	case err := <-errs:
+		if err == nil {
+			return 0
+		}
+		fmt.Println(err)
+		return 1
+	}
+}
+
+// listenPort returns the port of a listen address such as ":6882"
+func listenPort(address string) (int, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen address %q: %v", address, err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen port %q", port)
+	}
+	return n, nil
+}
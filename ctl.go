@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"tcp-app/daemon"
+	"tcp-app/server"
+)
+
+// takeFlag removes a flag with a value from args and returns the value,
+// or def if the flag is absent
+func takeFlag(args []string, flag, def string) (string, []string, error) {
+	value := def
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if args[i] != flag {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return "", nil, fmt.Errorf("%s needs a value", flag)
+		}
+		i++
+		value = args[i]
+	}
+	return value, rest, nil
+}
+
+// takeLimitFlags removes the queue limit flags from args and returns the
+// limits, the defaults for flags that are absent
+func takeLimitFlags(args []string) (daemon.Limits, []string, error) {
+	limits := daemon.DefaultLimits
+	counts := []struct {
+		flag  string
+		limit *int
+	}{
+		{"--max-active-downloads", &limits.MaxActiveDownloads},
+		{"--max-active-seeds", &limits.MaxActiveSeeds},
+	}
+	for _, c := range counts {
+		value, rest, err := takeFlag(args, c.flag, strconv.Itoa(*c.limit))
+		if err != nil {
+			return limits, nil, err
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return limits, nil, fmt.Errorf("invalid %s %q", c.flag, value)
+		}
+		*c.limit, args = n, rest
+	}
+	value, args, err := takeFlag(args, "--stall-timeout", limits.StallTimeout.String())
+	if err != nil {
+		return limits, nil, err
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return limits, nil, fmt.Errorf("invalid --stall-timeout %q", value)
+	}
+	limits.StallTimeout = timeout
+	return limits, args, nil
+}
+
+// takeDaemonPolicyFlags removes the seeding policy flags and
+// --policy-action from args and returns the policy they set
+func takeDaemonPolicyFlags(args []string) (daemon.Policy, []string, error) {
+	limits, args, err := takePolicyFlags(args)
+	if err != nil {
+		return daemon.Policy{}, nil, err
+	}
+	value, args, err := takeFlag(args, "--policy-action", string(daemon.ActionStop))
+	if err != nil {
+		return daemon.Policy{}, nil, err
+	}
+	action, err := daemon.ParsePolicyAction(value)
+	if err != nil {
+		return daemon.Policy{}, nil, err
+	}
+	return daemon.NewPolicy(limits, action), args, nil
+}
+
+// takeSocketFlag removes --socket from args and returns its value, the
+// default socket if absent
+func takeSocketFlag(args []string) (string, []string, error) {
+	return takeFlag(args, "--socket", daemon.DefaultSocket)
+}
+
+// runDaemon manages torrents in the background until interrupted, taking
+// commands on a Unix socket. Torrents beyond the active limits wait in a
+// queue. Torrents are seeded on the listen address, and the session is
+// restored from the state directory on startup.
+func runDaemon(args []string) int {
+	socket, args, err := takeSocketFlag(args)
+	var stateDir string
+	if err == nil {
+		stateDir, args, err = takeFlag(args, "--state", "state")
+	}
+	var limits daemon.Limits
+	if err == nil {
+		limits, args, err = takeLimitFlags(args)
+	}
+	var policy daemon.Policy
+	if err == nil {
+		policy, args, err = takeDaemonPolicyFlags(args)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	node, rest, err := parseNodeFlags(args)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unexpected argument %q", rest[0])
+	}
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Usage: daemon [--socket path] [--state dir] [--listen address] [--dht] [--lsd] [--max-download-rate rate]")
+		fmt.Println("              [--max-upload-rate rate] [--encryption policy] [--tls ca cert key]")
+		fmt.Println("              [--max-active-downloads n] [--max-active-seeds n] [--stall-timeout duration]")
+		fmt.Println("              [--ratio ratio] [--seed-time duration] [--idle-time duration] [--policy-action stop|remove]")
+		return 2
+	}
+	if node.listen == "" {
+		node.listen = defaultPeerAddress
+	}
+	// Resume bitfields and the DHT routing table live with the rest of
+	// the session
+	node.stateDir = stateDir
+	stop, err := node.start()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer stop()
+
+	listener, err := daemon.ListenUnix(socket)
+	if err != nil {
+		fmt.Printf("Error opening control socket: %v\n", err)
+		return 1
+	}
+	defer os.Remove(socket)
+	defer listener.Close()
+
+	d, err := daemon.New(stateDir, limits, policy)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer d.Close()
+	errs := make(chan error, 2)
+	go func() { errs <- server.StartServer(node.listen) }()
+	go func() { errs <- d.Serve(listener) }()
+	fmt.Printf("Daemon listening on %s\n", socket)
+	return waitInterrupt(errs)
+}
+
+// runCtl sends a command to a running daemon and returns the exit code
+func runCtl(args []string) int {
+	socket, args, err := takeSocketFlag(args)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if len(args) == 0 {
+		ctlUsage()
+		return 2
+	}
+	c := daemon.Dial(socket)
+
+	switch action, args := args[0], args[1:]; action {
+	case "list":
+		if len(args) > 1 || (len(args) == 1 && args[0] != "--json") {
+			ctlUsage()
+			return 2
+		}
+		list, err := c.List()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if len(args) == 1 {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(list)
+			return 0
+		}
+		printStatusList(list)
+		return 0
+
+	case "add":
+		req := daemon.AddRequest{}
+		for i := 0; i < len(args); i++ {
+			switch {
+			case args[i] == "--paused":
+				req.Paused = true
+			case args[i] == "--output" && i+1 < len(args):
+				i++
+				req.OutputDir = args[i]
+			case req.TorrentPath == "":
+				req.TorrentPath = args[i]
+			default:
+				ctlUsage()
+				return 2
+			}
+		}
+		if req.TorrentPath == "" {
+			ctlUsage()
+			return 2
+		}
+		// The daemon resolves paths against its own working directory
+		if req.TorrentPath, err = filepath.Abs(req.TorrentPath); err == nil {
+			req.OutputDir, err = filepath.Abs(req.OutputDir)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		status, err := c.Add(req)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("Added %s (%s), %s\n", status.Name, status.InfoHash, status.State)
+		return 0
+
+	case "remove", "pause", "resume":
+		if len(args) != 1 {
+			ctlUsage()
+			return 2
+		}
+		actions := map[string]func(string) error{"remove": c.Remove, "pause": c.Pause, "resume": c.Resume}
+		if err := actions[action](args[0]); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+
+	case "move":
+		if len(args) != 2 {
+			ctlUsage()
+			return 2
+		}
+		req, err := parseMove(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		if err := c.Move(args[0], req); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+
+	case "policy":
+		if len(args) == 2 && args[1] == "default" {
+			if err := c.SetPolicy(args[0], nil); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			return 0
+		}
+		if len(args) < 2 {
+			ctlUsage()
+			return 2
+		}
+		policy, rest, err := takeDaemonPolicyFlags(args[1:])
+		if err == nil && len(rest) > 0 {
+			err = fmt.Errorf("unexpected argument %q", rest[0])
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		if err := c.SetPolicy(args[0], &policy); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+
+	case "priority":
+		if len(args) != 3 {
+			ctlUsage()
+			return 2
+		}
+		index, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Printf("invalid file index %q\n", args[1])
+			return 2
+		}
+		if err := c.SetFilePriority(args[0], index, args[2]); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+	ctlUsage()
+	return 2
+}
+
+func ctlUsage() {
+	fmt.Println("Usage: ctl [--socket path] <action>")
+	fmt.Println("  list [--json]                        List torrents and their progress")
+	fmt.Println("  add [torrent-file] [--output dir] [--paused]")
+	fmt.Println("  remove|pause|resume [info-hash]      The info hash may be shortened to a unique prefix")
+	fmt.Println("  move [info-hash] top|bottom|up|down|[position]")
+	fmt.Println("  priority [info-hash] [file-index] skip|low|normal|high")
+	fmt.Println("  policy [info-hash] default|[--ratio ratio] [--seed-time duration] [--idle-time duration]")
+	fmt.Println("                          [--policy-action stop|remove]")
+}
+
+// parseMove turns the target of ctl move into a request
+func parseMove(to string) (daemon.MoveRequest, error) {
+	position := func(n int) daemon.MoveRequest { return daemon.MoveRequest{Position: &n} }
+	switch to {
+	case "top":
+		return position(0), nil
+	case "bottom":
+		return position(math.MaxInt32), nil
+	case "up":
+		return daemon.MoveRequest{By: -1}, nil
+	case "down":
+		return daemon.MoveRequest{By: 1}, nil
+	}
+	n, err := strconv.Atoi(to)
+	if err != nil || n < 0 {
+		return daemon.MoveRequest{}, fmt.Errorf("invalid queue position %q", to)
+	}
+	return position(n), nil
+}
+
+// printStatusList prints one line per torrent
+func printStatusList(list []daemon.Status) {
+	if len(list) == 0 {
+		fmt.Println("No torrents")
+		return
+	}
+	fmt.Printf("%4s %-10s %-12s %7s %10s %10s %6s  %s\n", "POS", "HASH", "STATE", "DONE", "DOWN", "UP", "RATIO", "NAME")
+	for _, s := range list {
+		done := 0.0
+		if s.Pieces > 0 {
+			done = float64(s.PiecesDone) * 100 / float64(s.Pieces)
+		}
+		fmt.Printf("%4d %-10s %-12s %6.1f%% %10s %10s %6.2f  %s\n", s.QueuePosition, s.InfoHash[:8], s.State, done,
+			formatBytes(s.Downloaded), formatBytes(s.Uploaded), s.Ratio, s.Name)
+		if s.Error != "" {
+			fmt.Printf("%15s %s\n", "", s.Error)
+		}
+	}
+}
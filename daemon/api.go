@@ -0,0 +1,180 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"tcp-app/client"
+)
+
+// DefaultSocket is where the daemon listens unless told otherwise
+const DefaultSocket = "tcp-app.sock"
+
+// AddRequest is the body of POST /torrents
+type AddRequest struct {
+	// TorrentPath and OutputDir should be absolute, since the daemon may
+	// run in another directory than the client
+	TorrentPath string `json:"torrent_path"`
+	OutputDir   string `json:"output_dir"`
+	Paused      bool   `json:"paused"`
+}
+
+// MoveRequest is the body of POST /torrents/{hash}/move. If Position is
+// set the torrent moves there, counting from 0; otherwise it moves By
+// places towards the back, or towards the front if negative.
+type MoveRequest struct {
+	Position *int `json:"position,omitempty"`
+	By       int  `json:"by,omitempty"`
+}
+
+// PriorityRequest is the body of PUT /torrents/{hash}/files/{index}/priority
+type PriorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the control API:
+//
+//	GET    /torrents                              list torrents
+//	POST   /torrents                              add a torrent (AddRequest)
+//	DELETE /torrents/{hash}                       remove a torrent
+//	POST   /torrents/{hash}/pause                 pause a torrent
+//	POST   /torrents/{hash}/resume                resume a torrent
+//	POST   /torrents/{hash}/move                  change the queue position (MoveRequest)
+//	PUT    /torrents/{hash}/policy                set the seeding policy (Policy)
+//	DELETE /torrents/{hash}/policy                follow the global seeding policy
+//	PUT    /torrents/{hash}/files/{index}/priority set a file priority (PriorityRequest)
+//
+// {hash} may be a unique prefix of the hex info hash.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /torrents", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.List())
+	})
+	mux.HandleFunc("POST /torrents", func(w http.ResponseWriter, r *http.Request) {
+		var req AddRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TorrentPath == "" {
+			writeError(w, fmt.Errorf("invalid add request"))
+			return
+		}
+		status, err := d.Add(req.TorrentPath, req.OutputDir, req.Paused)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+	})
+	mux.HandleFunc("DELETE /torrents/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, d.Remove(r.PathValue("hash")))
+	})
+	mux.HandleFunc("POST /torrents/{hash}/pause", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, d.Pause(r.PathValue("hash")))
+	})
+	mux.HandleFunc("POST /torrents/{hash}/resume", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, d.Resume(r.PathValue("hash")))
+	})
+	mux.HandleFunc("POST /torrents/{hash}/move", func(w http.ResponseWriter, r *http.Request) {
+		var req MoveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, fmt.Errorf("invalid move request"))
+			return
+		}
+		if req.Position != nil {
+			writeResult(w, d.Move(r.PathValue("hash"), *req.Position))
+			return
+		}
+		writeResult(w, d.MoveBy(r.PathValue("hash"), req.By))
+	})
+	mux.HandleFunc("PUT /torrents/{hash}/policy", func(w http.ResponseWriter, r *http.Request) {
+		var policy Policy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeError(w, fmt.Errorf("invalid policy"))
+			return
+		}
+		writeResult(w, d.SetPolicy(r.PathValue("hash"), &policy))
+	})
+	mux.HandleFunc("DELETE /torrents/{hash}/policy", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, d.SetPolicy(r.PathValue("hash"), nil))
+	})
+	mux.HandleFunc("PUT /torrents/{hash}/files/{index}/priority", func(w http.ResponseWriter, r *http.Request) {
+		index, err := strconv.Atoi(r.PathValue("index"))
+		if err != nil {
+			writeError(w, fmt.Errorf("invalid file index %q", r.PathValue("index")))
+			return
+		}
+		var req PriorityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, fmt.Errorf("invalid priority request"))
+			return
+		}
+		priority, err := client.ParsePriority(req.Priority)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, d.SetFilePriority(r.PathValue("hash"), index, priority))
+	})
+	return mux
+}
+
+// ListenUnix listens on a Unix socket, replacing a socket left behind by a
+// daemon that did not shut down cleanly
+func ListenUnix(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the owner may control the daemon
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve answers API requests on listener until it is closed
+func (d *Daemon) Serve(listener net.Listener) error {
+	err := http.Serve(listener, d.Handler())
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrExists):
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, errorResponse{err.Error()})
+}
@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client talks to a daemon over its Unix socket
+type Client struct {
+	http *http.Client
+}
+
+// Dial returns a client for the daemon listening on socketPath. No
+// connection is made until the first request.
+func Dial(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	// Pausing waits for in-flight pieces, so allow for slow peers
+	return &Client{http: &http.Client{Transport: transport, Timeout: time.Minute}}
+}
+
+// List returns the status of every torrent
+func (c *Client) List() ([]Status, error) {
+	var list []Status
+	err := c.do(http.MethodGet, "/torrents", nil, &list)
+	return list, err
+}
+
+// Add adds a torrent to the daemon
+func (c *Client) Add(req AddRequest) (Status, error) {
+	var status Status
+	err := c.do(http.MethodPost, "/torrents", req, &status)
+	return status, err
+}
+
+// Remove stops and forgets a torrent
+func (c *Client) Remove(infoHash string) error {
+	return c.do(http.MethodDelete, "/torrents/"+url.PathEscape(infoHash), nil, nil)
+}
+
+// Pause pauses a torrent
+func (c *Client) Pause(infoHash string) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/pause", nil, nil)
+}
+
+// Resume resumes a torrent
+func (c *Client) Resume(infoHash string) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/resume", nil, nil)
+}
+
+// Move changes the queue position of a torrent
+func (c *Client) Move(infoHash string, req MoveRequest) error {
+	return c.do(http.MethodPost, "/torrents/"+url.PathEscape(infoHash)+"/move", req, nil)
+}
+
+// SetPolicy sets the seeding policy of a torrent, or makes it follow the
+// global policy if policy is nil
+func (c *Client) SetPolicy(infoHash string, policy *Policy) error {
+	path := "/torrents/" + url.PathEscape(infoHash) + "/policy"
+	if policy == nil {
+		return c.do(http.MethodDelete, path, nil, nil)
+	}
+	return c.do(http.MethodPut, path, policy, nil)
+}
+
+// SetFilePriority sets the priority of one file of a torrent
+func (c *Client) SetFilePriority(infoHash string, file int, priority string) error {
+	path := fmt.Sprintf("/torrents/%s/files/%d/priority", url.PathEscape(infoHash), file)
+	return c.do(http.MethodPut, path, PriorityRequest{Priority: priority}, nil)
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out. API errors are returned with the daemon's message.
+func (c *Client) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	// The host is ignored; requests go to the socket
+	req, err := http.NewRequest(method, "http://daemon"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr errorResponse
+		if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusConflict:
+			return ErrExists
+		}
+		return errors.New(apiErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
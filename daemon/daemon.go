@@ -0,0 +1,473 @@
+// Package daemon manages a set of torrents in one long-running process:
+// each is downloaded in the background and seeded once complete until its
+// seeding policy is reached, with limits on how many run at once. The
+// torrents are controlled through a JSON API served on a Unix socket, and
+// the session is kept in a state directory so it survives restarts.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp-app/client"
+	"tcp-app/server"
+	"tcp-app/torrent"
+)
+
+var (
+	// ErrNotFound is returned for info hashes the daemon does not manage
+	ErrNotFound = errors.New("torrent not found")
+	// ErrExists is returned when adding a torrent that is already managed
+	ErrExists = errors.New("torrent already added")
+)
+
+// State is what the daemon is doing with a torrent
+type State string
+
+const (
+	StateQueued      State = "queued"
+	StateDownloading State = "downloading"
+	StateStalled     State = "stalled"
+	StateSeeding     State = "seeding"
+	StatePaused      State = "paused"
+	StateFailed      State = "failed"
+)
+
+// Status describes a managed torrent
+type Status struct {
+	InfoHash       string            `json:"info_hash"`
+	Name           string            `json:"name"`
+	TorrentPath    string            `json:"torrent_path"`
+	OutputDir      string            `json:"output_dir"`
+	QueuePosition  int               `json:"queue_position"`
+	State          State             `json:"state"`
+	PiecesDone     int               `json:"pieces_done"`
+	Pieces         int               `json:"pieces"`
+	Uploaded       int64             `json:"uploaded"`
+	Downloaded     int64             `json:"downloaded"`
+	Ratio          float64           `json:"ratio"`
+	SeedingTime    int64             `json:"seeding_time"`
+	Error          string            `json:"error,omitempty"`
+	FilePriorities map[string]string `json:"file_priorities,omitempty"`
+	// Policy is the torrent's own seeding policy, nil if it follows the
+	// daemon's
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// managed is a torrent handled by the daemon
+type managed struct {
+	tf          torrent.TorrentFile
+	torrentPath string
+	outputDir   string
+	opts        client.Options
+	state       State
+	err         error
+	piecesDone  int
+	// paused is set while the user wants the torrent stopped
+	paused bool
+	// complete is set once every wanted piece is downloaded
+	complete bool
+
+	// stalled is set while a download gets no data, so it does not hold
+	// a download slot. lastDownloaded is the client's byte count at
+	// lastProgress, and retryAt is when a download that found no peers
+	// may start again.
+	stalled        bool
+	lastDownloaded int64
+	lastProgress   time.Time
+	retryAt        time.Time
+
+	// Transfer totals of earlier sessions, and the process-wide counters
+	// when the torrent was added to this one
+	uploadedBase, downloadedBase   int64
+	uploadedStart, downloadedStart int64
+
+	// policy overrides the daemon's seeding policy if set. seedingTime is
+	// the time seeded before seedingSince, which is set while seeding.
+	policy       *Policy
+	seedingTime  time.Duration
+	seedingSince time.Time
+
+	// cancel stops the running download; done is closed once it returned
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Daemon manages torrents. Its methods are safe for concurrent use.
+type Daemon struct {
+	mu       sync.Mutex
+	torrents map[string]*managed
+	// order is the queue, which decides what starts when a slot is free
+	order  []*managed
+	limits Limits
+	// policy applies to torrents without their own
+	policy Policy
+
+	// stateDir holds the saved session; empty if nothing is persisted
+	stateDir string
+	saveMu   sync.Mutex
+	quit     chan struct{}
+}
+
+// New creates a daemon keeping its session in stateDir and running at
+// most as many torrents as limits allow. Complete torrents are seeded
+// until policy is reached, unless they have their own policy. The
+// torrents of the previous session are restored, and those that were not
+// paused are queued again. An empty stateDir keeps nothing across restarts.
+func New(stateDir string, limits Limits, policy Policy) (*Daemon, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	d := &Daemon{
+		torrents: make(map[string]*managed),
+		limits:   limits,
+		policy:   policy,
+		stateDir: stateDir,
+		quit:     make(chan struct{}),
+	}
+	if stateDir != "" {
+		if err := d.restore(); err != nil {
+			return nil, fmt.Errorf("error restoring session: %v", err)
+		}
+		go d.saveLoop(d.quit)
+	}
+	go d.queueLoop(d.quit)
+	return d, nil
+}
+
+// Add starts managing the torrent at torrentPath, writing its data below
+// outputDir. Unless paused it is queued at the back and starts as soon as
+// a slot is free.
+func (d *Daemon) Add(torrentPath, outputDir string, paused bool) (Status, error) {
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		return Status{}, fmt.Errorf("error opening torrent file: %v", err)
+	}
+	if d.stateDir != "" {
+		// Keep our own copy so the session survives the original moving
+		data, err := os.ReadFile(torrentPath)
+		if err == nil {
+			torrentPath = d.torrentCopy(tf.InfoHashHex())
+			err = os.WriteFile(torrentPath, data, 0644)
+		}
+		if err != nil {
+			return Status{}, fmt.Errorf("error saving torrent file: %v", err)
+		}
+	}
+
+	d.mu.Lock()
+	m, err := d.manage(torrentPath, outputDir)
+	if err != nil {
+		d.mu.Unlock()
+		return Status{}, err
+	}
+	m.paused = paused
+	d.schedule()
+	status := d.status(m)
+	d.mu.Unlock()
+	d.save()
+	return status, nil
+}
+
+// manage registers the torrent at torrentPath at the back of the queue
+// without starting it. d.mu must be held.
+func (d *Daemon) manage(torrentPath, outputDir string) (*managed, error) {
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening torrent file: %v", err)
+	}
+	key := tf.InfoHashHex()
+	if _, ok := d.torrents[key]; ok {
+		return nil, ErrExists
+	}
+	m := &managed{
+		tf:          tf,
+		torrentPath: torrentPath,
+		outputDir:   outputDir,
+		opts: client.Options{
+			OutputDir:      outputDir,
+			FilePriorities: make(map[int]client.Priority),
+		},
+		state:           StateQueued,
+		uploadedStart:   server.Uploaded(tf.InfoHash),
+		downloadedStart: client.Downloaded(tf.InfoHash),
+	}
+	d.torrents[key] = m
+	d.order = append(d.order, m)
+	fmt.Printf("Added %s (%s)\n", tf.Name, key)
+	return m, nil
+}
+
+// Remove stops a torrent and forgets it. Downloaded data is kept.
+func (d *Daemon) Remove(infoHash string) error {
+	d.mu.Lock()
+	m, err := d.lookup(infoHash)
+	if err == nil {
+		delete(d.torrents, m.tf.InfoHashHex())
+		d.unqueue(m)
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.stop(m)
+	d.mu.Lock()
+	d.schedule()
+	d.mu.Unlock()
+	if d.stateDir != "" {
+		os.Remove(d.torrentCopy(m.tf.InfoHashHex()))
+	}
+	d.save()
+	fmt.Printf("Removed %s\n", m.tf.Name)
+	return nil
+}
+
+// Pause stops downloading or seeding a torrent, freeing its slot for the
+// next one in the queue
+func (d *Daemon) Pause(infoHash string) error {
+	d.mu.Lock()
+	m, err := d.lookup(infoHash)
+	if err == nil {
+		m.paused = true
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.stop(m)
+	d.mu.Lock()
+	d.schedule()
+	d.mu.Unlock()
+	d.save()
+	return nil
+}
+
+// Resume queues a paused, stalled or failed torrent again. Pieces already
+// downloaded are kept, so a complete torrent goes straight back to seeding
+// once a seed slot is free.
+func (d *Daemon) Resume(infoHash string) error {
+	d.mu.Lock()
+	m, err := d.lookup(infoHash)
+	if err == nil {
+		m.paused = false
+		if m.state == StateFailed {
+			m.state = StateQueued
+			m.err = nil
+		}
+		if m.state == StateQueued {
+			m.stalled = false
+		}
+		d.schedule()
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.save()
+	return nil
+}
+
+// SetFilePriority changes the priority of one file of a torrent. A running
+// download is restarted to pick up the change, and a complete torrent is
+// downloaded again if the file is no longer skipped.
+func (d *Daemon) SetFilePriority(infoHash string, file int, priority client.Priority) error {
+	d.mu.Lock()
+	m, err := d.lookup(infoHash)
+	if err == nil && (file < 0 || file >= len(m.tf.Layout())) {
+		err = fmt.Errorf("file index %d out of range", file)
+	}
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	// Options are copied into the download, so replace the map rather
+	// than change the one a running download reads
+	priorities := make(map[int]client.Priority, len(m.opts.FilePriorities)+1)
+	for i, p := range m.opts.FilePriorities {
+		priorities[i] = p
+	}
+	priorities[file] = priority
+	m.opts.FilePriorities = priorities
+	reopen := m.complete && priority != client.PrioritySkip
+	restart := m.state == StateDownloading || (reopen && m.state == StateSeeding)
+	d.mu.Unlock()
+
+	if restart {
+		d.stop(m)
+	}
+	d.mu.Lock()
+	if reopen {
+		m.complete = false
+	}
+	d.schedule()
+	d.mu.Unlock()
+	d.save()
+	return nil
+}
+
+// List returns the status of every managed torrent in queue order
+func (d *Daemon) List() []Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.list()
+}
+
+// list is List with d.mu held
+func (d *Daemon) list() []Status {
+	list := make([]Status, 0, len(d.order))
+	for _, m := range d.order {
+		list = append(list, d.status(m))
+	}
+	return list
+}
+
+// Close saves the session and stops every torrent. The torrents keep
+// their saved state, so they start again with the next daemon.
+func (d *Daemon) Close() {
+	close(d.quit)
+	d.save()
+	d.mu.Lock()
+	all := append([]*managed(nil), d.order...)
+	d.mu.Unlock()
+	for _, m := range all {
+		d.stop(m)
+	}
+}
+
+// lookup finds a torrent by its hex info hash or a unique prefix of it.
+// d.mu must be held.
+func (d *Daemon) lookup(infoHash string) (*managed, error) {
+	infoHash = strings.ToLower(infoHash)
+	if m, ok := d.torrents[infoHash]; ok {
+		return m, nil
+	}
+	var found *managed
+	for key, m := range d.torrents {
+		if infoHash != "" && strings.HasPrefix(key, infoHash) {
+			if found != nil {
+				return nil, fmt.Errorf("info hash prefix %q is ambiguous", infoHash)
+			}
+			found = m
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// start downloads a torrent in the background. When the download returns
+// the torrent is queued for seeding, or to be retried if no peers were
+// found, and the next torrent in line is started. d.mu must be held.
+func (d *Daemon) start(m *managed) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.state = StateDownloading
+	m.err = nil
+	m.stalled = false
+	m.lastDownloaded = client.Downloaded(m.tf.InfoHash)
+	m.lastProgress = time.Now()
+	m.cancel = cancel
+	m.done = done
+	opts := m.opts
+
+	go func() {
+		defer close(done)
+		err := client.Download(ctx, m.torrentPath, opts)
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if ctx.Err() != nil {
+			// Paused or removed; stop has set the state
+			return
+		}
+		m.cancel, m.done = nil, nil
+		switch {
+		case err == nil:
+			m.state = StateQueued
+			m.complete = true
+			m.piecesDone = len(m.tf.PieceHashes)
+		case errors.Is(err, client.ErrNoPeers) || errors.Is(err, client.ErrIncomplete):
+			// Give the slot to the next torrent and try again later
+			fmt.Printf("Torrent %s stalled: %v\n", m.tf.Name, err)
+			m.state = StateQueued
+			m.stalled = true
+			m.retryAt = time.Now().Add(retryInterval)
+			m.err = err
+		default:
+			fmt.Printf("Torrent %s failed: %v\n", m.tf.Name, err)
+			m.state = StateFailed
+			m.err = err
+		}
+		d.schedule()
+	}()
+}
+
+// stop cancels a torrent's download, waits for it to return and stops
+// seeding it, leaving it queued. It must be called without d.mu held.
+func (d *Daemon) stop(m *managed) {
+	d.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel, m.done = nil, nil
+	if have, _, ok := client.Progress(m.tf.InfoHash); ok {
+		m.piecesDone = have
+	}
+	m.seedingTime = m.seeded()
+	m.seedingSince = time.Time{}
+	m.state = StateQueued
+	m.stalled = false
+	m.err = nil
+	d.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	server.Unseed(m.tf.InfoHash)
+}
+
+// status describes m. d.mu must be held.
+func (d *Daemon) status(m *managed) Status {
+	s := Status{
+		InfoHash:      m.tf.InfoHashHex(),
+		Name:          m.tf.Name,
+		TorrentPath:   m.torrentPath,
+		OutputDir:     m.outputDir,
+		QueuePosition: d.position(m),
+		State:         m.state,
+		PiecesDone:    m.piecesDone,
+		Pieces:        len(m.tf.PieceHashes),
+	}
+	if done, _, ok := client.Progress(m.tf.InfoHash); ok && m.state == StateDownloading {
+		s.PiecesDone = done
+	}
+	switch {
+	case m.paused:
+		s.State = StatePaused
+	case m.stalled:
+		s.State = StateStalled
+	}
+	if m.err != nil {
+		s.Error = m.err.Error()
+	}
+	stats := m.seedStats()
+	s.Uploaded, s.Downloaded = stats.Uploaded, stats.Downloaded
+	s.Ratio = stats.Ratio()
+	s.SeedingTime = int64(stats.Seeding / time.Second)
+	if m.policy != nil {
+		policy := *m.policy
+		s.Policy = &policy
+	}
+	for i, p := range m.opts.FilePriorities {
+		if s.FilePriorities == nil {
+			s.FilePriorities = make(map[string]string)
+		}
+		s.FilePriorities[fmt.Sprint(i)] = p.String()
+	}
+	return s
+}
@@ -0,0 +1,174 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"tcp-app/server"
+)
+
+// PolicyAction is what happens to a torrent once it has been seeded enough
+type PolicyAction string
+
+const (
+	// ActionStop pauses the torrent
+	ActionStop PolicyAction = "stop"
+	// ActionRemove removes the torrent, keeping its data
+	ActionRemove PolicyAction = "remove"
+)
+
+// ParsePolicyAction parses stop or remove
+func ParsePolicyAction(s string) (PolicyAction, error) {
+	switch action := PolicyAction(s); action {
+	case ActionStop, ActionRemove:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown policy action %q", s)
+}
+
+// Policy says when a torrent has been seeded enough and what to do then.
+// Times are in seconds. Limits that are zero are not checked, and an empty
+// action stops the torrent.
+type Policy struct {
+	Ratio    float64      `json:"ratio,omitempty"`
+	SeedTime int64        `json:"seed_time,omitempty"`
+	IdleTime int64        `json:"idle_time,omitempty"`
+	Action   PolicyAction `json:"action,omitempty"`
+}
+
+// NewPolicy returns the policy applying limits with action
+func NewPolicy(limits server.SeedPolicy, action PolicyAction) Policy {
+	return Policy{
+		Ratio:    limits.Ratio,
+		SeedTime: int64(limits.SeedTime / time.Second),
+		IdleTime: int64(limits.IdleTime / time.Second),
+		Action:   action,
+	}
+}
+
+// limits returns the seeding limits of the policy
+func (p Policy) limits() server.SeedPolicy {
+	return server.SeedPolicy{
+		Ratio:    p.Ratio,
+		SeedTime: time.Duration(p.SeedTime) * time.Second,
+		IdleTime: time.Duration(p.IdleTime) * time.Second,
+	}
+}
+
+// validate checks the limits and action of a policy
+func (p Policy) validate() error {
+	if p.Ratio < 0 || p.SeedTime < 0 || p.IdleTime < 0 {
+		return fmt.Errorf("policy limits must not be negative")
+	}
+	if p.Action != "" {
+		if _, err := ParsePolicyAction(string(p.Action)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetPolicy gives a torrent its own seeding policy. A nil policy makes it
+// follow the daemon's global policy again.
+func (d *Daemon) SetPolicy(infoHash string, policy *Policy) error {
+	if policy != nil {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		copied := *policy
+		policy = &copied
+	}
+	d.mu.Lock()
+	m, err := d.lookup(infoHash)
+	if err == nil {
+		m.policy = policy
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.save()
+	return nil
+}
+
+// policyHit is a torrent whose policy was reached
+type policyHit struct {
+	infoHash string
+	action   PolicyAction
+}
+
+// checkPolicies returns the seeding torrents that reached their policy.
+// d.mu must be held.
+func (d *Daemon) checkPolicies() []policyHit {
+	var hits []policyHit
+	for _, m := range d.order {
+		if m.state != StateSeeding {
+			continue
+		}
+		policy := d.policy
+		if m.policy != nil {
+			policy = *m.policy
+		}
+		reason := policy.limits().Reached(m.seedStats())
+		if reason == "" {
+			continue
+		}
+		action := policy.Action
+		if action == "" {
+			action = ActionStop
+		}
+		verb := "stopping"
+		if action == ActionRemove {
+			verb = "removing"
+		}
+		fmt.Printf("Torrent %s: %s, %s\n", m.tf.Name, reason, verb)
+		hits = append(hits, policyHit{m.tf.InfoHashHex(), action})
+	}
+	return hits
+}
+
+// applyPolicies pauses or removes the torrents that reached their policy.
+// It must be called without d.mu held.
+func (d *Daemon) applyPolicies(hits []policyHit) {
+	for _, hit := range hits {
+		var err error
+		if hit.action == ActionRemove {
+			err = d.Remove(hit.infoHash)
+		} else {
+			err = d.Pause(hit.infoHash)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			fmt.Printf("Error applying seeding policy: %v\n", err)
+		}
+	}
+}
+
+// seeded returns the total time m was seeded over all sessions. d.mu must
+// be held.
+func (m *managed) seeded() time.Duration {
+	total := m.seedingTime
+	if !m.seedingSince.IsZero() {
+		total += time.Since(m.seedingSince)
+	}
+	return total
+}
+
+// seedStats returns what m's policy is checked against. d.mu must be held.
+func (m *managed) seedStats() server.SeedStats {
+	uploaded, downloaded := m.transferred()
+	idleSince := m.seedingSince
+	if last := server.LastUpload(m.tf.InfoHash); last.After(idleSince) {
+		idleSince = last
+	}
+	s := server.SeedStats{
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Size:       int64(m.tf.Length),
+		Seeding:    m.seeded(),
+	}
+	if !idleSince.IsZero() {
+		s.Idle = time.Since(idleSince)
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckPolicies(t *testing.T) {
+	seedTime := &Policy{SeedTime: 60, Action: ActionRemove}
+	tests := []struct {
+		name   string
+		global Policy
+		setup  func(m *managed)
+		want   PolicyAction
+	}{
+		{"no policy", Policy{}, func(*managed) {}, ""},
+		{"global seed time reached", Policy{SeedTime: 60}, func(*managed) {}, ActionStop},
+		{"global seed time not reached", Policy{SeedTime: 7200}, func(*managed) {}, ""},
+		{"earlier sessions count", Policy{SeedTime: 7200}, func(m *managed) { m.seedingTime = 2 * time.Hour }, ActionStop},
+		{"own policy overrides", Policy{SeedTime: 7200}, func(m *managed) { m.policy = seedTime }, ActionRemove},
+		{"own policy without limits", Policy{SeedTime: 60}, func(m *managed) { m.policy = &Policy{} }, ""},
+		{"idle time", Policy{IdleTime: 60, Action: ActionRemove}, func(*managed) {}, ActionRemove},
+		{"ratio", Policy{Ratio: 1}, func(m *managed) { m.uploadedBase = 2 * int64(m.tf.Length) }, ActionStop},
+		{"only seeding torrents", Policy{SeedTime: 60}, func(m *managed) { m.state = StateDownloading }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDaemon(Limits{}, "a")
+			d.policy = tt.global
+			m := d.order[0]
+			m.tf.Length = 1000
+			m.state = StateSeeding
+			m.seedingSince = time.Now().Add(-time.Hour)
+			tt.setup(m)
+
+			hits := d.checkPolicies()
+			var got PolicyAction
+			if len(hits) > 0 {
+				got = hits[0].action
+				if hits[0].infoHash != m.tf.InfoHashHex() {
+					t.Errorf("hit for %s, want %s", hits[0].infoHash, m.tf.InfoHashHex())
+				}
+			}
+			if len(hits) > 1 || got != tt.want {
+				t.Errorf("hits %v, want action %q", hits, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		ok     bool
+	}{
+		{Policy{}, true},
+		{Policy{Ratio: 1.5, SeedTime: 60, IdleTime: 60, Action: ActionRemove}, true},
+		{Policy{Ratio: -1}, false},
+		{Policy{SeedTime: -1}, false},
+		{Policy{Action: "delete"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v", tt.policy, err)
+		}
+	}
+}
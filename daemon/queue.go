@@ -0,0 +1,182 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"tcp-app/client"
+	"tcp-app/server"
+)
+
+// Limits bound how many torrents the daemon runs at once. Torrents over a
+// limit wait in the queue, in queue order. Zero means no limit.
+type Limits struct {
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// StallTimeout is how long a download may go without receiving data
+	// before it is marked stalled and stops counting as active. Zero
+	// disables the check.
+	StallTimeout time.Duration
+}
+
+// DefaultLimits are the limits of a daemon started without options
+var DefaultLimits = Limits{
+	MaxActiveDownloads: 3,
+	MaxActiveSeeds:     5,
+	StallTimeout:       2 * time.Minute,
+}
+
+// queueInterval is how often stalls are checked and the queue advanced
+const queueInterval = 5 * time.Second
+
+// retryInterval is how long a download that found no peers waits before
+// it is tried again
+const retryInterval = time.Minute
+
+// Move puts a torrent at position in the queue, counting from 0. Positions
+// past the end move it to the back.
+func (d *Daemon) Move(infoHash string, position int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, err := d.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	d.move(m, position)
+	return nil
+}
+
+// MoveBy moves a torrent delta places towards the back of the queue, or
+// towards the front if delta is negative
+func (d *Daemon) MoveBy(infoHash string, delta int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, err := d.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	d.move(m, d.position(m)+delta)
+	return nil
+}
+
+// move puts m at position and starts whatever is now first in line.
+// d.mu must be held.
+func (d *Daemon) move(m *managed, position int) {
+	d.unqueue(m)
+	position = max(0, min(position, len(d.order)))
+	d.order = append(d.order, nil)
+	copy(d.order[position+1:], d.order[position:])
+	d.order[position] = m
+	d.schedule()
+}
+
+// position returns where m is in the queue. d.mu must be held.
+func (d *Daemon) position(m *managed) int {
+	for i, queued := range d.order {
+		if queued == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// unqueue takes m out of the queue order. d.mu must be held.
+func (d *Daemon) unqueue(m *managed) {
+	if i := d.position(m); i >= 0 {
+		d.order = append(d.order[:i], d.order[i+1:]...)
+	}
+}
+
+// schedule starts queued torrents in queue order while there are free
+// slots: incomplete ones are downloaded, complete ones seeded. Running
+// torrents are never stopped to make room, so moving a torrent to the
+// front makes it the next to start. d.mu must be held.
+func (d *Daemon) schedule() {
+	downloads, seeds := 0, 0
+	for _, m := range d.order {
+		switch {
+		case m.state == StateDownloading && !m.stalled:
+			downloads++
+		case m.state == StateSeeding:
+			seeds++
+		}
+	}
+
+	now := time.Now()
+	for _, m := range d.order {
+		if m.paused || m.state != StateQueued {
+			continue
+		}
+		if m.complete {
+			if d.limits.MaxActiveSeeds > 0 && seeds >= d.limits.MaxActiveSeeds {
+				continue
+			}
+			if _, err := server.Seed(m.torrentPath, filepath.Join(m.outputDir, m.tf.Name)); err != nil {
+				fmt.Printf("Torrent %s failed: %v\n", m.tf.Name, err)
+				m.state = StateFailed
+				m.err = err
+				continue
+			}
+			m.state = StateSeeding
+			m.seedingSince = time.Now()
+			seeds++
+			continue
+		}
+		if m.stalled && now.Before(m.retryAt) {
+			continue
+		}
+		if d.limits.MaxActiveDownloads > 0 && downloads >= d.limits.MaxActiveDownloads {
+			continue
+		}
+		d.start(m)
+		downloads++
+	}
+}
+
+// checkStalls marks downloads that received nothing for the stall timeout
+// as stalled, and clears the mark once data arrives again. d.mu must be
+// held.
+func (d *Daemon) checkStalls() {
+	now := time.Now()
+	for _, m := range d.order {
+		if m.state != StateDownloading {
+			continue
+		}
+		downloaded := client.Downloaded(m.tf.InfoHash)
+		if downloaded != m.lastDownloaded {
+			if m.stalled {
+				fmt.Printf("Torrent %s is receiving data again\n", m.tf.Name)
+			}
+			m.lastDownloaded = downloaded
+			m.lastProgress = now
+			m.stalled = false
+			continue
+		}
+		timeout := d.limits.StallTimeout
+		if !m.stalled && timeout > 0 && now.Sub(m.lastProgress) >= timeout {
+			fmt.Printf("Torrent %s stalled: no data for %v\n", m.tf.Name, timeout)
+			m.stalled = true
+		}
+	}
+}
+
+// queueLoop checks for stalls and seeding policies and advances the queue
+// until stop is closed
+func (d *Daemon) queueLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(queueInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mu.Lock()
+			d.checkStalls()
+			hits := d.checkPolicies()
+			d.schedule()
+			d.mu.Unlock()
+			d.applyPolicies(hits)
+		case <-stop:
+			return
+		}
+	}
+}
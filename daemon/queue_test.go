@@ -0,0 +1,196 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-app/server"
+	"tcp-app/torrent"
+)
+
+// newTestDaemon returns a daemon managing one torrent per name, queued in
+// that order, without starting its background loops
+func newTestDaemon(limits Limits, names ...string) *Daemon {
+	d := &Daemon{torrents: make(map[string]*managed), limits: limits}
+	for i, name := range names {
+		m := &managed{state: StateQueued}
+		m.tf.Name = name
+		m.tf.InfoHash[0] = byte(i + 1)
+		d.torrents[m.tf.InfoHashHex()] = m
+		d.order = append(d.order, m)
+	}
+	return d
+}
+
+// find returns the torrent called name
+func (d *Daemon) find(name string) *managed {
+	for _, m := range d.order {
+		if m.tf.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// waitDownloads waits until no download runs. The test torrents have no
+// file, so their downloads fail right away and the next ones start.
+func waitDownloads(d *Daemon) {
+	for {
+		var done chan struct{}
+		d.mu.Lock()
+		for _, m := range d.order {
+			if m.done != nil {
+				done = m.done
+				break
+			}
+		}
+		d.mu.Unlock()
+		if done == nil {
+			return
+		}
+		<-done
+	}
+}
+
+func (d *Daemon) queueOrder() string {
+	var names []string
+	for _, m := range d.order {
+		names = append(names, m.tf.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestQueueMove(t *testing.T) {
+	tests := []struct {
+		name string
+		move func(d *Daemon) error
+		want string
+	}{
+		{"to the front", func(d *Daemon) error { return d.Move(d.find("c").tf.InfoHashHex(), 0) }, "c a b d"},
+		{"past the end", func(d *Daemon) error { return d.Move(d.find("a").tf.InfoHashHex(), 10) }, "b c d a"},
+		{"back by two", func(d *Daemon) error { return d.MoveBy(d.find("a").tf.InfoHashHex(), 2) }, "b c a d"},
+		{"before the front", func(d *Daemon) error { return d.MoveBy(d.find("b").tf.InfoHashHex(), -5) }, "b a c d"},
+		{"by info hash prefix", func(d *Daemon) error { return d.Move(d.find("d").tf.InfoHashHex()[:2], 1) }, "a d b c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDaemon(Limits{}, "a", "b", "c", "d")
+			// Paused torrents stay put, so nothing is started
+			for _, m := range d.order {
+				m.paused = true
+			}
+			if err := tt.move(d); err != nil {
+				t.Fatal(err)
+			}
+			if got := d.queueOrder(); got != tt.want {
+				t.Errorf("queue %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	d := newTestDaemon(Limits{}, "a")
+	if err := d.Move(strings.Repeat("f", 40), 0); err == nil {
+		t.Error("moved a torrent that is not managed")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		// setup prepares the torrents a, b and c, all queued to begin with
+		setup func(d *Daemon)
+		// started lists the torrents schedule starts downloading
+		started string
+	}{
+		{"no limit", Limits{}, func(*Daemon) {}, "a b c"},
+		{"download limit in queue order", Limits{MaxActiveDownloads: 2}, func(*Daemon) {}, "a b"},
+		{"running downloads hold slots", Limits{MaxActiveDownloads: 2}, func(d *Daemon) {
+			d.find("a").state = StateDownloading
+		}, "b"},
+		{"stalled downloads free their slot", Limits{MaxActiveDownloads: 1}, func(d *Daemon) {
+			d.find("a").state = StateDownloading
+			d.find("a").stalled = true
+		}, "b"},
+		{"stalled torrents wait to retry", Limits{MaxActiveDownloads: 1}, func(d *Daemon) {
+			d.find("a").stalled = true
+			d.find("a").retryAt = time.Now().Add(time.Hour)
+		}, "b"},
+		{"paused torrents are skipped", Limits{MaxActiveDownloads: 1}, func(d *Daemon) {
+			d.find("a").paused = true
+		}, "b"},
+		{"seeds do not take download slots", Limits{MaxActiveDownloads: 1, MaxActiveSeeds: 1}, func(d *Daemon) {
+			d.find("a").state = StateSeeding
+		}, "b"},
+		{"seed limit leaves complete torrents queued", Limits{MaxActiveSeeds: 1}, func(d *Daemon) {
+			d.find("a").state = StateSeeding
+			d.find("b").complete = true
+		}, "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDaemon(tt.limits, "a", "b", "c")
+			tt.setup(d)
+			before := make(map[*managed]State)
+			for _, m := range d.order {
+				before[m] = m.state
+			}
+
+			d.mu.Lock()
+			d.schedule()
+			var started []string
+			for _, m := range d.order {
+				if before[m] == StateQueued && m.state == StateDownloading {
+					started = append(started, m.tf.Name)
+				}
+			}
+			d.mu.Unlock()
+			waitDownloads(d)
+
+			if got := strings.Join(started, " "); got != tt.started {
+				t.Errorf("started %q, want %q", got, tt.started)
+			}
+		})
+	}
+}
+
+func TestScheduleSeedsCompleteTorrents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, make([]byte, 3*torrent.MinPieceLength), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := torrent.CreateOptions{PieceLength: torrent.MinPieceLength}
+	torrentPath, err := torrent.CreateContext(context.Background(), path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Unseed(tf.InfoHash) })
+
+	// Two complete torrents compete for one seeding slot
+	d := newTestDaemon(Limits{MaxActiveSeeds: 1}, "first", "second")
+	for _, m := range d.order {
+		m.tf = tf
+		m.torrentPath = torrentPath
+		m.outputDir = dir
+		m.complete = true
+	}
+	d.mu.Lock()
+	d.schedule()
+	d.mu.Unlock()
+
+	if d.order[0].state != StateSeeding || d.order[1].state != StateQueued {
+		t.Errorf("states %s and %s, want seeding and queued", d.order[0].state, d.order[1].state)
+	}
+	if d.order[0].seedingSince.IsZero() {
+		t.Error("seeding time not started")
+	}
+}
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"tcp-app/client"
+	"tcp-app/internal/atomicfile"
+	"tcp-app/server"
+)
+
+// sessionFile lists the managed torrents inside the state directory. Each
+// torrent's metadata is copied to torrents/<info hash>.torrent next to it,
+// so the session does not depend on the file it was added from.
+const sessionFile = "session.json"
+
+// saveInterval is how often transfer totals are written while running
+const saveInterval = time.Minute
+
+type savedTorrent struct {
+	InfoHash       string            `json:"info_hash"`
+	OutputDir      string            `json:"output_dir"`
+	Paused         bool              `json:"paused"`
+	FilePriorities map[string]string `json:"file_priorities,omitempty"`
+	Uploaded       int64             `json:"uploaded"`
+	Downloaded     int64             `json:"downloaded"`
+	SeedingTime    int64             `json:"seeding_time,omitempty"`
+	Policy         *Policy           `json:"policy,omitempty"`
+}
+
+type savedSession struct {
+	Torrents []savedTorrent `json:"torrents"`
+}
+
+// torrentCopy returns where the metadata of a torrent is kept
+func (d *Daemon) torrentCopy(infoHash string) string {
+	return filepath.Join(d.stateDir, "torrents", infoHash+".torrent")
+}
+
+// restore adds the torrents of the saved session in their queue order,
+// queueing those that were not paused. Torrents that cannot be restored
+// are reported and dropped.
+func (d *Daemon) restore() error {
+	if err := os.MkdirAll(filepath.Join(d.stateDir, "torrents"), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(d.stateDir, sessionFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var session savedSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return fmt.Errorf("invalid session file: %v", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, saved := range session.Torrents {
+		m, err := d.manage(d.torrentCopy(saved.InfoHash), saved.OutputDir)
+		if err != nil {
+			fmt.Printf("Cannot restore torrent %s: %v\n", saved.InfoHash, err)
+			continue
+		}
+		for file, level := range saved.FilePriorities {
+			index, err := strconv.Atoi(file)
+			priority, perr := client.ParsePriority(level)
+			if err == nil && perr == nil {
+				m.opts.FilePriorities[index] = priority
+			}
+		}
+		m.uploadedBase = saved.Uploaded
+		m.downloadedBase = saved.Downloaded
+		m.seedingTime = time.Duration(saved.SeedingTime) * time.Second
+		if saved.Policy != nil && saved.Policy.validate() == nil {
+			m.policy = saved.Policy
+		}
+		m.paused = saved.Paused
+	}
+	d.schedule()
+	fmt.Printf("Restored %d torrents from %s\n", len(d.torrents), d.stateDir)
+	return nil
+}
+
+// save writes the session. Without a state directory nothing is kept.
+func (d *Daemon) save() {
+	if d.stateDir == "" {
+		return
+	}
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+
+	var session savedSession
+	d.mu.Lock()
+	for _, s := range d.list() {
+		m := d.torrents[s.InfoHash]
+		session.Torrents = append(session.Torrents, savedTorrent{
+			InfoHash:       s.InfoHash,
+			OutputDir:      m.outputDir,
+			Paused:         m.paused,
+			FilePriorities: s.FilePriorities,
+			Uploaded:       s.Uploaded,
+			Downloaded:     s.Downloaded,
+			SeedingTime:    s.SeedingTime,
+			Policy:         s.Policy,
+		})
+	}
+	d.mu.Unlock()
+
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err == nil {
+		err = atomicfile.Write(filepath.Join(d.stateDir, sessionFile), data, 0600)
+	}
+	if err != nil {
+		fmt.Printf("Error saving session: %v\n", err)
+	}
+}
+
+// saveLoop saves the session periodically so transfer totals survive a
+// crash, until stop is closed
+func (d *Daemon) saveLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.save()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// transferred returns the bytes uploaded and downloaded for m over all
+// sessions. d.mu must be held.
+func (m *managed) transferred() (uploaded, downloaded int64) {
+	uploaded = m.uploadedBase + server.Uploaded(m.tf.InfoHash) - m.uploadedStart
+	downloaded = m.downloadedBase + client.Downloaded(m.tf.InfoHash) - m.downloadedStart
+	return uploaded, downloaded
+}
@@ -0,0 +1,313 @@
+// Package dht implements a mainline DHT node (BEP 5) used to find peers
+// for torrents without relying on a tracker.
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultBootstrapNodes are well known public routers of the mainline DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// queryTimeout is how long to wait for a response to a single query
+const queryTimeout = 2 * time.Second
+
+// errTimeout is returned when a queried node does not respond
+var errTimeout = errors.New("dht query timed out")
+
+// Config controls how a DHT node is started
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881" or "127.0.0.1:0"
+	Addr string
+	// BootstrapNodes are contacted when the routing table is empty
+	BootstrapNodes []string
+	// StateFile persists the node id and routing table across restarts
+	// when non-empty
+	StateFile string
+}
+
+// Server is a DHT node that answers queries and performs lookups
+type Server struct {
+	id        [20]byte
+	conn      *net.UDPConn
+	table     *table
+	peers     *peerStore
+	tokens    *tokens
+	bootstrap []string
+	stateFile string
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	nextTx  uint16
+	closed  chan struct{}
+}
+
+// New starts a DHT node listening on cfg.Addr. The routing table is
+// restored from cfg.StateFile if it exists.
+func New(cfg Config) (*Server, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = ":6881"
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dht address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting dht node: %v", err)
+	}
+
+	s := &Server{
+		conn:      conn,
+		peers:     newPeerStore(),
+		tokens:    newTokens(),
+		bootstrap: cfg.BootstrapNodes,
+		stateFile: cfg.StateFile,
+		pending:   make(map[string]*pendingQuery),
+		closed:    make(chan struct{}),
+	}
+
+	var nodes []*node
+	if cfg.StateFile != "" {
+		id, saved, err := loadState(cfg.StateFile)
+		if err == nil {
+			s.id = id
+			nodes = saved
+		}
+	}
+	if s.id == ([20]byte{}) {
+		rand.Read(s.id[:])
+	}
+	s.table = newTable(s.id)
+	for _, n := range nodes {
+		s.table.update(n)
+	}
+
+	go s.readLoop()
+	return s, nil
+}
+
+// ID returns the node id
+func (s *Server) ID() [20]byte {
+	return s.id
+}
+
+// Addr returns the UDP address the node listens on
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the number of nodes in the routing table
+func (s *Server) Nodes() int {
+	return s.table.size()
+}
+
+// Close saves the routing table and stops the node
+func (s *Server) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	if s.stateFile != "" {
+		if err := saveState(s.stateFile, s.id, s.table.all()); err != nil {
+			fmt.Printf("Error saving dht state: %v\n", err)
+		}
+	}
+	return s.conn.Close()
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			continue
+		}
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch m.Y {
+		case "q":
+			s.handleQuery(m, addr)
+		case "r", "e":
+			s.handleResponse(m, addr)
+		}
+	}
+}
+
+// pendingQuery is an outstanding query waiting for its response
+type pendingQuery struct {
+	addr *net.UDPAddr
+	ch   chan *msg
+}
+
+func (s *Server) handleResponse(m *msg, addr *net.UDPAddr) {
+	s.mu.Lock()
+	pq, ok := s.pending[m.T]
+	// Only accept responses from the node the query was sent to
+	if ok && pq.addr.IP.Equal(addr.IP) && pq.addr.Port == addr.Port {
+		delete(s.pending, m.T)
+	} else {
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if m.Y == "r" {
+		if id, ok := idArg(m.R, "id"); ok {
+			s.table.update(&node{id: id, addr: addr})
+		}
+	}
+	pq.ch <- m
+}
+
+func (s *Server) handleQuery(m *msg, addr *net.UDPAddr) {
+	id, ok := idArg(m.A, "id")
+	if !ok {
+		s.sendError(m.T, errProtocol, "missing id", addr)
+		return
+	}
+	s.table.update(&node{id: id, addr: addr})
+
+	switch m.Q {
+	case "ping":
+		s.respond(m.T, map[string]interface{}{"id": string(s.id[:])}, addr)
+
+	case "find_node":
+		target, ok := idArg(m.A, "target")
+		if !ok {
+			s.sendError(m.T, errProtocol, "missing target", addr)
+			return
+		}
+		s.respond(m.T, map[string]interface{}{
+			"id":    string(s.id[:]),
+			"nodes": encodeNodes(s.table.closest(target, K)),
+		}, addr)
+
+	case "get_peers":
+		infoHash, ok := idArg(m.A, "info_hash")
+		if !ok {
+			s.sendError(m.T, errProtocol, "missing info_hash", addr)
+			return
+		}
+		r := map[string]interface{}{
+			"id":    string(s.id[:]),
+			"token": s.tokens.issue(addr.IP),
+		}
+		if peers := s.peers.get(infoHash); len(peers) > 0 {
+			var values []interface{}
+			for _, p := range peers {
+				if compact, ok := encodePeer(p); ok {
+					values = append(values, compact)
+				}
+			}
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(s.table.closest(infoHash, K))
+		}
+		s.respond(m.T, r, addr)
+
+	case "announce_peer":
+		infoHash, ok := idArg(m.A, "info_hash")
+		token, tokenOK := stringArg(m.A, "token")
+		if !ok || !tokenOK {
+			s.sendError(m.T, errProtocol, "missing info_hash or token", addr)
+			return
+		}
+		if !s.tokens.valid(token, addr.IP) {
+			s.sendError(m.T, errProtocol, "bad token", addr)
+			return
+		}
+		port, _ := intArg(m.A, "port")
+		if implied, _ := intArg(m.A, "implied_port"); implied != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(m.T, errProtocol, "invalid port", addr)
+			return
+		}
+		s.peers.add(infoHash, &net.TCPAddr{IP: addr.IP, Port: port})
+		s.respond(m.T, map[string]interface{}{"id": string(s.id[:])}, addr)
+
+	default:
+		s.sendError(m.T, errMethod, "method unknown", addr)
+	}
+}
+
+func (s *Server) respond(t string, values map[string]interface{}, addr *net.UDPAddr) {
+	data, err := encodeResponse(t, values)
+	if err != nil {
+		return
+	}
+	s.conn.WriteToUDP(data, addr)
+}
+
+func (s *Server) sendError(t string, code int, message string, addr *net.UDPAddr) {
+	data, err := encodeError(t, code, message)
+	if err != nil {
+		return
+	}
+	s.conn.WriteToUDP(data, addr)
+}
+
+// query sends a KRPC query and waits for the response
+func (s *Server) query(addr *net.UDPAddr, method string, args map[string]interface{}) (*msg, error) {
+	args["id"] = string(s.id[:])
+
+	s.mu.Lock()
+	s.nextTx++
+	t := string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+	ch := make(chan *msg, 1)
+	s.pending[t] = &pendingQuery{addr: addr, ch: ch}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	data, err := encodeQuery(t, method, args)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.conn.WriteToUDP(data, addr); err != nil {
+		return nil, err
+	}
+
+	select {
+	case m := <-ch:
+		if m.Y == "e" {
+			return nil, fmt.Errorf("dht error from %s: %v", addr, m.E)
+		}
+		return m, nil
+	case <-time.After(queryTimeout):
+		return nil, errTimeout
+	case <-s.closed:
+		return nil, errors.New("dht node closed")
+	}
+}
+
+// Ping checks that a node is alive and adds it to the routing table
+func (s *Server) Ping(addr *net.UDPAddr) error {
+	_, err := s.query(addr, "ping", map[string]interface{}{})
+	return err
+}
@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// startCluster starts n nodes on loopback. Every node but the first
+// bootstraps from the first one.
+func startCluster(t *testing.T, n int) []*Server {
+	t.Helper()
+	var nodes []*Server
+	for i := 0; i < n; i++ {
+		cfg := Config{Addr: "127.0.0.1:0"}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("starting node %d: %v", i, err)
+		}
+		t.Cleanup(func() { s.Close() })
+		nodes = append(nodes, s)
+	}
+	for i, s := range nodes[1:] {
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("bootstrapping node %d: %v", i+1, err)
+		}
+	}
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := startCluster(t, 8)
+	for i, s := range nodes {
+		if s.Nodes() == 0 {
+			t.Errorf("node %d has an empty routing table", i)
+		}
+	}
+	// The bootstrap node hears from everyone that joined through it
+	if got := nodes[0].Nodes(); got != len(nodes)-1 {
+		t.Errorf("bootstrap node knows %d nodes, want %d", got, len(nodes)-1)
+	}
+}
+
+func TestBootstrapWithoutNodes(t *testing.T) {
+	s, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Bootstrap(); err == nil {
+		t.Error("bootstrap without reachable nodes succeeded")
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startCluster(t, 8)
+	infoHash := [20]byte{1, 2, 3, 4, 5}
+
+	if peers := nodes[5].GetPeers(infoHash); len(peers) != 0 {
+		t.Fatalf("found peers %v before any announce", peers)
+	}
+	nodes[3].Announce(infoHash, 6882)
+
+	peers := nodes[6].GetPeers(infoHash)
+	if len(peers) == 0 {
+		t.Fatal("no peers found after announce")
+	}
+	for _, p := range peers {
+		if !p.IP.IsLoopback() || p.Port != 6882 {
+			t.Errorf("unexpected peer %v", p)
+		}
+	}
+
+	// Another torrent stays unknown
+	if peers := nodes[6].GetPeers([20]byte{9}); len(peers) != 0 {
+		t.Errorf("found peers %v for a torrent nobody announced", peers)
+	}
+}
+
+func TestAnnounceNeedsToken(t *testing.T) {
+	nodes := startCluster(t, 2)
+	infoHash := [20]byte{7}
+	_, err := nodes[1].query(nodes[0].Addr(), "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      6882,
+		"token":     "forged",
+	})
+	if err == nil {
+		t.Error("announce with a forged token was accepted")
+	}
+	if peers := nodes[0].peers.get(infoHash); len(peers) != 0 {
+		t.Errorf("forged announce stored peers %v", peers)
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	nodes := startCluster(t, 3)
+	state := filepath.Join(t.TempDir(), "dht.json")
+
+	s, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{nodes[0].Addr().String()},
+		StateFile:      state,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	id, known := s.ID(), s.Nodes()
+	s.Close()
+
+	restored, err := New(Config{Addr: "127.0.0.1:0", StateFile: state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if restored.ID() != id {
+		t.Error("node id was not restored")
+	}
+	if restored.Nodes() != known {
+		t.Errorf("restored %d nodes, want %d", restored.Nodes(), known)
+	}
+	// The restored table is enough to join without bootstrap nodes
+	if err := restored.Bootstrap(); err != nil {
+		t.Errorf("bootstrap from restored table: %v", err)
+	}
+}
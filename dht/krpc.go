@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC error codes from BEP 5
+const (
+	errGeneric  = 201
+	errServer   = 202
+	errProtocol = 203
+	errMethod   = 204
+)
+
+// compactNodeLen is the size of one entry in a compact node list
+const compactNodeLen = 26
+
+// msg is a decoded KRPC message. Only the fields relevant to its type
+// ("q", "r" or "e") are set.
+type msg struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E []interface{}
+}
+
+func decodeMsg(data []byte) (*msg, error) {
+	v, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid krpc message: %v", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("krpc message is not a dictionary")
+	}
+	m := &msg{}
+	m.T, _ = dict["t"].(string)
+	m.Y, _ = dict["y"].(string)
+	m.Q, _ = dict["q"].(string)
+	m.A, _ = dict["a"].(map[string]interface{})
+	m.R, _ = dict["r"].(map[string]interface{})
+	m.E, _ = dict["e"].([]interface{})
+	if m.T == "" {
+		return nil, fmt.Errorf("krpc message without transaction id")
+	}
+	switch m.Y {
+	case "q":
+		if m.Q == "" || m.A == nil {
+			return nil, fmt.Errorf("malformed krpc query")
+		}
+	case "r":
+		if m.R == nil {
+			return nil, fmt.Errorf("malformed krpc response")
+		}
+	case "e":
+	default:
+		return nil, fmt.Errorf("unknown krpc message type %q", m.Y)
+	}
+	return m, nil
+}
+
+func encodeQuery(t, method string, args map[string]interface{}) ([]byte, error) {
+	return encode(map[string]interface{}{"t": t, "y": "q", "q": method, "a": args})
+}
+
+func encodeResponse(t string, values map[string]interface{}) ([]byte, error) {
+	return encode(map[string]interface{}{"t": t, "y": "r", "r": values})
+}
+
+func encodeError(t string, code int, message string) ([]byte, error) {
+	return encode(map[string]interface{}{"t": t, "y": "e", "e": []interface{}{code, message}})
+}
+
+func encode(v map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stringArg returns a string argument, or false if missing or mistyped
+func stringArg(dict map[string]interface{}, key string) (string, bool) {
+	s, ok := dict[key].(string)
+	return s, ok
+}
+
+// idArg returns a 20 byte id argument such as "id" or "info_hash"
+func idArg(dict map[string]interface{}, key string) ([20]byte, bool) {
+	var id [20]byte
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+func intArg(dict map[string]interface{}, key string) (int, bool) {
+	i, ok := dict[key].(int64)
+	return int(i), ok
+}
+
+// encodeNodes packs IPv4 nodes into the compact node info format
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		ip4 := n.addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip4...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+	return string(buf)
+}
+
+// decodeNodes unpacks a compact node info list
+func decodeNodes(s string) ([]*node, error) {
+	if len(s)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("malformed compact node list of length %d", len(s))
+	}
+	var nodes []*node
+	for i := 0; i < len(s); i += compactNodeLen {
+		entry := []byte(s[i : i+compactNodeLen])
+		n := &node{addr: &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), entry[20:24]...)),
+			Port: int(binary.BigEndian.Uint16(entry[24:26])),
+		}}
+		copy(n.id[:], entry[:20])
+		if n.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// encodePeer packs an IPv4 peer into the 6 byte compact format
+func encodePeer(addr *net.TCPAddr) (string, bool) {
+	ip4 := addr.IP.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte(nil), ip4...), uint16(addr.Port))), true
+}
+
+// decodePeers unpacks the "values" list of a get_peers response
+func decodePeers(values []interface{}) []*net.TCPAddr {
+	var peers []*net.TCPAddr
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		port := int(binary.BigEndian.Uint16([]byte(s[4:])))
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, &net.TCPAddr{IP: net.IP([]byte(s[:4])), Port: port})
+	}
+	return peers
+}
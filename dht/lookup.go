@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// alpha is the number of concurrent queries during a lookup
+const alpha = 3
+
+// lookupResult collects what an iterative lookup learned
+type lookupResult struct {
+	// nodes are the closest nodes that responded, nearest first
+	nodes []*node
+	// tokens maps a responding node's address to its announce token
+	tokens map[string]string
+	peers  []*net.TCPAddr
+}
+
+// Bootstrap joins the DHT by looking up our own id, starting from the
+// bootstrap nodes when the routing table is empty.
+func (s *Server) Bootstrap() error {
+	if s.table.size() == 0 {
+		for _, address := range s.bootstrap {
+			addr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				fmt.Printf("Error resolving dht bootstrap node %s: %v\n", address, err)
+				continue
+			}
+			m, err := s.query(addr, "find_node", map[string]interface{}{"target": string(s.id[:])})
+			if err != nil {
+				continue
+			}
+			s.learnNodes(m)
+		}
+	}
+	if s.table.size() == 0 {
+		return fmt.Errorf("dht bootstrap failed: no nodes reachable")
+	}
+	s.lookup(s.id, "find_node")
+	return nil
+}
+
+// GetPeers searches the DHT for peers of a torrent
+func (s *Server) GetPeers(infoHash [20]byte) []*net.TCPAddr {
+	return s.lookup(infoHash, "get_peers").peers
+}
+
+// Announce registers this host as a peer for infoHash on the nodes
+// closest to it and returns the peers found along the way
+func (s *Server) Announce(infoHash [20]byte, port int) []*net.TCPAddr {
+	res := s.lookup(infoHash, "get_peers")
+	var wg sync.WaitGroup
+	for _, n := range res.nodes {
+		token, ok := res.tokens[n.addr.String()]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(n *node, token string) {
+			defer wg.Done()
+			s.query(n.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port":      port,
+				"token":     token,
+			})
+		}(n, token)
+	}
+	wg.Wait()
+	return res.peers
+}
+
+// learnNodes adds the nodes from a response to the routing table
+func (s *Server) learnNodes(m *msg) []*node {
+	compact, _ := stringArg(m.R, "nodes")
+	nodes, err := decodeNodes(compact)
+	if err != nil {
+		return nil
+	}
+	for _, n := range nodes {
+		s.table.update(n)
+	}
+	return nodes
+}
+
+// lookup iteratively queries the nodes closest to target until the K
+// closest known nodes have all been asked
+func (s *Server) lookup(target [20]byte, method string) *lookupResult {
+	res := &lookupResult{tokens: make(map[string]string)}
+	var mu sync.Mutex
+	candidates := s.table.closest(target, K)
+	seen := make(map[[20]byte]bool)
+	for _, n := range candidates {
+		seen[n.id] = true
+	}
+	queried := make(map[[20]byte]bool)
+	responded := make(map[[20]byte]bool)
+	seenPeers := make(map[string]bool)
+
+	argKey := "target"
+	if method == "get_peers" {
+		argKey = "info_hash"
+	}
+
+	for {
+		mu.Lock()
+		sortByDistance(candidates, target)
+		var batch []*node
+		considered := 0
+		for _, n := range candidates {
+			if considered == K {
+				break
+			}
+			considered++
+			if !queried[n.id] {
+				batch = append(batch, n)
+				queried[n.id] = true
+				if len(batch) == alpha {
+					break
+				}
+			}
+		}
+		mu.Unlock()
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range batch {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				m, err := s.query(n.addr, method, map[string]interface{}{argKey: string(target[:])})
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					// Drop unresponsive nodes from the candidate list
+					s.table.remove(n.id)
+					for i, c := range candidates {
+						if c.id == n.id {
+							candidates = append(candidates[:i], candidates[i+1:]...)
+							break
+						}
+					}
+					return
+				}
+				responded[n.id] = true
+				if token, ok := stringArg(m.R, "token"); ok {
+					res.tokens[n.addr.String()] = token
+				}
+				if values, ok := m.R["values"].([]interface{}); ok {
+					for _, p := range decodePeers(values) {
+						if !seenPeers[p.String()] {
+							seenPeers[p.String()] = true
+							res.peers = append(res.peers, p)
+						}
+					}
+				}
+				for _, found := range s.learnNodes(m) {
+					if !seen[found.id] && found.id != s.id {
+						seen[found.id] = true
+						candidates = append(candidates, found)
+					}
+				}
+			}(n)
+		}
+		wg.Wait()
+	}
+
+	for _, n := range candidates {
+		if responded[n.id] {
+			res.nodes = append(res.nodes, n)
+			if len(res.nodes) == K {
+				break
+			}
+		}
+	}
+	return res
+}
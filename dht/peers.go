@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// peerTTL is how long an announced peer is kept without re-announcing
+	peerTTL = 30 * time.Minute
+	// maxPeersPerHash bounds the peers stored for a single info hash
+	maxPeersPerHash = 200
+	// maxPeersPerResponse bounds the "values" list of get_peers responses
+	maxPeersPerResponse = 50
+	// tokenRotation is how often the token secret changes. Tokens from the
+	// previous secret are still accepted.
+	tokenRotation = 5 * time.Minute
+)
+
+// peerStore keeps the peers announced to this node
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+}
+
+type storedPeer struct {
+	addr  *net.TCPAddr
+	added time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[string]storedPeer)}
+}
+
+func (s *peerStore) add(infoHash [20]byte, addr *net.TCPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := s.peers[infoHash]
+	if peers == nil {
+		peers = make(map[string]storedPeer)
+		s.peers[infoHash] = peers
+	}
+	if _, ok := peers[addr.String()]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+	peers[addr.String()] = storedPeer{addr: addr, added: time.Now()}
+}
+
+// get returns the unexpired peers for an info hash
+func (s *peerStore) get(infoHash [20]byte) []*net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*net.TCPAddr
+	for key, p := range s.peers[infoHash] {
+		if time.Since(p.added) > peerTTL {
+			delete(s.peers[infoHash], key)
+			continue
+		}
+		if len(out) < maxPeersPerResponse {
+			out = append(out, p.addr)
+		}
+	}
+	return out
+}
+
+// tokens issues and checks the write tokens handed out by get_peers
+type tokens struct {
+	mu       sync.Mutex
+	current  [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{rotated: time.Now()}
+	rand.Read(t.current[:])
+	t.previous = t.current
+	return t
+}
+
+func (t *tokens) rotate() {
+	if time.Since(t.rotated) < tokenRotation {
+		return
+	}
+	t.previous = t.current
+	rand.Read(t.current[:])
+	t.rotated = time.Now()
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip)
+	return string(h.Sum(nil)[:8])
+}
+
+// issue returns the token a node at ip must present to announce
+func (t *tokens) issue(ip net.IP) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return tokenFor(t.current, ip)
+}
+
+// valid reports whether token was issued to ip recently
+func (t *tokens) valid(token string, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return token == tokenFor(t.current, ip) || token == tokenFor(t.previous, ip)
+}
@@ -0,0 +1,71 @@
+package dht
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"tcp-app/internal/atomicfile"
+)
+
+type savedNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type savedState struct {
+	ID    string      `json:"id"`
+	Nodes []savedNode `json:"nodes"`
+}
+
+// saveState writes the node id and routing table to path atomically
+func saveState(path string, id [20]byte, nodes []*node) error {
+	state := savedState{ID: hex.EncodeToString(id[:])}
+	for _, n := range nodes {
+		state.Nodes = append(state.Nodes, savedNode{
+			ID:   hex.EncodeToString(n.id[:]),
+			Addr: n.addr.String(),
+		})
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, data, 0600)
+}
+
+// loadState reads a routing table written by saveState
+func loadState(path string) ([20]byte, []*node, error) {
+	var id [20]byte
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return id, nil, err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return id, nil, fmt.Errorf("invalid dht state file: %v", err)
+	}
+	b, err := hex.DecodeString(state.ID)
+	if err != nil || len(b) != len(id) {
+		return id, nil, fmt.Errorf("invalid node id in dht state file")
+	}
+	copy(id[:], b)
+
+	var nodes []*node
+	for _, sn := range state.Nodes {
+		b, err := hex.DecodeString(sn.ID)
+		if err != nil || len(b) != 20 {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", sn.Addr)
+		if err != nil {
+			continue
+		}
+		n := &node{addr: addr}
+		copy(n.id[:], b)
+		nodes = append(nodes, n)
+	}
+	return id, nodes, nil
+}
@@ -0,0 +1,158 @@
+package dht
+
+import (
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the maximum number of nodes per bucket and the size of lookup results
+const K = 8
+
+// staleAfter is how long a node may stay silent before it can be replaced
+const staleAfter = 15 * time.Minute
+
+// node is a remote DHT node
+type node struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+// distance returns the XOR distance between two ids
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// less reports whether distance a is smaller than distance b
+func less(a, b [20]byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// commonPrefixLen returns the number of leading bits a and b share
+func commonPrefixLen(a, b [20]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// table is a Kademlia routing table with one bucket per shared prefix
+// length. Buckets are ordered from least to most recently seen.
+type table struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [160][]*node
+}
+
+func newTable(self [20]byte) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucketIndex(id [20]byte) int {
+	i := commonPrefixLen(t.self, id)
+	if i >= len(t.buckets) {
+		i = len(t.buckets) - 1
+	}
+	return i
+}
+
+// update records that a node was heard from. New nodes are added when
+// their bucket has room or holds a stale node; otherwise they are dropped
+// in favour of long-lived nodes.
+func (t *table) update(n *node) {
+	if n.id == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n.lastSeen = time.Now()
+	i := t.bucketIndex(n.id)
+	bucket := t.buckets[i]
+	for j, existing := range bucket {
+		if existing.id == n.id {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			t.buckets[i] = append(bucket, n)
+			return
+		}
+	}
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, n)
+		return
+	}
+	if time.Since(bucket[0].lastSeen) > staleAfter {
+		t.buckets[i] = append(bucket[1:], n)
+	}
+}
+
+// remove drops a node that stopped responding
+func (t *table) remove(id [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.bucketIndex(id)
+	bucket := t.buckets[i]
+	for j, existing := range bucket {
+		if existing.id == id {
+			t.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to count known nodes ordered by distance to target
+func (t *table) closest(target [20]byte, count int) []*node {
+	t.mu.Lock()
+	var all []*node
+	for _, bucket := range t.buckets {
+		all = append(all, bucket...)
+	}
+	t.mu.Unlock()
+
+	sortByDistance(all, target)
+	if len(all) > count {
+		all = all[:count]
+	}
+	return all
+}
+
+// all returns every node in the table
+func (t *table) all() []*node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var all []*node
+	for _, bucket := range t.buckets {
+		all = append(all, bucket...)
+	}
+	return all
+}
+
+// size returns the number of nodes in the table
+func (t *table) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(nodes []*node, target [20]byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return less(distance(nodes[i].id, target), distance(nodes[j].id, target))
+	})
+}
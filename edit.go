@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"tcp-app/torrent"
+)
+
+// parseEditOptions parses the flags of the edit command. Flags taking a
+// value consume the following argument; --comment consumes every argument
+// up to the next flag so comments may contain spaces.
+func parseEditOptions(args []string) (torrent.EditOptions, error) {
+	var opts torrent.EditOptions
+	var webSeeds []string
+	clearWebSeeds := false
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag == "" {
+			continue
+		}
+		switch flag {
+		case "--clear-trackers":
+			opts.Trackers = [][]string{}
+			continue
+		case "--clear-web-seeds":
+			clearWebSeeds = true
+			continue
+		case "--force":
+			opts.AllowInfoHashChange = true
+			continue
+		case "--comment":
+			var words []string
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				words = append(words, args[i])
+			}
+			comment := strings.Join(words, " ")
+			opts.Comment = &comment
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("%s needs a value", flag)
+		}
+		i++
+		value := args[i]
+		switch flag {
+		case "--tracker":
+			opts.Trackers = append(opts.Trackers, []string{value})
+		case "--tier":
+			opts.Trackers = append(opts.Trackers, strings.Split(value, ","))
+		case "--web-seed":
+			webSeeds = append(webSeeds, value)
+		case "--source":
+			opts.Source = &value
+		case "--private":
+			if value != "on" && value != "off" {
+				return opts, fmt.Errorf("--private takes on or off")
+			}
+			private := value == "on"
+			opts.Private = &private
+		default:
+			return opts, fmt.Errorf("unknown option %s", flag)
+		}
+	}
+	if webSeeds != nil || clearWebSeeds {
+		opts.WebSeeds = append([]string{}, webSeeds...)
+	}
+	return opts, nil
+}
+
+// runEdit rewrites the trackers, web seeds, comment or info fields of a
+// torrent and returns the exit code: 0 when edited, 1 when the edit was
+// refused because it would change the info hash, 2 on errors
+func runEdit(args []string) int {
+	if len(args) < 2 {
+		fmt.Println("Usage: edit [torrent-file] [--tracker url ...] [--tier url,url ...] [--clear-trackers]")
+		fmt.Println("            [--web-seed url ...] [--clear-web-seeds] [--comment text]")
+		fmt.Println("            [--source tag] [--private on|off] [--force]")
+		return 2
+	}
+	opts, err := parseEditOptions(args[1:])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	result, err := torrent.Edit(args[0], opts)
+	if errors.Is(err, torrent.ErrInfoHashChange) {
+		fmt.Printf("Not edited: changing %s would change the info hash; peers and trackers would see a new torrent. Use --force to edit anyway.\n",
+			strings.Join(result.InfoFields, " and "))
+		return 1
+	}
+	if err != nil {
+		fmt.Printf("Error editing torrent: %v\n", err)
+		return 2
+	}
+	if result.InfoHashChanged() {
+		fmt.Printf("Edited %s; info hash changed from %x to %x\n", args[0], result.OldInfoHash, result.NewInfoHash)
+	} else {
+		fmt.Printf("Edited %s; info hash %x unchanged\n", args[0], result.OldInfoHash)
+	}
+	return 0
+}
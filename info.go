@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"tcp-app/torrent"
+)
+
+type infoFile struct {
+	Path        string `json:"path"`
+	Length      int    `json:"length"`
+	Attr        string `json:"attr,omitempty"`
+	SymlinkPath string `json:"symlink_path,omitempty"`
+}
+
+// torrentInfo is the JSON form of the info command's output
+type torrentInfo struct {
+	Name           string     `json:"name"`
+	InfoHash       string     `json:"info_hash"`
+	InfoHashBase32 string     `json:"info_hash_base32"`
+	Magnet         string     `json:"magnet"`
+	Trackers       []string   `json:"trackers"`
+	WebSeeds       []string   `json:"web_seeds,omitempty"`
+	HTTPSeeds      []string   `json:"http_seeds,omitempty"`
+	PieceLength    int        `json:"piece_length"`
+	Pieces         int        `json:"pieces"`
+	TotalSize      int        `json:"total_size"`
+	Private        bool       `json:"private"`
+	Source         string     `json:"source,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	CreationDate   *time.Time `json:"creation_date,omitempty"`
+	Comment        string     `json:"comment,omitempty"`
+	Files          []infoFile `json:"files"`
+}
+
+func newTorrentInfo(tf *torrent.TorrentFile) torrentInfo {
+	info := torrentInfo{
+		Name:           tf.Name,
+		InfoHash:       tf.InfoHashHex(),
+		InfoHashBase32: tf.InfoHashBase32(),
+		Magnet:         tf.Magnet(),
+		Trackers:       tf.Trackers(),
+		WebSeeds:       tf.URLList,
+		HTTPSeeds:      tf.HTTPSeeds,
+		PieceLength:    tf.PieceLength,
+		Pieces:         len(tf.PieceHashes),
+		TotalSize:      tf.Length,
+		Private:        tf.Private,
+		Source:         tf.Source,
+		CreatedBy:      tf.CreatedBy,
+		Comment:        tf.Comment,
+	}
+	if info.Trackers == nil {
+		info.Trackers = []string{}
+	}
+	if !tf.CreationDate.IsZero() {
+		info.CreationDate = &tf.CreationDate
+	}
+	for _, f := range tf.Layout() {
+		p := tf.Name
+		if len(f.Path) > 0 {
+			p = path.Join(append([]string{tf.Name}, f.Path...)...)
+		}
+		info.Files = append(info.Files, infoFile{
+			Path:        p,
+			Length:      f.Length,
+			Attr:        f.Attr,
+			SymlinkPath: strings.Join(f.SymlinkPath, "/"),
+		})
+	}
+	return info
+}
+
+// runInfo prints the metadata of a torrent file, as JSON with --json, and
+// returns the exit code
+func runInfo(args []string) int {
+	jsonOutput := false
+	var files []string
+	for _, arg := range args {
+		if arg == "--json" {
+			jsonOutput = true
+		} else {
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 1 {
+		fmt.Println("Usage: info [torrent-file] [--json]")
+		return 2
+	}
+	tf, err := torrent.Open(files[0])
+	if err != nil {
+		fmt.Printf("Error opening torrent file: %v\n", err)
+		return 2
+	}
+	info := newTorrentInfo(&tf)
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			fmt.Printf("Error encoding info: %v\n", err)
+			return 2
+		}
+		return 0
+	}
+
+	fmt.Printf("Name:         %s\n", info.Name)
+	fmt.Printf("Info hash:    %s\n", info.InfoHash)
+	fmt.Printf("              %s (base32)\n", info.InfoHashBase32)
+	fmt.Printf("Magnet:       %s\n", info.Magnet)
+	for i, tracker := range info.Trackers {
+		label := ""
+		if i == 0 {
+			label = "Trackers:"
+		}
+		fmt.Printf("%-14s%s\n", label, tracker)
+	}
+	for i, seed := range append(append([]string{}, info.WebSeeds...), info.HTTPSeeds...) {
+		label := ""
+		if i == 0 {
+			label = "Web seeds:"
+		}
+		fmt.Printf("%-14s%s\n", label, seed)
+	}
+	fmt.Printf("Piece size:   %s (%d bytes)\n", formatBytes(int64(info.PieceLength)), info.PieceLength)
+	fmt.Printf("Pieces:       %d\n", info.Pieces)
+	fmt.Printf("Total size:   %s (%d bytes)\n", formatBytes(int64(info.TotalSize)), info.TotalSize)
+	fmt.Printf("Private:      %t\n", info.Private)
+	if info.Source != "" {
+		fmt.Printf("Source:       %s\n", info.Source)
+	}
+	if info.CreatedBy != "" {
+		fmt.Printf("Created by:   %s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Printf("Created on:   %s\n", info.CreationDate.Format(time.RFC1123))
+	}
+	if info.Comment != "" {
+		fmt.Printf("Comment:      %s\n", info.Comment)
+	}
+	fmt.Println("Files:")
+	printFileTree(&tf)
+	return 0
+}
+
+// printFileTree prints the files of a torrent indented below their
+// directories. Padding files, and files without a path that Open would
+// have rejected, are left out.
+func printFileTree(tf *torrent.TorrentFile) {
+	if len(tf.Files) == 0 {
+		fmt.Printf("  %s (%s)\n", tf.Name, formatBytes(int64(tf.Length)))
+		return
+	}
+	fmt.Printf("  %s/\n", tf.Name)
+	var printed []string
+	for _, f := range tf.Files {
+		if f.IsPadding() || len(f.Path) == 0 {
+			continue
+		}
+		// Print the directories not shared with the previous file
+		dirs := f.Path[:len(f.Path)-1]
+		common := 0
+		for common < len(dirs) && common < len(printed) && dirs[common] == printed[common] {
+			common++
+		}
+		for depth := common; depth < len(dirs); depth++ {
+			fmt.Printf("  %s%s/\n", strings.Repeat("  ", depth+1), dirs[depth])
+		}
+		printed = dirs
+
+		detail := formatBytes(int64(f.Length))
+		if f.IsSymlink() {
+			detail = "-> " + strings.Join(f.SymlinkPath, "/")
+		}
+		if f.Attr != "" {
+			detail += ", attr " + f.Attr
+		}
+		fmt.Printf("  %s%s (%s)\n", strings.Repeat("  ", len(dirs)+1), f.Path[len(f.Path)-1], detail)
+	}
+}
+
+// formatBytes formats a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,279 @@
+// Package lsd implements Local Service Discovery (BEP 14), which finds
+// peers on the same LAN through multicast announcements.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multicast groups used for announcements
+const (
+	IPv4Group = "239.192.152.143:6771"
+	IPv6Group = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	// DefaultInterval is how often every active torrent is re-announced
+	DefaultInterval = 5 * time.Minute
+	// minAnnounceGap rate limits announcements of a single info hash
+	minAnnounceGap = time.Minute
+	// maxHashesPerMessage keeps announcements within a single datagram
+	maxHashesPerMessage = 20
+)
+
+// Config controls the discovery service
+type Config struct {
+	// Port is the TCP port of the local peer server being announced
+	Port int
+	// OnPeer is called for every peer discovered on the LAN
+	OnPeer func(infoHash [20]byte, addr *net.TCPAddr)
+	// Interval overrides DefaultInterval when non-zero
+	Interval time.Duration
+}
+
+// Service announces active torrents and listens for other peers'
+// announcements on the IPv4 and IPv6 multicast groups
+type Service struct {
+	cfg    Config
+	cookie string
+	groups []*group
+
+	mu        sync.Mutex
+	hashes    map[[20]byte]bool
+	announced map[[20]byte]time.Time
+	closed    chan struct{}
+}
+
+type group struct {
+	addr     *net.UDPAddr
+	listener *net.UDPConn
+	sender   *net.UDPConn
+}
+
+// Start joins the multicast groups. It fails only if neither IPv4 nor
+// IPv6 multicast is available.
+func Start(cfg Config) (*Service, error) {
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	s := &Service{
+		cfg:       cfg,
+		cookie:    hex.EncodeToString(cookie),
+		hashes:    make(map[[20]byte]bool),
+		announced: make(map[[20]byte]time.Time),
+		closed:    make(chan struct{}),
+	}
+
+	var errs []string
+	for _, network := range []struct{ name, addr string }{{"udp4", IPv4Group}, {"udp6", IPv6Group}} {
+		g, err := joinGroup(network.name, network.addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		s.groups = append(s.groups, g)
+		go s.listen(g)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("local service discovery unavailable: %s", strings.Join(errs, "; "))
+	}
+	go s.run()
+	return s, nil
+}
+
+func joinGroup(network, address string) (*group, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error joining %s: %v", address, err)
+	}
+	sender, err := net.DialUDP(network, nil, addr)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error dialing %s: %v", address, err)
+	}
+	return &group{addr: addr, listener: listener, sender: sender}, nil
+}
+
+// Add starts announcing a torrent. Private torrents are never announced.
+func (s *Service) Add(infoHash [20]byte, private bool) {
+	if private {
+		return
+	}
+	s.mu.Lock()
+	s.hashes[infoHash] = true
+	s.mu.Unlock()
+	s.announce([][20]byte{infoHash})
+}
+
+// Remove stops announcing a torrent
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hashes, infoHash)
+	delete(s.announced, infoHash)
+}
+
+// Close leaves the multicast groups
+func (s *Service) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	for _, g := range s.groups {
+		g.listener.Close()
+		g.sender.Close()
+	}
+	return nil
+}
+
+func (s *Service) run() {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			hashes := make([][20]byte, 0, len(s.hashes))
+			for h := range s.hashes {
+				hashes = append(hashes, h)
+			}
+			s.mu.Unlock()
+			s.announce(hashes)
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// announce multicasts the given info hashes, skipping any announced less
+// than a minute ago
+func (s *Service) announce(hashes [][20]byte) {
+	s.mu.Lock()
+	var due [][20]byte
+	for _, h := range hashes {
+		if time.Since(s.announced[h]) >= minAnnounceGap {
+			s.announced[h] = time.Now()
+			due = append(due, h)
+		}
+	}
+	s.mu.Unlock()
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxHashesPerMessage {
+			n = maxHashesPerMessage
+		}
+		for _, g := range s.groups {
+			if _, err := g.sender.Write(s.message(g.addr, due[:n])); err != nil {
+				fmt.Printf("Error sending LSD announce to %s: %v\n", g.addr, err)
+			}
+		}
+		due = due[n:]
+	}
+}
+
+// message builds a BT-SEARCH announcement
+func (s *Service) message(groupAddr *net.UDPAddr, hashes [][20]byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", groupAddr)
+	fmt.Fprintf(&buf, "Port: %d\r\n", s.cfg.Port)
+	for _, h := range hashes {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", h)
+	}
+	fmt.Fprintf(&buf, "cookie: %s\r\n", s.cookie)
+	fmt.Fprintf(&buf, "\r\n\r\n")
+	return buf.Bytes()
+}
+
+func (s *Service) listen(g *group) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := g.listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			continue
+		}
+		s.handleMessage(buf[:n], from)
+	}
+}
+
+// handleMessage parses a BT-SEARCH announcement and reports the peers for
+// torrents we are interested in
+func (s *Service) handleMessage(data []byte, from *net.UDPAddr) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	requestLine, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(requestLine, "BT-SEARCH * HTTP/1.1") {
+		return
+	}
+	header, err := readHeader(reader)
+	if err != nil {
+		return
+	}
+	if header.Get("Cookie") == s.cookie {
+		// Our own announcement looped back
+		return
+	}
+	port, err := strconv.Atoi(header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	addr := &net.TCPAddr{IP: from.IP, Port: port}
+
+	for _, value := range header.Values("Infohash") {
+		b, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(b) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], b)
+
+		s.mu.Lock()
+		active := s.hashes[infoHash]
+		s.mu.Unlock()
+		if active && s.cfg.OnPeer != nil {
+			s.cfg.OnPeer(infoHash, addr)
+		}
+	}
+}
+
+// readHeader reads "Key: value" lines up to the first blank line
+func readHeader(reader *bufio.Reader) (http.Header, error) {
+	header := make(http.Header)
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return header, nil
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+		if err != nil {
+			return header, nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package lsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestService returns a service that has not joined any group
+func newTestService(port int, cookie string, onPeer func([20]byte, *net.TCPAddr)) *Service {
+	return &Service{
+		cfg:       Config{Port: port, OnPeer: onPeer, Interval: DefaultInterval},
+		cookie:    cookie,
+		hashes:    make(map[[20]byte]bool),
+		announced: make(map[[20]byte]time.Time),
+		closed:    make(chan struct{}),
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	group, _ := net.ResolveUDPAddr("udp4", IPv4Group)
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 6771}
+	active, other := [20]byte{1}, [20]byte{2}
+	sender := newTestService(6881, "remote", nil)
+
+	tests := []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{"announcement", string(sender.message(group, [][20]byte{active})), []string{"192.168.1.20:6881"}},
+		{"several torrents", string(sender.message(group, [][20]byte{other, active})), []string{"192.168.1.20:6881"}},
+		{"inactive torrent", string(sender.message(group, [][20]byte{other})), nil},
+		{"own announcement", string(newTestService(6881, "local", nil).message(group, [][20]byte{active})), nil},
+		{"bad port", strings.Replace(string(sender.message(group, [][20]byte{active})), "Port: 6881", "Port: 70000", 1), nil},
+		{"not a search", strings.Replace(string(sender.message(group, [][20]byte{active})), "BT-SEARCH", "M-SEARCH", 1), nil},
+		{"short info hash", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0100\r\ncookie: x\r\n\r\n\r\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			s := newTestService(6882, "local", func(infoHash [20]byte, addr *net.TCPAddr) {
+				if infoHash != active {
+					t.Errorf("reported peer for inactive torrent %x", infoHash)
+				}
+				got = append(got, addr.String())
+			})
+			s.hashes[active] = true
+			s.handleMessage([]byte(tt.message), from)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("peers %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnounceRateLimit(t *testing.T) {
+	s := newTestService(6881, "local", nil)
+	infoHash := [20]byte{1}
+	s.Add(infoHash, false)
+	first := s.announced[infoHash]
+	if first.IsZero() {
+		t.Fatal("torrent not announced when added")
+	}
+	s.announce([][20]byte{infoHash})
+	if !s.announced[infoHash].Equal(first) {
+		t.Error("torrent announced again within a minute")
+	}
+
+	s.Remove(infoHash)
+	s.Add(infoHash, true)
+	if s.hashes[infoHash] || !s.announced[infoHash].IsZero() {
+		t.Error("private torrent announced")
+	}
+}
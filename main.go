@@ -1,113 +1,230 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"tcp-app/client"
-	"tcp-app/server"
+	"tcp-app/storage"
 	"tcp-app/torrent"
 )
 
-func main() {
-	go func() {
-		err := server.StartServer(":8080")
-		if err != nil {
-			log.Fatalf("Failed to start server: %v\n", err)
-		}
-	}()
-
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Torrent Simulation App")
-	fmt.Println("Commands:")
-	fmt.Println("  download [torrent-file]  - Start downloading a torrent file")
-	fmt.Println("  test [ip:port]          - Test connection to a peer")
-	fmt.Println("  exit                     - Exit the program")
-	fmt.Println("  clear                    - Clear the terminal")
-	fmt.Println("  create [file]            - Create a torrent file from a source file")
-	fmt.Println("  open [torrent-file]      - Open and display torrent file contents")
-	fmt.Println("  test-file [filename]     - Test split and merge functionality")
-	for {
-		fmt.Print("> ") // CLI prompt
-		commandLine, _ := reader.ReadString('\n')
-		commandLine = strings.TrimSpace(commandLine)
+// command is a subcommand run from the command line. run returns the exit
+// code: 0 on success, 1 when the command failed and 2 for usage errors.
+type command struct {
+	run     func(args []string) int
+	args    string
+	summary string
+}
 
-		// Handle commands
-		switch {
-		case strings.HasPrefix(commandLine, "seed"):
-			args := strings.Split(commandLine, " ")
-			if len(args) < 2 {
-				fmt.Println("Usage: seed [torrent-file]")
-				continue
-			}
-			torrentFile := args[1]
-			server.StartServer(torrentFile)
-		case strings.HasPrefix(commandLine, "download"):
-			args := strings.Split(commandLine, " ")
-			if len(args) < 2 {
-				fmt.Println("Usage: download [torrent-file]")
-				continue
-			}
-			torrentFile := args[1]
-			client.StartDownload(torrentFile)
+var commands = map[string]command{
+	"create":   {runCreate, "create [file|dir] [web-seed-url...]", "Create a torrent file"},
+	"info":     {runInfo, "info [torrent-file] [--json]", "Show torrent metadata"},
+	"edit":     {runEdit, "edit [torrent-file] [options]", "Change trackers, web seeds or comment"},
+	"verify":   {runVerify, "verify [torrent-file] [path]", "Check local data against a torrent"},
+	"download": {runDownload, "download [torrent-file] [options]", "Download a torrent"},
+	"seed":     {runSeed, "seed [torrent-file] [path] [options]", "Serve a torrent to peers"},
+	"tracker":  {runTracker, "tracker [--listen address]", "Run an HTTP tracker"},
+	"daemon":   {runDaemon, "daemon [--socket path] [options]", "Manage torrents in the background"},
+	"ctl":      {runCtl, "ctl [--socket path] <action>", "Control a running daemon"},
+	"shell":    {runShell, "shell [--listen address]", "Start the interactive prompt"},
+}
 
-		case strings.HasPrefix(commandLine, "test"):
-			args := strings.Split(commandLine, " ")
-			if len(args) < 2 {
-				fmt.Println("Usage: test [ip:port]")
-				continue
-			}
-			peerAddress := args[1]
-			if err := client.TestConnection(peerAddress); err != nil {
-				fmt.Printf("Connection failed: %v\n", err)
-			} else {
-				fmt.Printf("Successfully connected to %s\n", peerAddress)
-			}
+// commandOrder lists the commands in the order usage shows them
+var commandOrder = []string{"create", "info", "edit", "verify", "download", "seed", "tracker", "daemon", "ctl", "shell"}
 
-		case commandLine == "exit":
-			fmt.Println("Exiting...")
-			return
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Printf("Unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
 
-		case commandLine == "clear":
-			fmt.Println("\033[H\033[2J") // Clear the terminal
+func usage() {
+	fmt.Printf("Usage: %s <command> [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, name := range commandOrder {
+		fmt.Printf("  %-38s %s\n", commands[name].args, commands[name].summary)
+	}
+	fmt.Println()
+	fmt.Println("Commands print their options on invalid usage. Exit codes: 0 success,")
+	fmt.Println("1 failure (for verify: damaged data), 2 invalid usage.")
+}
 
-		case strings.HasPrefix(commandLine, "create"):
-			args := strings.Split(commandLine, " ")
-			if len(args) < 2 {
-				fmt.Println("Usage: create [file]")
-				continue
+// parseDownloadOptions reads the flags of the download command
+func parseDownloadOptions(args []string) (client.Options, error) {
+	opts := client.Options{FilePriorities: make(map[int]client.Priority)}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--sequential":
+			opts.Sequential = true
+		case "--first-last":
+			opts.FirstLastFirst = true
+		case "--output":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--output needs a directory")
 			}
-			sourceFile := args[1]
-			torrentFileName, err := torrent.Create(sourceFile)
+			i++
+			opts.OutputDir = args[i]
+		case "--peer":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--peer needs an address")
+			}
+			i++
+			opts.Peers = append(opts.Peers, args[i])
+		case "--storage":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--storage needs file, memory or mmap")
+			}
+			i++
+			kind, err := storage.ParseKind(args[i])
 			if err != nil {
-				fmt.Printf("Failed to create torrent file: %v\n", err)
-			} else {
-				fmt.Printf("Torrent file created successfully: %s\n", torrentFileName)
+				return opts, err
 			}
-		case strings.HasPrefix(commandLine, "open"):
-			args := strings.Split(commandLine, " ")
-			if len(args) < 2 {
-				fmt.Println("Usage: open [torrent-file]")
-				continue
+			opts.Storage = kind
+		case "--file":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--file needs index=priority")
 			}
-			torrentFile := args[1]
-			torrent.Open(torrentFile)
-		case strings.HasPrefix(commandLine, "check-file"):
-			args := strings.Split(commandLine, " ")
-			if len(args) < 2 {
-				fmt.Println("Usage: check-file <filename>")
-				return
+			i++
+			index, level, ok := strings.Cut(args[i], "=")
+			n, err := strconv.Atoi(index)
+			if !ok || err != nil {
+				return opts, fmt.Errorf("invalid file priority %q", args[i])
 			}
-			filename := args[1]
-			if err := torrent.TestSplitAndMerge(filename); err != nil {
-				fmt.Printf("Test failed: %v\n", err)
-				return
+			prio, err := client.ParsePriority(level)
+			if err != nil {
+				return opts, err
 			}
+			opts.FilePriorities[n] = prio
 		default:
-			fmt.Println("Unknown command. Try again.")
+			return opts, fmt.Errorf("unknown download option %q", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// hashProgressPrinter returns a callback showing how much of a file has
+// been hashed, updating the line whenever the percentage changes
+func hashProgressPrinter() torrent.ProgressFunc {
+	last := int64(-1)
+	return func(done, total int64) {
+		if total == 0 || done*100/total == last {
+			return
+		}
+		last = done * 100 / total
+		fmt.Printf("\rHashing: %3d%% (%d/%d bytes)", last, done, total)
+	}
+}
+
+// parseCreateOptions reads the flags of the create command. Other
+// arguments are web seed URLs.
+func parseCreateOptions(args []string) (torrent.CreateOptions, error) {
+	var opts torrent.CreateOptions
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--align" {
+			opts.Align = true
+			continue
+		}
+		if args[i] == "--tracker" {
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--tracker needs a URL")
+			}
+			i++
+			opts.Tracker = args[i]
+			continue
+		}
+		if args[i] != "--piece-length" {
+			opts.WebSeeds = append(opts.WebSeeds, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("--piece-length needs a size")
+		}
+		i++
+		size, err := parseSize(args[i])
+		if err != nil {
+			return opts, err
+		}
+		if err := torrent.ValidatePieceLength(size); err != nil {
+			return opts, err
+		}
+		opts.PieceLength = size
+	}
+	return opts, nil
+}
+
+// parseSize parses a byte count with an optional k or m suffix
+func parseSize(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing size")
+	}
+	multiplier := 1
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		multiplier = 1024
+	case "m":
+		multiplier = 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// runVerify checks local data against a torrent and returns the exit code:
+// 0 if everything matches, 1 if pieces are missing or corrupt, 2 on errors
+func runVerify(args []string) int {
+	if len(args) < 2 {
+		fmt.Println("Usage: verify [torrent-file] [path]")
+		return 2
+	}
+	tf, err := torrent.Open(args[0])
+	if err != nil {
+		fmt.Printf("Error opening torrent file: %v\n", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result, err := torrent.Verify(ctx, &tf, args[1], torrent.VerifyOptions{Progress: hashProgressPrinter()})
+	fmt.Println()
+	if err != nil {
+		fmt.Printf("Verification failed: %v\n", err)
+		return 2
+	}
+
+	if result.OK() {
+		fmt.Printf("All %d pieces are complete and correct\n", result.Pieces)
+		return 0
+	}
+	fmt.Printf("%d of %d pieces are missing, %d are corrupt\n", len(result.Missing), result.Pieces, len(result.Corrupt))
+	for _, r := range result.Damaged {
+		state := "corrupt"
+		if r.Missing {
+			state = "missing"
 		}
+		fmt.Printf("  %s: bytes %d-%d %s\n", r.Path, r.Start, r.End-1, state)
 	}
+	return 1
 }
@@ -0,0 +1,243 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// plaintextPrefixes are the first bytes of every unencrypted message of
+// the peer protocol. Anything else is treated as an encrypted handshake.
+var plaintextPrefixes = []string{"HANDSHAKE:", "test", "Requesting"}
+
+// Initiate performs the outgoing side of the handshake using infoHash as
+// SKEY. With PolicyDisable the connection is returned untouched. With
+// PolicyPrefer plaintext is offered alongside RC4, so the remote side may
+// choose it; with PolicyRequire only RC4 is offered.
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (net.Conn, error) {
+	if policy == PolicyDisable {
+		return conn, nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTTL))
+	defer conn.SetDeadline(time.Time{})
+
+	priv, ya, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(ya, padA...)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(reader, yb); err != nil {
+		return nil, fmt.Errorf("mse: error reading public key: %v", err)
+	}
+	secret, err := sharedSecret(yb, priv)
+	if err != nil {
+		return nil, err
+	}
+	skey := infoHash[:]
+	enc := newCipher("keyA", secret, skey)
+	dec := newCipher("keyB", secret, skey)
+
+	provide := uint32(cryptoRC4)
+	if policy == PolicyPrefer {
+		provide |= cryptoPlaintext
+	}
+	padC, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	var plain bytes.Buffer
+	plain.Write(make([]byte, vcLen))
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(len(padC)))
+	plain.Write(padC)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // no initial payload
+	encrypted := make([]byte, plain.Len())
+	enc.XORKeyStream(encrypted, plain.Bytes())
+
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), secret))
+	msg.Write(xorBytes(hash([]byte("req2"), skey), hash([]byte("req3"), secret)))
+	msg.Write(encrypted)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Skip PadB by looking for the encrypted verification constant
+	vc := make([]byte, vcLen)
+	dec.XORKeyStream(vc, vc)
+	if err := readUntil(reader, vc, maxPadLen); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:]))
+	if len(padD) > maxPadLen {
+		return nil, errors.New("mse: padding too long")
+	}
+	if _, err := io.ReadFull(reader, padD); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	c := &Conn{Conn: conn, reader: reader, InfoHash: infoHash}
+	switch {
+	case selected == cryptoRC4:
+		c.enc, c.dec, c.Encrypted = enc, dec, true
+	case selected == cryptoPlaintext && policy == PolicyPrefer:
+	default:
+		return nil, fmt.Errorf("mse: remote selected unsupported method %d", selected)
+	}
+	return c, nil
+}
+
+// Accept performs the incoming side of the handshake. Plaintext
+// connections are detected from their first bytes and passed through
+// unless policy requires encryption. skeys returns the info hashes this
+// side serves; the handshake must match one of them.
+func Accept(conn net.Conn, policy Policy, skeys func() [][20]byte) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTTL))
+	first, err := reader.Peek(4)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range plaintextPrefixes {
+		if bytes.HasPrefix([]byte(prefix), first) {
+			if policy == PolicyRequire {
+				return nil, ErrPlaintextRefused
+			}
+			return &peekedConn{Conn: conn, reader: reader}, nil
+		}
+	}
+	if policy == PolicyDisable {
+		return nil, errors.New("mse: encrypted connection refused by policy")
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTTL))
+	defer conn.SetDeadline(time.Time{})
+
+	ya := make([]byte, keyLen)
+	if _, err := io.ReadFull(reader, ya); err != nil {
+		return nil, fmt.Errorf("mse: error reading public key: %v", err)
+	}
+	priv, yb, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(ya, priv)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(yb, padB...)); err != nil {
+		return nil, err
+	}
+
+	// Skip PadA by looking for HASH('req1', S)
+	if err := readUntil(reader, hash([]byte("req1"), secret), maxPadLen); err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, err
+	}
+	req2 := xorBytes(obfuscated, hash([]byte("req3"), secret))
+	var infoHash [20]byte
+	found := false
+	for _, candidate := range skeys() {
+		if bytes.Equal(req2, hash([]byte("req2"), candidate[:])) {
+			infoHash = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrUnknownSKEY
+	}
+
+	skey := infoHash[:]
+	dec := newCipher("keyA", secret, skey)
+	enc := newCipher("keyB", secret, skey)
+
+	header := make([]byte, vcLen+6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:vcLen], make([]byte, vcLen)) {
+		return nil, errors.New("mse: bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[vcLen:])
+	padC := make([]byte, binary.BigEndian.Uint16(header[vcLen+4:]))
+	if len(padC) > maxPadLen {
+		return nil, errors.New("mse: padding too long")
+	}
+	if _, err := io.ReadFull(reader, padC); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	iaLen := make([]byte, 2)
+	if _, err := io.ReadFull(reader, iaLen); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(iaLen, iaLen)
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen))
+	if _, err := io.ReadFull(reader, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy == PolicyPrefer:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("mse: no acceptable method in %d", provide)
+	}
+
+	padD, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	var plain bytes.Buffer
+	plain.Write(make([]byte, vcLen))
+	binary.Write(&plain, binary.BigEndian, selected)
+	binary.Write(&plain, binary.BigEndian, uint16(len(padD)))
+	plain.Write(padD)
+	reply := make([]byte, plain.Len())
+	enc.XORKeyStream(reply, plain.Bytes())
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	// The initial payload is handed to the caller ahead of the stream
+	c := &Conn{Conn: conn, reader: reader, pending: ia, InfoHash: infoHash}
+	if selected == cryptoRC4 {
+		c.enc, c.dec, c.Encrypted = enc, dec, true
+	}
+	return c, nil
+}
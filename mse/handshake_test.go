@@ -0,0 +1,162 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordingConn keeps a copy of everything written to the connection
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// connPair returns both ends of a loopback TCP connection
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+func TestHandshakePolicies(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	tests := []struct {
+		initiator, acceptor Policy
+		encrypted           bool
+		refused             bool
+	}{
+		{PolicyPrefer, PolicyPrefer, true, false},
+		{PolicyPrefer, PolicyRequire, true, false},
+		{PolicyRequire, PolicyPrefer, true, false},
+		{PolicyRequire, PolicyRequire, true, false},
+		{PolicyDisable, PolicyPrefer, false, false},
+		{PolicyDisable, PolicyDisable, false, false},
+		{PolicyDisable, PolicyRequire, false, true},
+		{PolicyPrefer, PolicyDisable, false, true},
+		{PolicyRequire, PolicyDisable, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.initiator.String()+"/"+tt.acceptor.String(), func(t *testing.T) {
+			raw, incoming := connPair(t)
+			outgoing := &recordingConn{Conn: raw}
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			accepted := make(chan result, 1)
+			go func() {
+				conn, err := Accept(incoming, tt.acceptor, func() [][20]byte { return [][20]byte{infoHash} })
+				if err != nil {
+					incoming.Close()
+				}
+				accepted <- result{conn, err}
+			}()
+
+			conn, err := Initiate(outgoing, infoHash, tt.initiator)
+			if err == nil {
+				_, err = conn.Write([]byte("HANDSHAKE:secret\n"))
+			}
+			got := <-accepted
+			if tt.refused {
+				if got.err == nil {
+					t.Fatal("acceptor allowed a connection its policy forbids")
+				}
+				return
+			}
+			if err != nil || got.err != nil {
+				t.Fatalf("initiate: %v, accept: %v", err, got.err)
+			}
+
+			line, err := bufio.NewReader(got.conn).ReadString('\n')
+			if err != nil || line != "HANDSHAKE:secret\n" {
+				t.Fatalf("acceptor read %q, %v", line, err)
+			}
+			if c, ok := conn.(*Conn); (ok && c.Encrypted) != tt.encrypted {
+				t.Errorf("initiator encrypted = %v, want %v", ok && c.Encrypted, tt.encrypted)
+			}
+			if c, ok := got.conn.(*Conn); (ok && c.Encrypted) != tt.encrypted {
+				t.Errorf("acceptor encrypted = %v, want %v", ok && c.Encrypted, tt.encrypted)
+			}
+			leaked := bytes.Contains(outgoing.written.Bytes(), []byte("secret"))
+			if leaked == tt.encrypted {
+				t.Errorf("plaintext on the wire = %v with encryption %v", leaked, tt.encrypted)
+			}
+
+			// The reply travels back through the same ciphers
+			if _, err := got.conn.Write([]byte("OK\n")); err != nil {
+				t.Fatal(err)
+			}
+			reply, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || reply != "OK\n" {
+				t.Errorf("initiator read %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+func TestHandshakeUnknownTorrent(t *testing.T) {
+	raw, incoming := connPair(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := Accept(incoming, PolicyPrefer, func() [][20]byte { return [][20]byte{{9}} })
+		incoming.Close()
+		errs <- err
+	}()
+	Initiate(raw, [20]byte{1}, PolicyRequire)
+	if err := <-errs; !errors.Is(err, ErrUnknownSKEY) {
+		t.Errorf("accept returned %v, want %v", err, ErrUnknownSKEY)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Policy
+		ok   bool
+	}{
+		{"prefer", PolicyPrefer, true},
+		{"REQUIRE", PolicyRequire, true},
+		{"disable", PolicyDisable, true},
+		{"always", PolicyPrefer, false},
+	}
+	for _, tt := range tests {
+		got, err := ParsePolicy(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("ParsePolicy(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package mse implements Message Stream Encryption / Protocol Encryption:
+// a Diffie-Hellman key exchange followed by RC4 obfuscation of the peer
+// connection, with the info hash used as the shared secret (SKEY).
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy controls when connections are encrypted
+type Policy int
+
+const (
+	// PolicyPrefer encrypts when the remote side supports it
+	PolicyPrefer Policy = iota
+	// PolicyRequire refuses plaintext connections
+	PolicyRequire
+	// PolicyDisable never encrypts
+	PolicyDisable
+)
+
+// ParsePolicy converts "prefer", "require" or "disable" to a Policy
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "prefer":
+		return PolicyPrefer, nil
+	case "require":
+		return PolicyRequire, nil
+	case "disable":
+		return PolicyDisable, nil
+	}
+	return PolicyPrefer, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyRequire:
+		return "require"
+	case PolicyDisable:
+		return "disable"
+	}
+	return "prefer"
+}
+
+// Crypto methods offered in crypto_provide and chosen in crypto_select
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+const (
+	keyLen       = 96
+	maxPadLen    = 512
+	vcLen        = 8
+	handshakeTTL = 10 * time.Second
+)
+
+// The 768 bit safe prime and generator from the specification
+var (
+	dhPrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+)
+
+// ErrPlaintextRefused is returned when policy requires encryption but the
+// remote side sent plaintext
+var ErrPlaintextRefused = errors.New("mse: plaintext connection refused by policy")
+
+// ErrUnknownSKEY is returned when no known info hash matches the handshake
+var ErrUnknownSKEY = errors.New("mse: no matching torrent for encrypted handshake")
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newKeyPair returns a random private key and the padded public key
+func newKeyPair() (*big.Int, []byte, error) {
+	priv := make([]byte, 20)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(priv)
+	y := new(big.Int).Exp(dhGenerator, x, dhPrime)
+	return x, padKey(y), nil
+}
+
+func padKey(v *big.Int) []byte {
+	out := make([]byte, keyLen)
+	v.FillBytes(out)
+	return out
+}
+
+// sharedSecret computes S from the remote public key and our private key
+func sharedSecret(remote []byte, priv *big.Int) ([]byte, error) {
+	y := new(big.Int).SetBytes(remote)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(dhPrime, big.NewInt(1))) >= 0 {
+		return nil, errors.New("mse: invalid public key")
+	}
+	return padKey(new(big.Int).Exp(y, priv, dhPrime)), nil
+}
+
+// newCipher creates an RC4 stream keyed as in the specification, with the
+// first 1024 bytes of keystream discarded
+func newCipher(name string, secret, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLen+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// Conn is a peer connection after the encryption handshake. Reads and
+// writes go through RC4 when it was selected.
+type Conn struct {
+	net.Conn
+	reader  io.Reader
+	pending []byte
+	writeMu sync.Mutex
+	enc     *rc4.Cipher
+	dec     *rc4.Cipher
+	// Encrypted reports whether RC4 was negotiated
+	Encrypted bool
+	// InfoHash is the SKEY the handshake matched
+	InfoHash [20]byte
+}
+
+// Read reads and decrypts data from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.reader.Read(b)
+	if c.dec != nil && n > 0 {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts and writes data to the connection
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	out := make([]byte, len(b))
+	c.enc.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// peekedConn replays bytes already read while sniffing the protocol
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// readUntil reads from r until pattern was consumed, failing after limit
+// bytes without a match
+func readUntil(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit+len(pattern))
+	for len(window) < limit+len(pattern) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("mse: synchronisation pattern not found")
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
@@ -0,0 +1,275 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// MsgExtended carries an extension protocol (BEP 10) message. The line is
+// EXTENDED:<id>:<length> and is followed by length bytes of payload. An id
+// of 0 is the extended handshake.
+const MsgExtended = "EXTENDED"
+
+// ClientVersion is sent as "v" in the extended handshake
+const ClientVersion = "tcp-app 0.1"
+
+// DefaultRequestQueue is sent as "reqq" in the extended handshake
+const DefaultRequestQueue = 250
+
+// ErrUnsupported is returned when sending an extension message the remote
+// peer did not advertise in its extended handshake.
+var ErrUnsupported = errors.New("extension not supported by peer")
+
+// Extension is a protocol extension negotiated through the extended
+// handshake, such as metadata exchange or peer exchange.
+type Extension interface {
+	// Name is the key of the extension in the handshake "m" dictionary
+	Name() string
+	// HandleMessage processes a message the remote peer sent to this extension
+	HandleMessage(s *Session, payload []byte) error
+}
+
+// HandshakeHook is implemented by extensions that add their own keys to the
+// extended handshake or need to know once the remote handshake arrived.
+type HandshakeHook interface {
+	ExtendHandshake(s *Session, hs map[string]interface{})
+	OnHandshake(s *Session)
+}
+
+// CloseHook is implemented by extensions that keep per-connection state.
+type CloseHook interface {
+	OnClose(s *Session)
+}
+
+// Conn is the part of a peer connection the extension layer writes to.
+type Conn interface {
+	RemoteAddr() net.Addr
+	WriteExtended(id int, payload []byte) error
+}
+
+// ExtendedHandshake is the decoded extended handshake of a remote peer
+type ExtendedHandshake struct {
+	M      map[string]int
+	V      string
+	P      int
+	Reqq   int
+	YourIP net.IP
+	// Dict holds the complete decoded dictionary for extension specific keys
+	Dict map[string]interface{}
+}
+
+// Registry holds the extensions supported by the local side. Local message
+// ids are assigned in registration order starting at 1.
+type Registry struct {
+	mu         sync.RWMutex
+	extensions []Extension
+}
+
+// NewRegistry creates an empty extension registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds an extension to the registry
+func (r *Registry) Register(ext Extension) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.extensions {
+		if e.Name() == ext.Name() {
+			return fmt.Errorf("extension %s already registered", ext.Name())
+		}
+	}
+	r.extensions = append(r.extensions, ext)
+	return nil
+}
+
+// Extensions returns the registered extensions ordered by local id
+func (r *Registry) Extensions() []Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Extension(nil), r.extensions...)
+}
+
+func (r *Registry) byID(id int) Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if id < 1 || id > len(r.extensions) {
+		return nil
+	}
+	return r.extensions[id-1]
+}
+
+// Session is the extension protocol state of a single peer connection.
+type Session struct {
+	registry *Registry
+	conn     Conn
+
+	// InfoHash is the torrent the connection was opened for
+	InfoHash [20]byte
+	// ListenPort is advertised to the remote peer as "p" when non-zero
+	ListenPort int
+	// Private marks sessions for private torrents, where extensions that
+	// share peers must stay silent
+	Private bool
+
+	mu     sync.Mutex
+	remote *ExtendedHandshake
+}
+
+// NewSession creates the extension state for a newly handshaken connection
+func (r *Registry) NewSession(conn Conn, infoHash [20]byte) *Session {
+	return &Session{registry: r, conn: conn, InfoHash: infoHash}
+}
+
+// RemoteAddr returns the address of the remote peer
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Remote returns the remote extended handshake, or nil if none arrived yet
+func (s *Session) Remote() *ExtendedHandshake {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// SendHandshake sends the local extended handshake to the remote peer
+func (s *Session) SendHandshake() error {
+	m := make(map[string]interface{})
+	for i, ext := range s.registry.Extensions() {
+		m[ext.Name()] = i + 1
+	}
+	hs := map[string]interface{}{
+		"m":    m,
+		"v":    ClientVersion,
+		"reqq": DefaultRequestQueue,
+	}
+	if s.ListenPort > 0 {
+		hs["p"] = s.ListenPort
+	}
+	if ip := RemoteIP(s.conn.RemoteAddr()); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			hs["yourip"] = string(ip4)
+		} else {
+			hs["yourip"] = string(ip.To16())
+		}
+	}
+	for _, ext := range s.registry.Extensions() {
+		if hook, ok := ext.(HandshakeHook); ok {
+			hook.ExtendHandshake(s, hs)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, hs); err != nil {
+		return err
+	}
+	return s.conn.WriteExtended(0, buf.Bytes())
+}
+
+// Send writes a message to the remote peer's instance of the named extension
+func (s *Session) Send(name string, payload []byte) error {
+	remote := s.Remote()
+	if remote == nil {
+		return ErrUnsupported
+	}
+	id, ok := remote.M[name]
+	if !ok || id == 0 {
+		return ErrUnsupported
+	}
+	return s.conn.WriteExtended(id, payload)
+}
+
+// Supports reports whether the remote peer advertised the named extension
+func (s *Session) Supports(name string) bool {
+	remote := s.Remote()
+	return remote != nil && remote.M[name] != 0
+}
+
+// HandleMessage dispatches an incoming extended message by its local id
+func (s *Session) HandleMessage(id int, payload []byte) error {
+	if id == 0 {
+		return s.handleHandshake(payload)
+	}
+	ext := s.registry.byID(id)
+	if ext == nil {
+		return fmt.Errorf("unknown extended message id %d", id)
+	}
+	return ext.HandleMessage(s, payload)
+}
+
+// Close notifies extensions that the connection went away
+func (s *Session) Close() {
+	for _, ext := range s.registry.Extensions() {
+		if hook, ok := ext.(CloseHook); ok {
+			hook.OnClose(s)
+		}
+	}
+}
+
+func (s *Session) handleHandshake(payload []byte) error {
+	hs, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.remote = hs
+	s.mu.Unlock()
+
+	for _, ext := range s.registry.Extensions() {
+		if hook, ok := ext.(HandshakeHook); ok {
+			hook.OnHandshake(s)
+		}
+	}
+	return nil
+}
+
+// ParseExtendedHandshake decodes a bencoded extended handshake dictionary
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	data, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %v", err)
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	hs := &ExtendedHandshake{M: make(map[string]int), Dict: dict}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, v := range m {
+			if id, ok := v.(int64); ok && id > 0 {
+				hs.M[name] = int(id)
+			}
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		hs.V = v
+	}
+	if p, ok := dict["p"].(int64); ok && p > 0 && p < 65536 {
+		hs.P = int(p)
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		hs.Reqq = int(reqq)
+	}
+	if ip, ok := dict["yourip"].(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		hs.YourIP = net.IP(ip)
+	}
+	return hs, nil
+}
+
+// Names returns the extension names advertised by the remote peer
+func (hs *ExtendedHandshake) Names() []string {
+	names := make([]string, 0, len(hs.M))
+	for name := range hs.M {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,59 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// Message prefixes added by the Fast Extension (BEP 6). Each message is a
+// single line of the form PREFIX[:args].
+const (
+	MsgHaveAll     = "HAVE_ALL"
+	MsgHaveNone    = "HAVE_NONE"
+	MsgReject      = "REJECT"
+	MsgAllowedFast = "ALLOWED_FAST"
+	MsgSuggest     = "SUGGEST"
+	MsgChoke       = "CHOKE"
+	MsgUnchoke     = "UNCHOKE"
+	MsgPiece       = "PIECE"
+)
+
+// AllowedFastCount is the default size of the allowed fast set
+const AllowedFastCount = 10
+
+// AllowedFastSet computes the canonical allowed fast set for a peer as
+// described in BEP 6. Only IPv4 addresses are masked to their /24; other
+// addresses are hashed as-is.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces int, k int) []int {
+	if numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	var x []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		x = []byte{ip4[0], ip4[1], ip4[2], 0}
+	} else {
+		x = append([]byte{}, ip...)
+	}
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int(y % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Reserved holds the 8 reserved handshake bytes that peers use to announce
+// which protocol extensions they support.
+type Reserved [8]byte
+
+// SetFast marks the Fast Extension (BEP 6) as supported.
+func (r *Reserved) SetFast() {
+	r[7] |= 0x04
+}
+
+// SupportsFast reports whether the Fast Extension (BEP 6) bit is set.
+func (r Reserved) SupportsFast() bool {
+	return r[7]&0x04 != 0
+}
+
+// SetExtended marks the extension protocol (BEP 10) as supported.
+func (r *Reserved) SetExtended() {
+	r[5] |= 0x10
+}
+
+// SupportsExtended reports whether the extension protocol (BEP 10) bit is set.
+func (r Reserved) SupportsExtended() bool {
+	return r[5]&0x10 != 0
+}
+
+// Intersect returns the extensions supported by both sides.
+func (r Reserved) Intersect(other Reserved) Reserved {
+	var out Reserved
+	for i := range r {
+		out[i] = r[i] & other[i]
+	}
+	return out
+}
+
+// String encodes the reserved bytes as hex for the line protocol
+func (r Reserved) String() string {
+	return hex.EncodeToString(r[:])
+}
+
+// ParseReserved decodes reserved bytes sent as hex in a handshake
+func ParseReserved(s string) (Reserved, error) {
+	var r Reserved
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(r) {
+		return r, fmt.Errorf("invalid reserved bytes %q", s)
+	}
+	copy(r[:], b)
+	return r, nil
+}
+
+// LocalReserved returns the reserved bytes advertised by this implementation.
+func LocalReserved() Reserved {
+	var r Reserved
+	r.SetFast()
+	r.SetExtended()
+	return r
+}
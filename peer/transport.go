@@ -0,0 +1,256 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"tcp-app/utp"
+)
+
+// utpHeadStart is how long a uTP dial runs alone before TCP is tried
+// alongside it. Peers that speak uTP answer within a round trip or two.
+const utpHeadStart = 500 * time.Millisecond
+
+// DisableUTP makes Dial and Listen use TCP only
+var DisableUTP bool
+
+// utpSocket is the socket uTP connections are dialed from: the listening
+// socket once Listen has run, otherwise a dial-only socket shared by all
+// dials
+var (
+	utpMu     sync.Mutex
+	utpSocket *utp.Socket
+)
+
+// Listen accepts peer connections over both TCP and uTP on the same port.
+// If the UDP port is unavailable only TCP is used.
+func Listen(address string) (net.Listener, error) {
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if DisableUTP {
+		return tcpListener, nil
+	}
+
+	// Bind uTP to the port TCP actually got, which matters for ":0"
+	host, _, _ := net.SplitHostPort(address)
+	port := tcpListener.Addr().(*net.TCPAddr).Port
+	utpListener, err := utp.Listen(net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		fmt.Printf("uTP disabled on %s: %v\n", address, err)
+		return tcpListener, nil
+	}
+	// Dial from the listening socket so peers see our port. A dial-only
+	// socket it replaces stays open for the connections it carries.
+	utpMu.Lock()
+	utpSocket = utpListener
+	utpMu.Unlock()
+	return newDualListener(tcpListener, utpListener), nil
+}
+
+// dialSocket returns the socket to dial uTP connections from, opening the
+// dial-only socket on first use
+func dialSocket() (*utp.Socket, error) {
+	utpMu.Lock()
+	defer utpMu.Unlock()
+	if utpSocket == nil {
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		utpSocket = utp.NewSocket(pc)
+	}
+	return utpSocket, nil
+}
+
+// forgetSocket stops dialing from a socket that was closed
+func forgetSocket(ln net.Listener) {
+	utpMu.Lock()
+	defer utpMu.Unlock()
+	if utpSocket != nil && net.Listener(utpSocket) == ln {
+		utpSocket = nil
+	}
+}
+
+// Dial connects to a peer over uTP or TCP, whichever connects first. uTP
+// gets a head start of utpHeadStart, after which TCP is tried alongside
+// it. TCP is tried right away when the uTP dial fails, and a TCP failure
+// ends the dial since uTP had its chance by then.
+func Dial(address string, timeout time.Duration) (net.Conn, error) {
+	if DisableUTP {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	socket, err := dialSocket()
+	if err != nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	dialUTP := func(ctx context.Context) (net.Conn, error) {
+		return socket.DialContext(ctx, address)
+	}
+	dialTCP := func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	return dialRace(ctx, dialUTP, dialTCP, utpHeadStart)
+}
+
+// dialRace runs the dials of Dial. Connections of the dial that loses are
+// closed, and ctx is cancelled by the caller once it returns.
+func dialRace(ctx context.Context, dialUTP, dialTCP func(context.Context) (net.Conn, error), headStart time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+		tcp  bool
+	}
+	results := make(chan result, 2)
+	go func() {
+		conn, err := dialUTP(ctx)
+		results <- result{conn, err, false}
+	}()
+	pending, tcpStarted := 1, false
+	startTCP := func() {
+		tcpStarted = true
+		pending++
+		go func() {
+			conn, err := dialTCP(ctx)
+			results <- result{conn, err, true}
+		}()
+	}
+	// done returns the outcome. A dial still running fails once ctx is
+	// cancelled, unless it connected just before.
+	done := func(conn net.Conn, err error) (net.Conn, error) {
+		if pending > 0 {
+			go func() {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}()
+		}
+		return conn, err
+	}
+
+	timer := time.NewTimer(headStart)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if !tcpStarted {
+				startTCP()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil || r.tcp {
+				return done(r.conn, r.err)
+			}
+			if !tcpStarted {
+				startTCP()
+			}
+		}
+	}
+}
+
+// RemoteIP returns the IP of a TCP or UDP address, or nil
+func RemoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// dualListener merges connections accepted by several listeners
+type dualListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func newDualListener(listeners ...net.Listener) *dualListener {
+	l := &dualListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		closed:    make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go l.acceptLoop(ln)
+	}
+	return l
+}
+
+func (l *dualListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			l.errs <- err
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next connection from any transport
+func (l *dualListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes every underlying listener
+func (l *dualListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		for _, ln := range l.listeners {
+			forgetSocket(ln)
+			if e := ln.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the TCP address, which shares its port with uTP
+func (l *dualListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
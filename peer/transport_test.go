@@ -0,0 +1,103 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDial is a dial that answers after delay with a connection or err.
+// It counts its calls and the connections closed.
+type fakeDial struct {
+	name   string
+	delay  time.Duration
+	err    error
+	calls  atomic.Int32
+	closed atomic.Int32
+}
+
+type fakeConn struct {
+	net.Conn
+	dial *fakeDial
+	once sync.Once
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { c.dial.closed.Add(1) })
+	return c.Conn.Close()
+}
+
+func (d *fakeDial) dial(ctx context.Context) (net.Conn, error) {
+	d.calls.Add(1)
+	// A negative delay never answers before ctx is done
+	if d.delay < 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(d.delay)
+	if d.err != nil {
+		return nil, d.err
+	}
+	conn, _ := net.Pipe()
+	return &fakeConn{Conn: conn, dial: d}, nil
+}
+
+func TestDialRace(t *testing.T) {
+	const headStart = 20 * time.Millisecond
+	failed := errors.New("failed")
+	tests := []struct {
+		name     string
+		utp, tcp *fakeDial
+		winner   string
+		tcpCalls int32
+	}{
+		{"uTP answers within its head start", &fakeDial{delay: 0}, &fakeDial{delay: 0}, "utp", 0},
+		{"silent uTP falls back to TCP", &fakeDial{delay: -1}, &fakeDial{delay: 0}, "tcp", 1},
+		{"uTP failing at once starts TCP", &fakeDial{err: failed}, &fakeDial{delay: 0}, "tcp", 1},
+		// The head start ends while uTP is still trying; its failure must
+		// not start a second TCP dial
+		{"uTP failing after its head start", &fakeDial{delay: 3 * headStart, err: failed}, &fakeDial{delay: 5 * headStart}, "tcp", 1},
+		{"TCP wins and late uTP is closed", &fakeDial{delay: 3 * headStart}, &fakeDial{delay: 0}, "tcp", 1},
+		{"TCP failure ends the dial", &fakeDial{delay: -1}, &fakeDial{err: failed}, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.utp.name, tt.tcp.name = "utp", "tcp"
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			conn, err := dialRace(ctx, tt.utp.dial, tt.tcp.dial, headStart)
+			cancel()
+
+			winner := ""
+			if conn != nil {
+				winner = conn.(*fakeConn).dial.name
+			}
+			if winner != tt.winner {
+				t.Fatalf("winner %q (%v), want %q", winner, err, tt.winner)
+			}
+			if (err == nil) != (tt.winner != "") {
+				t.Errorf("error %v with winner %q", err, winner)
+			}
+			// Let dials that lost finish before counting
+			time.Sleep(10 * headStart)
+			if got := tt.tcp.calls.Load(); got != tt.tcpCalls {
+				t.Errorf("%d TCP dials, want %d", got, tt.tcpCalls)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			opened := int32(0)
+			for _, d := range []*fakeDial{tt.utp, tt.tcp} {
+				if d.err == nil && d.delay >= 0 {
+					opened += d.calls.Load()
+				}
+			}
+			if closed := tt.utp.closed.Load() + tt.tcp.closed.Load(); closed != opened {
+				t.Errorf("%d of %d connections closed", closed, opened)
+			}
+		})
+	}
+}
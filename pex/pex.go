@@ -0,0 +1,335 @@
+// Package pex implements the ut_pex peer exchange extension (BEP 11) on
+// top of the extension protocol in package peer.
+package pex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+
+	"tcp-app/peer"
+)
+
+// Name is the extension name used in the extended handshake
+const Name = "ut_pex"
+
+const (
+	// Interval is how often added/dropped lists are sent to each peer
+	Interval = time.Minute
+	// minReceiveInterval is the shortest gap accepted between two messages
+	// from the same peer; anything faster is dropped as spam
+	minReceiveInterval = 45 * time.Second
+	// maxPeersPerMessage caps the added and dropped lists of one message
+	maxPeersPerMessage = 50
+)
+
+// Peer flags carried in added.f and added6.f
+const (
+	FlagPrefersEncryption = 0x01
+	FlagSeed              = 0x02
+	FlagUTP               = 0x04
+	FlagHolepunch         = 0x08
+	FlagReachable         = 0x10
+)
+
+// Peer is a swarm member exchanged through PEX
+type Peer struct {
+	Addr  *net.TCPAddr
+	Flags byte
+}
+
+// Extension exchanges the peers of each torrent with every connected peer
+// that supports ut_pex. Sessions for private torrents are ignored.
+type Extension struct {
+	// OnPeers receives peers learned from remote peers
+	OnPeers func(infoHash [20]byte, peers []Peer)
+
+	mu       sync.Mutex
+	sessions map[*peer.Session]*sessionState
+	start    sync.Once
+}
+
+type sessionState struct {
+	sent         map[string]Peer
+	lastReceived time.Time
+}
+
+// New creates a PEX extension that reports received peers to onPeers
+func New(onPeers func(infoHash [20]byte, peers []Peer)) *Extension {
+	return &Extension{
+		OnPeers:  onPeers,
+		sessions: make(map[*peer.Session]*sessionState),
+	}
+}
+
+// Name implements peer.Extension
+func (e *Extension) Name() string {
+	return Name
+}
+
+// ExtendHandshake implements peer.HandshakeHook
+func (e *Extension) ExtendHandshake(s *peer.Session, hs map[string]interface{}) {
+	if s.Private {
+		// Do not advertise ut_pex at all for private torrents
+		if m, ok := hs["m"].(map[string]interface{}); ok {
+			delete(m, Name)
+		}
+	}
+}
+
+// OnHandshake implements peer.HandshakeHook
+func (e *Extension) OnHandshake(s *peer.Session) {
+	if s.Private || !s.Supports(Name) {
+		return
+	}
+	e.mu.Lock()
+	e.sessions[s] = &sessionState{sent: make(map[string]Peer)}
+	e.mu.Unlock()
+	e.start.Do(func() { go e.run() })
+}
+
+// OnClose implements peer.CloseHook
+func (e *Extension) OnClose(s *peer.Session) {
+	e.mu.Lock()
+	delete(e.sessions, s)
+	e.mu.Unlock()
+}
+
+// HandleMessage implements peer.Extension
+func (e *Extension) HandleMessage(s *peer.Session, payload []byte) error {
+	if s.Private {
+		return fmt.Errorf("pex message on private torrent")
+	}
+	e.mu.Lock()
+	state, ok := e.sessions[s]
+	if ok {
+		if !state.lastReceived.IsZero() && time.Since(state.lastReceived) < minReceiveInterval {
+			e.mu.Unlock()
+			return fmt.Errorf("pex message from %s too soon, dropped", s.RemoteAddr())
+		}
+		state.lastReceived = time.Now()
+	}
+	e.mu.Unlock()
+
+	msg, err := parseMessage(payload)
+	if err != nil {
+		return err
+	}
+	if len(msg.added) > 0 && e.OnPeers != nil {
+		e.OnPeers(s.InfoHash, msg.added)
+	}
+	return nil
+}
+
+// run periodically sends each session the peers added to and dropped from
+// its swarm since the previous message
+func (e *Extension) run() {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.broadcast()
+	}
+}
+
+// broadcast works out every session's message under e.mu and sends them
+// after releasing it, each on its own, so a peer whose connection stalls
+// holds up neither the others nor sessions coming and going
+func (e *Extension) broadcast() {
+	type outgoing struct {
+		session *peer.Session
+		payload []byte
+	}
+	var messages []outgoing
+
+	e.mu.Lock()
+	// Build the current member list of each swarm
+	swarms := make(map[[20]byte]map[string]Peer)
+	for s := range e.sessions {
+		p, ok := sessionPeer(s)
+		if !ok {
+			continue
+		}
+		if swarms[s.InfoHash] == nil {
+			swarms[s.InfoHash] = make(map[string]Peer)
+		}
+		swarms[s.InfoHash][p.Addr.String()] = p
+	}
+
+	for s, state := range e.sessions {
+		current := swarms[s.InfoHash]
+		self, _ := sessionPeer(s)
+
+		var added, dropped []Peer
+		for key, p := range current {
+			if self.Addr != nil && key == self.Addr.String() {
+				continue
+			}
+			if _, ok := state.sent[key]; !ok && len(added) < maxPeersPerMessage {
+				added = append(added, p)
+				state.sent[key] = p
+			}
+		}
+		for key, p := range state.sent {
+			if _, ok := current[key]; !ok && len(dropped) < maxPeersPerMessage {
+				dropped = append(dropped, p)
+				delete(state.sent, key)
+			}
+		}
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+		payload, err := encodeMessage(added, dropped)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, outgoing{s, payload})
+	}
+	e.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range messages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.session.Send(Name, m.payload); err != nil {
+				fmt.Printf("Error sending PEX to %s: %v\n", m.session.RemoteAddr(), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// sessionPeer returns the connectable address of the remote side of s,
+// which requires the listen port from its extended handshake
+func sessionPeer(s *peer.Session) (Peer, bool) {
+	remote := s.Remote()
+	ip := peer.RemoteIP(s.RemoteAddr())
+	if remote == nil || remote.P == 0 || ip == nil {
+		return Peer{}, false
+	}
+	flags := byte(FlagReachable)
+	if _, ok := s.RemoteAddr().(*net.UDPAddr); ok {
+		flags |= FlagUTP
+	}
+	return Peer{
+		Addr:  &net.TCPAddr{IP: ip, Port: remote.P},
+		Flags: flags,
+	}, true
+}
+
+type message struct {
+	added   []Peer
+	dropped []Peer
+}
+
+func encodeMessage(added, dropped []Peer) ([]byte, error) {
+	var added4, added6, flags4, flags6, dropped4, dropped6 []byte
+	for _, p := range added {
+		if ip4 := p.Addr.IP.To4(); ip4 != nil {
+			added4 = appendCompact(added4, ip4, p.Addr.Port)
+			flags4 = append(flags4, p.Flags)
+		} else {
+			added6 = appendCompact(added6, p.Addr.IP.To16(), p.Addr.Port)
+			flags6 = append(flags6, p.Flags)
+		}
+	}
+	for _, p := range dropped {
+		if ip4 := p.Addr.IP.To4(); ip4 != nil {
+			dropped4 = appendCompact(dropped4, ip4, p.Addr.Port)
+		} else {
+			dropped6 = appendCompact(dropped6, p.Addr.IP.To16(), p.Addr.Port)
+		}
+	}
+
+	dict := map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(flags4),
+		"added6":   string(added6),
+		"added6.f": string(flags6),
+		"dropped":  string(dropped4),
+		"dropped6": string(dropped6),
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, dict); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseMessage(payload []byte) (*message, error) {
+	data, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pex message: %v", err)
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pex message is not a dictionary")
+	}
+
+	msg := &message{}
+	str := func(key string) string {
+		s, _ := dict[key].(string)
+		return s
+	}
+	added4, err := parseCompact(str("added"), str("added.f"), net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	added6, err := parseCompact(str("added6"), str("added6.f"), net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	dropped4, err := parseCompact(str("dropped"), "", net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	dropped6, err := parseCompact(str("dropped6"), "", net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	msg.added = append(added4, added6...)
+	msg.dropped = append(dropped4, dropped6...)
+	if len(msg.added) > maxPeersPerMessage || len(msg.dropped) > maxPeersPerMessage {
+		return nil, fmt.Errorf("pex message lists too many peers")
+	}
+	return msg, nil
+}
+
+func appendCompact(buf []byte, ip net.IP, port int) []byte {
+	buf = append(buf, ip...)
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// parseCompact decodes a compact peer list with optional per-peer flags.
+// Entries with a zero port or an unspecified address are skipped.
+func parseCompact(list, flags string, ipLen int) ([]Peer, error) {
+	entryLen := ipLen + 2
+	if len(list)%entryLen != 0 {
+		return nil, fmt.Errorf("malformed compact peer list of length %d", len(list))
+	}
+	count := len(list) / entryLen
+	if flags != "" && len(flags) != count {
+		return nil, fmt.Errorf("pex flags length %d does not match %d peers", len(flags), count)
+	}
+
+	var peers []Peer
+	for i := 0; i < count; i++ {
+		entry := list[i*entryLen : (i+1)*entryLen]
+		ip := net.IP([]byte(entry[:ipLen]))
+		port := int(binary.BigEndian.Uint16([]byte(entry[ipLen:])))
+		if port == 0 || ip.IsUnspecified() || ip.IsMulticast() {
+			continue
+		}
+		p := Peer{Addr: &net.TCPAddr{IP: ip, Port: port}}
+		if flags != "" {
+			p.Flags = flags[i]
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
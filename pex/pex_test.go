@@ -0,0 +1,183 @@
+package pex
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+
+	"tcp-app/peer"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		added, dropped []Peer
+	}{
+		{"empty", nil, nil},
+		{"IPv4 with flags", []Peer{
+			{tcpAddr("10.0.0.1:6881"), FlagSeed | FlagReachable},
+			{tcpAddr("192.0.2.7:51413"), FlagUTP},
+		}, nil},
+		{"IPv6 and dropped", []Peer{
+			{tcpAddr("[2001:db8::1]:6881"), FlagPrefersEncryption},
+		}, []Peer{
+			{tcpAddr("10.0.0.2:6882"), 0},
+			{tcpAddr("[2001:db8::2]:6883"), 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := encodeMessage(tt.added, tt.dropped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := parseMessage(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := peerList(msg.added, true), peerList(tt.added, true); got != want {
+				t.Errorf("added %s, want %s", got, want)
+			}
+			if got, want := peerList(msg.dropped, false), peerList(tt.dropped, false); got != want {
+				t.Errorf("dropped %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// peerList formats peers for comparison, IPv4 before IPv6 as encoded
+func peerList(peers []Peer, flags bool) string {
+	var v4, v6 []string
+	for _, p := range peers {
+		s := p.Addr.String()
+		if flags {
+			s += "/" + string('0'+rune(p.Flags>>4)) + string('0'+rune(p.Flags&0xf))
+		}
+		if p.Addr.IP.To4() != nil {
+			v4 = append(v4, s)
+		} else {
+			v6 = append(v6, s)
+		}
+	}
+	return strings.Join(append(v4, v6...), " ")
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		dict map[string]interface{}
+	}{
+		{"truncated entry", map[string]interface{}{"added": "\x0a\x00\x00\x01\x1a"}},
+		{"flags do not match", map[string]interface{}{"added": "\x0a\x00\x00\x01\x1a\xe1", "added.f": "\x01\x02"}},
+		{"too many peers", map[string]interface{}{"added": strings.Repeat("\x0a\x00\x00\x01\x1a\xe1", maxPeersPerMessage+1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := bencode.Marshal(&buf, tt.dict); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseMessage(buf.Bytes()); err == nil {
+				t.Error("malformed message accepted")
+			}
+		})
+	}
+	if _, err := parseMessage([]byte("not bencode")); err == nil {
+		t.Error("garbage accepted")
+	}
+
+	// Unusable entries are skipped rather than rejected
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, map[string]interface{}{"added": "\x00\x00\x00\x00\x1a\xe1\x0a\x00\x00\x01\x00\x00"})
+	if msg, err := parseMessage(buf.Bytes()); err != nil || len(msg.added) != 0 {
+		t.Errorf("got %v, %v for unusable entries", msg, err)
+	}
+}
+
+// testConn is the connection of a session. Writes block while block is
+// open and are recorded in writes.
+type testConn struct {
+	addr   net.Addr
+	block  chan struct{}
+	writes chan []byte
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *testConn) WriteExtended(id int, payload []byte) error {
+	if c.block != nil {
+		<-c.block
+	}
+	c.writes <- payload
+	return nil
+}
+
+// newSession registers a session for infoHash whose remote listens on port
+func newSession(t *testing.T, registry *peer.Registry, conn *testConn, infoHash [20]byte, port int) *peer.Session {
+	t.Helper()
+	s := registry.NewSession(conn, infoHash)
+	var hs bytes.Buffer
+	bencode.Marshal(&hs, map[string]interface{}{"m": map[string]interface{}{Name: 1}, "p": port})
+	if err := s.HandleMessage(0, hs.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBroadcastDoesNotWaitForStalledPeers(t *testing.T) {
+	e := New(nil)
+	registry := peer.NewRegistry()
+	if err := registry.Register(e); err != nil {
+		t.Fatal(err)
+	}
+	infoHash := [20]byte{1}
+	stalled := &testConn{addr: tcpAddr("10.0.0.1:40000"), block: make(chan struct{}), writes: make(chan []byte, 1)}
+	healthy := &testConn{addr: tcpAddr("10.0.0.2:40000"), writes: make(chan []byte, 1)}
+	stalledSession := newSession(t, registry, stalled, infoHash, 6881)
+	newSession(t, registry, healthy, infoHash, 6882)
+
+	done := make(chan struct{})
+	go func() {
+		e.broadcast()
+		close(done)
+	}()
+
+	// The healthy peer hears about the stalled one right away
+	select {
+	case payload := <-healthy.writes:
+		msg, err := parseMessage(payload)
+		if err != nil || len(msg.added) != 1 || msg.added[0].Addr.String() != "10.0.0.1:6881" {
+			t.Errorf("healthy peer got %v, %v", msg, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled peer held up the others")
+	}
+
+	// Sessions can still come and go while the write is stuck
+	closed := make(chan struct{})
+	go func() {
+		stalledSession.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing a session waited for a stalled write")
+	}
+
+	close(stalled.block)
+	<-stalled.writes
+	<-done
+}
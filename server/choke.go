@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+
+	"tcp-app/peer"
+)
+
+// maxUnchokedPeers is the number of upload slots shared by all fast peers
+const maxUnchokedPeers = 4
+
+var (
+	slotsMu  sync.Mutex
+	unchoked = make(map[*peerConn]bool)
+	waiting  []*peerConn
+)
+
+// acquireSlot unchokes pc if an upload slot is free; otherwise pc is queued
+// and unchoked once another peer disconnects.
+func acquireSlot(pc *peerConn) bool {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	if len(unchoked) < maxUnchokedPeers {
+		unchoked[pc] = true
+		return true
+	}
+	waiting = append(waiting, pc)
+	return false
+}
+
+// releaseSlot frees the slot held by pc and hands it to the next waiting peer
+func releaseSlot(pc *peerConn) {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	for i, w := range waiting {
+		if w == pc {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if !unchoked[pc] {
+		return
+	}
+	delete(unchoked, pc)
+	if len(waiting) == 0 {
+		return
+	}
+	next := waiting[0]
+	waiting = waiting[1:]
+	unchoked[next] = true
+	next.send(peer.MsgUnchoke)
+}
+
+// isChoked reports whether pc is currently choked
+func isChoked(pc *peerConn) bool {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	return !unchoked[pc]
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+
+	"tcp-app/mse"
+)
+
+// encryptionPolicy decides whether accepted connections must, may or must
+// not use Message Stream Encryption
+var encryptionPolicy = mse.PolicyPrefer
+
+// SetEncryptionPolicy sets the encryption policy for accepted connections
+func SetEncryptionPolicy(policy mse.Policy) {
+	encryptionPolicy = policy
+}
+
+func acceptEncrypted(conn net.Conn) (net.Conn, error) {
+	return mse.Accept(conn, encryptionPolicy, seededInfoHashes)
+}
+
+// seededInfoHashes returns every info hash the server can serve. They are
+// the candidate SKEYs for encrypted handshakes.
+func seededInfoHashes() [][20]byte {
+	seen := make(map[string]bool)
+	workersMu.Lock()
+	for infoHash := range connectionWorkers {
+		seen[infoHash] = true
+	}
+	workersMu.Unlock()
+
+	for _, e := range seedEntries() {
+		seen[e.infoHash] = true
+	}
+
+	var hashes [][20]byte
+	for infoHash := range seen {
+		b, err := hex.DecodeString(infoHash)
+		if err != nil || len(b) != 20 {
+			continue
+		}
+		var h [20]byte
+		copy(h[:], b)
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"tcp-app/peer"
+)
+
+// maxExtendedPayload bounds the size of a single extended message
+const maxExtendedPayload = 1 << 20
+
+// extensions holds the extension protocol handlers offered to peers
+var extensions = peer.NewRegistry()
+
+// listenPort is advertised to peers in the extended handshake and to
+// trackers. StartServer sets it while announce goroutines read it.
+var listenPort atomic.Int32
+
+// RegisterExtension adds an extension protocol (BEP 10) handler to every
+// connection accepted by the server.
+func RegisterExtension(ext peer.Extension) error {
+	return extensions.Register(ext)
+}
+
+func init() {
+	registerHandler(peer.MsgExtended, handleExtendedMessage)
+}
+
+// RemoteAddr returns the address of the peer
+func (pc *peerConn) RemoteAddr() net.Addr {
+	return pc.conn.RemoteAddr()
+}
+
+// WriteExtended sends an extended message to the peer
+func (pc *peerConn) WriteExtended(id int, payload []byte) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	if _, err := fmt.Fprintf(pc.conn, "%s:%d:%d\n", peer.MsgExtended, id, len(payload)); err != nil {
+		return err
+	}
+	_, err := pc.conn.Write(payload)
+	return err
+}
+
+// startExtendedSession creates the extension state for a handshaken peer
+// and sends our extended handshake
+func startExtendedSession(pc *peerConn) {
+	var infoHash [20]byte
+	if b, err := hex.DecodeString(pc.infoHash); err == nil && len(b) == len(infoHash) {
+		copy(infoHash[:], b)
+	}
+	pc.session = extensions.NewSession(pc, infoHash)
+	pc.session.ListenPort = int(listenPort.Load())
+	pc.session.Private = pc.private
+	if err := pc.session.SendHandshake(); err != nil {
+		fmt.Printf("Error sending extended handshake: %v\n", err)
+	}
+}
+
+func handleExtendedMessage(pc *peerConn, message string) error {
+	fields := strings.Split(message, ":")
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed extended message: %s", message)
+	}
+	id, err1 := strconv.Atoi(fields[1])
+	length, err2 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil || length < 0 || length > maxExtendedPayload {
+		return fmt.Errorf("malformed extended message: %s", message)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(pc.reader, payload); err != nil {
+		return fmt.Errorf("error reading extended payload: %v", err)
+	}
+
+	if pc.session == nil {
+		pc.send("ERROR: Extension protocol not negotiated")
+		return nil
+	}
+	if err := pc.session.HandleMessage(id, payload); err != nil {
+		fmt.Printf("Error handling extended message %d: %v\n", id, err)
+	}
+	return nil
+}
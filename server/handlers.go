@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// messageHandler processes a single line-protocol message from a peer.
+// Returning an error closes the connection.
+type messageHandler func(pc *peerConn, message string) error
+
+// messageHandlers maps message names, the text before the first ':', to
+// their handlers. New messages are added here rather than in the read loop.
+var messageHandlers = map[string]messageHandler{}
+
+func registerHandler(name string, handler messageHandler) {
+	messageHandlers[name] = handler
+}
+
+func init() {
+	registerHandler("test", handleTestMessage)
+	registerHandler("HANDSHAKE", handleHandshakeMessage)
+	registerHandler("Requesting", handleRequestMessage)
+}
+
+func handleTestMessage(pc *peerConn, message string) error {
+	fmt.Printf("Received test message: %s\n", message)
+	pc.send("OK")
+	return nil
+}
+
+func handleHandshakeMessage(pc *peerConn, message string) error {
+	if _, worker := handleHandshake(pc, message); worker == nil {
+		return fmt.Errorf("handshake failed")
+	}
+	return nil
+}
+
+func handleRequestMessage(pc *peerConn, message string) error {
+	parts := strings.Split(message, ":")
+	if len(parts) < 2 {
+		pc.send("ERROR: Invalid request format")
+		return nil
+	}
+	// Serve from the worker this connection holds, which stays open even
+	// if the torrent is unseeded meanwhile
+	worker := pc.worker
+	if worker == nil || pc.infoHash != parts[1] {
+		pc.send("ERROR: Handshake required")
+		return nil
+	}
+	fmt.Printf("Received piece request: %s\n", message)
+	return handlePieceRequest(pc, message, worker)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"sync"
+
+	"tcp-app/lsd"
+)
+
+var (
+	lsdMu      sync.Mutex
+	lsdService *lsd.Service
+)
+
+// SetLSD makes the server announce every seeded public torrent on the LAN
+// through svc. Nil stops the announcements.
+func SetLSD(svc *lsd.Service) {
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+	lsdService = svc
+	if svc == nil {
+		return
+	}
+	for _, e := range seedEntries() {
+		svc.Add(e.tf.InfoHash, e.private)
+	}
+}
+
+// announceLocal starts announcing a seeded torrent on the LAN
+func announceLocal(infoHash [20]byte, private bool) {
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+	if lsdService != nil {
+		lsdService.Add(infoHash, private)
+	}
+}
+
+// stopLocal stops announcing a torrent that is no longer seeded
+func stopLocal(infoHash [20]byte) {
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+	if lsdService != nil {
+		lsdService.Remove(infoHash)
+	}
+}
@@ -0,0 +1,8 @@
+package server
+
+import "tcp-app/pex"
+
+func init() {
+	// The server only seeds, so peers it learns are not used
+	RegisterExtension(pex.New(nil))
+}
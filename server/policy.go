@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// SeedPolicy decides when a torrent has been seeded enough. Limits that
+// are zero are not checked.
+type SeedPolicy struct {
+	// Ratio is the share ratio to reach, see SeedStats.Ratio
+	Ratio float64
+	// SeedTime is how long to seed in total
+	SeedTime time.Duration
+	// IdleTime is how long to keep seeding without uploading anything
+	IdleTime time.Duration
+}
+
+// SeedStats is what a seed policy is checked against
+type SeedStats struct {
+	Uploaded   int64
+	Downloaded int64
+	// Size is the torrent's total size
+	Size int64
+	// Seeding is the total time seeded, Idle the time since the last
+	// upload or since seeding started, whichever is later
+	Seeding time.Duration
+	Idle    time.Duration
+}
+
+// IsZero reports whether the policy has no limits, so seeding never stops
+func (p SeedPolicy) IsZero() bool {
+	return p.Ratio <= 0 && p.SeedTime <= 0 && p.IdleTime <= 0
+}
+
+// Reached returns why the policy says to stop seeding, or "" to go on
+func (p SeedPolicy) Reached(s SeedStats) string {
+	switch {
+	case p.Ratio > 0 && s.Ratio() >= p.Ratio:
+		return fmt.Sprintf("share ratio %.2f reached", s.Ratio())
+	case p.SeedTime > 0 && s.Seeding >= p.SeedTime:
+		return fmt.Sprintf("seeded for %v", p.SeedTime)
+	case p.IdleTime > 0 && s.Idle >= p.IdleTime:
+		return fmt.Sprintf("nothing uploaded for %v", p.IdleTime)
+	}
+	return ""
+}
+
+// Ratio is the bytes uploaded over the bytes downloaded. Torrents that
+// were not downloaded by this client, such as the ones it created, count
+// their size as downloaded instead.
+func (s SeedStats) Ratio() float64 {
+	base := s.Downloaded
+	if base == 0 {
+		base = s.Size
+	}
+	if base == 0 {
+		return 0
+	}
+	return float64(s.Uploaded) / float64(base)
+}
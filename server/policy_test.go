@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedPolicyReached(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  SeedPolicy
+		stats   SeedStats
+		reached bool
+	}{
+		{"no limits", SeedPolicy{}, SeedStats{Uploaded: 100, Downloaded: 1, Seeding: time.Hour, Idle: time.Hour}, false},
+		{"ratio below", SeedPolicy{Ratio: 2}, SeedStats{Uploaded: 150, Downloaded: 100}, false},
+		{"ratio reached", SeedPolicy{Ratio: 2}, SeedStats{Uploaded: 200, Downloaded: 100}, true},
+		{"ratio of a created torrent", SeedPolicy{Ratio: 1}, SeedStats{Uploaded: 100, Size: 100}, true},
+		{"ratio of an empty torrent", SeedPolicy{Ratio: 1}, SeedStats{Uploaded: 100}, false},
+		{"seed time below", SeedPolicy{SeedTime: time.Hour}, SeedStats{Seeding: time.Minute}, false},
+		{"seed time reached", SeedPolicy{SeedTime: time.Hour}, SeedStats{Seeding: time.Hour}, true},
+		{"idle below", SeedPolicy{IdleTime: time.Hour}, SeedStats{Idle: time.Minute}, false},
+		{"idle reached", SeedPolicy{IdleTime: time.Hour}, SeedStats{Idle: 2 * time.Hour}, true},
+		{"any limit counts", SeedPolicy{Ratio: 10, SeedTime: time.Hour}, SeedStats{Downloaded: 100, Seeding: time.Hour}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.policy.Reached(tt.stats)
+			if (reason != "") != tt.reached {
+				t.Errorf("Reached = %q, want reached %v", reason, tt.reached)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"tcp-app/ratelimit"
+	"tcp-app/torrent"
+	"tcp-app/tracker"
+)
+
+// seedEntry is a torrent the server can serve
+type seedEntry struct {
+	infoHash string
+	name     string
+	filePath string
+	private  bool
+	tf       torrent.TorrentFile
+}
+
+// Torrents registered with Seed, keyed by hex info hash
+var (
+	seedsMu sync.Mutex
+	seeds   = make(map[string]seedEntry)
+)
+
+// uploadLimiter throttles piece data sent to peers; nil means unlimited
+var uploadLimiter *ratelimit.Limiter
+
+// SetUploadLimit limits the piece data sent to all peers together to
+// bytesPerSecond. Zero removes the limit.
+func SetUploadLimit(bytesPerSecond int64) {
+	uploadLimiter = ratelimit.New(bytesPerSecond)
+}
+
+// peerID identifies the server to trackers
+var peerID = tracker.NewPeerID()
+
+// Seed serves the data at dataPath for the torrent at torrentPath. An empty
+// dataPath means the torrent's name in the working directory. The torrent
+// is announced to its trackers while the server listens, and on the LAN
+// when local service discovery is on.
+func Seed(torrentPath, dataPath string) (torrent.TorrentFile, error) {
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		return tf, fmt.Errorf("error opening torrent file: %v", err)
+	}
+	if dataPath == "" {
+		dataPath = tf.Name
+	}
+	if _, err := os.Stat(dataPath); err != nil {
+		return tf, fmt.Errorf("error opening seeded data: %v", err)
+	}
+
+	infoHash := tf.InfoHashHex()
+	seedsMu.Lock()
+	_, known := seeds[infoHash]
+	seeds[infoHash] = seedEntry{
+		infoHash: infoHash,
+		name:     tf.Name,
+		filePath: dataPath,
+		private:  tf.Private,
+		tf:       tf,
+	}
+	seedsMu.Unlock()
+
+	// A worker built for other data must not keep serving the old files
+	removeWorker(infoHash)
+
+	fmt.Printf("Seeding %s (%s) from %s\n", tf.Name, infoHash, dataPath)
+	announceLocal(tf.InfoHash, tf.Private)
+	if !known {
+		go announceSeed(&tf)
+	}
+	return tf, nil
+}
+
+// Unseed stops serving a torrent registered with Seed. Peers already
+// connected keep their worker until they disconnect, after which its
+// storage is closed.
+func Unseed(infoHash [20]byte) {
+	key := hex.EncodeToString(infoHash[:])
+	seedsMu.Lock()
+	delete(seeds, key)
+	seedsMu.Unlock()
+	stopLocal(infoHash)
+	removeWorker(key)
+}
+
+// seedEntries returns the registered torrents
+func seedEntries() []seedEntry {
+	seedsMu.Lock()
+	defer seedsMu.Unlock()
+	entries := make([]seedEntry, 0, len(seeds))
+	for _, e := range seeds {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// findSeed looks up a seeded torrent by hex info hash
+func findSeed(infoHash string) (seedEntry, bool) {
+	seedsMu.Lock()
+	defer seedsMu.Unlock()
+	e, ok := seeds[infoHash]
+	return e, ok
+}
+
+// announceSeed tells the torrent's trackers about the server until the
+// torrent is no longer seeded. Announces wait until the server listens,
+// since trackers need the port.
+func announceSeed(tf *torrent.TorrentFile) {
+	trackers := tf.Trackers()
+	if len(trackers) == 0 {
+		return
+	}
+	event := tracker.EventStarted
+	for {
+		seedsMu.Lock()
+		_, seeded := seeds[tf.InfoHashHex()]
+		seedsMu.Unlock()
+		if !seeded {
+			return
+		}
+		interval := tracker.DefaultInterval
+		if listenPort.Load() > 0 {
+			for _, url := range trackers {
+				resp, err := announce(url, tf, event)
+				if err != nil {
+					fmt.Printf("Announce to %s failed: %v\n", url, err)
+					continue
+				}
+				interval = min(interval, resp.Interval)
+			}
+			event = ""
+		} else {
+			interval = time.Second
+		}
+		time.Sleep(interval)
+	}
+}
+
+func announce(trackerURL string, tf *torrent.TorrentFile, event string) (*tracker.AnnounceResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req := tracker.AnnounceRequest{
+		InfoHash: tf.InfoHash,
+		PeerID:   peerID,
+		Port:     int(listenPort.Load()),
+		Uploaded: Uploaded(tf.InfoHash),
+		Event:    event,
+	}
+	if creds := tlsCredentials; creds != nil {
+		return tracker.Announce(ctx, trackerURL, req, creds.ClientConfig())
+	}
+	return tracker.Announce(ctx, trackerURL, req, nil)
+}
@@ -4,64 +4,137 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"encoding/binary"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
 	"net"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+
+	"tcp-app/peer"
+	"tcp-app/storage"
 	"tcp-app/torrent"
 )
 
-type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
-}
-
 // FileWorker handles the file pieces for a specific torrent
 type FileWorker struct {
-	filePath    string
-	pieces      [][]byte
-	numPieces   int
-	pieceHashes [][20]byte
+	filePath  string
+	store     storage.Storage
+	layout    storage.Layout
+	numPieces int
+
+	// recent holds the most recently served piece indices, newest first.
+	// They are suggested to new fast peers since they are hot in the cache.
+	recentMu sync.Mutex
+	recent   []int
+
+	// refs counts the connections using the worker, and retired is set
+	// once it was replaced or unseeded; the storage is closed when both
+	// say it is unused. Guarded by workersMu.
+	refs    int
+	retired bool
 }
 
-// NewFileWorker creates and initializes a new FileWorker
-func NewFileWorker(filePath string) (*FileWorker, error) {
-	t := &TorrentFile{
-		PieceLength: 256 * 1024, // 256KB pieces
+// maxSuggestedPieces bounds the number of SUGGEST messages sent per peer
+const maxSuggestedPieces = 4
+
+// touch records that a piece was just served
+func (w *FileWorker) touch(index int) {
+	w.recentMu.Lock()
+	defer w.recentMu.Unlock()
+	for i, r := range w.recent {
+		if r == index {
+			w.recent = append(w.recent[:i], w.recent[i+1:]...)
+			break
+		}
 	}
-	// Get pieces using the StreamFilePieces function
-	pieces, err := torrent.StreamFilePieces(filePath, t.PieceLength)
+	w.recent = append([]int{index}, w.recent...)
+	if len(w.recent) > maxSuggestedPieces {
+		w.recent = w.recent[:maxSuggestedPieces]
+	}
+}
+
+// suggestions returns the pieces worth suggesting to a newly connected peer
+func (w *FileWorker) suggestions() []int {
+	w.recentMu.Lock()
+	defer w.recentMu.Unlock()
+	return append([]int(nil), w.recent...)
+}
+
+// NewFileWorker creates and initializes a new FileWorker serving the data
+// at filePath, laid out as described by tf
+func NewFileWorker(filePath string, tf *torrent.TorrentFile) (*FileWorker, error) {
+	layout := tf.StorageLayout(filePath)
+	store, err := openStorage(layout, tf.InfoHash)
 	if err != nil {
-		return nil, fmt.Errorf("error streaming file pieces: %v", err)
+		return nil, fmt.Errorf("error opening storage: %v", err)
+	}
+	w := &FileWorker{
+		filePath:  filePath,
+		store:     store,
+		layout:    layout,
+		numPieces: layout.NumPieces(),
 	}
+	w.verify(tf)
+	return w, nil
+}
 
-	// Calculate piece hashes
-	pieceHashes := make([][20]byte, len(pieces))
-	for i, piece := range pieces {
-		pieceHashes[i] = sha1.Sum(piece)
+// verify hashes the pieces the completion database does not vouch for.
+// Without piece hashes the data is trusted as before.
+func (w *FileWorker) verify(tf *torrent.TorrentFile) {
+	checked, valid := 0, 0
+	for i := 0; i < w.numPieces; i++ {
+		if w.store.Completed(i) {
+			continue
+		}
+		if i >= len(tf.PieceHashes) {
+			w.store.MarkComplete(i)
+			continue
+		}
+		checked++
+		data, err := w.readPiece(i)
+		if err != nil || sha1.Sum(data) != tf.PieceHashes[i] {
+			continue
+		}
+		if err := w.store.MarkComplete(i); err != nil {
+			fmt.Printf("Error recording piece %d: %v\n", i, err)
+		}
+		valid++
 	}
+	if checked > 0 {
+		fmt.Printf("Verified %s: %d of %d checked pieces are valid\n", w.filePath, valid, checked)
+	}
+}
+
+// complete reports whether every piece is available
+func (w *FileWorker) complete() bool {
+	for i := 0; i < w.numPieces; i++ {
+		if !w.store.Completed(i) {
+			return false
+		}
+	}
+	return w.numPieces > 0
+}
 
-	return &FileWorker{
-		filePath:    filePath,
-		pieces:      pieces,
-		numPieces:   len(pieces),
-		pieceHashes: pieceHashes,
-	}, nil
+// readPiece reads a whole piece from storage
+func (w *FileWorker) readPiece(index int) ([]byte, error) {
+	data := make([]byte, w.layout.PieceSize(index))
+	if _, err := w.store.ReadAt(index, data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 // StartServer initializes the server to handle peer requests.
 func StartServer(address string) error {
-	listener, err := net.Listen("tcp", address)
+	listener, err := peer.Listen(address)
 	if err != nil {
 		return fmt.Errorf("error starting TCP server: %v", err)
 	}
 	defer listener.Close()
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		listenPort.Store(int32(addr.Port))
+	}
 
 	fmt.Printf("Server listening on %s...\n", address)
 
@@ -77,18 +150,160 @@ func StartServer(address string) error {
 	}
 }
 
-// Global map to store workers associated with info hashes
-var connectionWorkers = make(map[string]*FileWorker)
+// Global map to store workers associated with info hashes, and the
+// workers still being built by a first handshake
+var (
+	workersMu         sync.Mutex
+	connectionWorkers = make(map[string]*FileWorker)
+	pendingWorkers    = make(map[string]*workerBuild)
+)
+
+// workerBuild lets handshakes for a torrent wait for the one building its
+// worker. stale is set if the torrent was unseeded meanwhile.
+type workerBuild struct {
+	done  chan struct{}
+	stale bool
+}
+
+// acquireWorker returns the worker of a seeded torrent, building it if no
+// connection uses it yet. Concurrent handshakes for one torrent share a
+// single build. The caller must release the worker with releaseWorker.
+func acquireWorker(seed seedEntry) (*FileWorker, error) {
+	workersMu.Lock()
+	for {
+		if w := connectionWorkers[seed.infoHash]; w != nil {
+			w.refs++
+			workersMu.Unlock()
+			return w, nil
+		}
+		build := pendingWorkers[seed.infoHash]
+		if build == nil {
+			break
+		}
+		workersMu.Unlock()
+		<-build.done
+		workersMu.Lock()
+	}
+	build := &workerBuild{done: make(chan struct{})}
+	pendingWorkers[seed.infoHash] = build
+	workersMu.Unlock()
+
+	w, err := NewFileWorker(seed.filePath, &seed.tf)
+
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	delete(pendingWorkers, seed.infoHash)
+	close(build.done)
+	if err != nil {
+		return nil, err
+	}
+	w.refs = 1
+	// A worker for data that is no longer seeded only serves this peer
+	w.retired = build.stale
+	if !w.retired {
+		connectionWorkers[seed.infoHash] = w
+	}
+	return w, nil
+}
+
+// releaseWorker gives up a connection's use of a worker, closing its
+// storage if it was the last user of a retired worker
+func releaseWorker(w *FileWorker) {
+	workersMu.Lock()
+	w.refs--
+	unused := w.retired && w.refs == 0
+	workersMu.Unlock()
+	if unused {
+		w.store.Close()
+	}
+}
+
+// removeWorker stops handing out the worker of a torrent. Connected peers
+// keep using it until they disconnect, and its storage is closed after
+// the last one.
+func removeWorker(infoHash string) {
+	workersMu.Lock()
+	if build := pendingWorkers[infoHash]; build != nil {
+		build.stale = true
+	}
+	w := connectionWorkers[infoHash]
+	delete(connectionWorkers, infoHash)
+	unused := false
+	if w != nil {
+		w.retired = true
+		unused = w.refs == 0
+	}
+	workersMu.Unlock()
+	if unused {
+		w.store.Close()
+	}
+}
+
+// peerConn holds the per-connection state negotiated during the handshake
+type peerConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	reader  *bufio.Reader
+	session *peer.Session
+	// identity is the certificate identity of the peer in TLS mode
+	identity string
+
+	reserved    peer.Reserved
+	infoHash    string
+	private     bool
+	worker      *FileWorker
+	allowedFast map[int]bool
+}
+
+// send writes a single protocol line to the peer
+func (pc *peerConn) send(format string, args ...interface{}) {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	fmt.Fprintf(pc.conn, format+"\n", args...)
+}
+
+// sendPiece writes a header followed by the raw piece data
+func (pc *peerConn) sendPiece(header, data []byte) error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	if _, err := pc.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := pc.conn.Write(data)
+	return err
+}
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	// Negotiate TLS or stream encryption before any protocol message
+	conn, identity, err := secureConn(conn)
+	if err != nil {
+		fmt.Printf("Securing connection failed: %v\n", err)
+		return
+	}
+	if identity != "" {
+		fmt.Printf("Authenticated peer %s\n", identity)
+	}
+
 	// Create a buffered reader to process incoming data
-	reader := bufio.NewReader(conn)
+	pc := &peerConn{conn: conn, reader: bufio.NewReader(conn), identity: identity}
+	defer releaseSlot(pc)
+	defer func() {
+		if pc.worker != nil {
+			releaseWorker(pc.worker)
+		}
+	}()
+	defer func() {
+		if pc.session != nil {
+			pc.session.Close()
+		}
+	}()
 
 	for {
 		// Read client request
-		message, err := reader.ReadString('\n')
+		message, err := pc.reader.ReadString('\n')
 		if err != nil {
 			fmt.Printf("Error reading from connection: %v\n", err)
 			return
@@ -96,90 +311,168 @@ func handleConnection(conn net.Conn) {
 		message = strings.TrimSpace(message)
 		fmt.Printf("Received message: %s\n", message)
 
-		// Process the message based on its type
-		switch {
-		case strings.HasPrefix(message, "test:"):
-			fmt.Printf("Received test message: %s\n", message)
-			conn.Write([]byte("OK\n"))
-		case strings.HasPrefix(message, "HANDSHAKE:"):
-			infoHash, worker := handleHandshake(conn, message)
-			if worker == nil {
-				return
-			}
-			// Store the worker in the global map using info hash
-			connectionWorkers[infoHash] = worker
-
-		case strings.HasPrefix(message, "Requesting"):
-			parts := strings.Split(message, ":")
-			infoHash := parts[1]
-			worker, exists := connectionWorkers[infoHash]
-			if !exists || worker == nil {
-				conn.Write([]byte("ERROR: Handshake required\n"))
-				continue
-			}
-			fmt.Printf("Received piece request: %s\n", message)
-			handlePieceRequest(conn, message, worker)
-
-		default:
+		// Dispatch the message on the text before the first ':'
+		name, _, _ := strings.Cut(message, ":")
+		handler, ok := messageHandlers[name]
+		if !ok {
 			fmt.Printf("Unknown message: %s\n", message)
 			conn.Write([]byte("ERROR: Unknown message\n"))
+			continue
+		}
+		if err := handler(pc, message); err != nil {
+			fmt.Printf("Closing connection to %s: %v\n", conn.RemoteAddr(), err)
+			return
 		}
 	}
 }
 
-func handleHandshake(conn net.Conn, message string) (string, *FileWorker) {
-	// Get the info hash from the message
-	infoHashMessage := strings.TrimPrefix(message, "HANDSHAKE:")
-	// Check if the info hash is in the torrent_info.json file
-	torrentInfo, err := os.ReadFile("torrent_info.json")
-	if err != nil {
-		fmt.Printf("Error reading torrent_info.json: %v\n", err)
-		return "", nil
-	}
-	var torrentInfoMap map[string]string
-	err = json.Unmarshal(torrentInfo, &torrentInfoMap)
-	if err != nil {
-		fmt.Printf("Error unmarshalling torrent_info.json: %v\n", err)
-		return "", nil
+func handleHandshake(pc *peerConn, message string) (string, *FileWorker) {
+	conn := pc.conn
+	// Get the info hash and optional reserved bytes from the message
+	fields := strings.Split(strings.TrimPrefix(message, "HANDSHAKE:"), ":")
+	infoHashMessage := fields[0]
+	var remote peer.Reserved
+	if len(fields) > 1 {
+		r, err := peer.ParseReserved(fields[1])
+		if err != nil {
+			fmt.Printf("Invalid handshake: %v\n", err)
+			conn.Write([]byte("ERROR: Invalid handshake\n"))
+			return "", nil
+		}
+		remote = r
 	}
-	infoHash := torrentInfoMap["InfoHash"]
-	if infoHash != infoHashMessage {
-		fmt.Printf("Info hash mismatch: %s != %s\n", infoHash, infoHashMessage)
+
+	// Check that the info hash is one we seed
+	seed, ok := findSeed(infoHashMessage)
+	if !ok {
+		fmt.Printf("Info hash not seeded: %s\n", infoHashMessage)
 		return "", nil
 	}
-	filePath := torrentInfoMap["FilePath"]
-	// Create worker for the file
-	worker, err := NewFileWorker(filePath)
+	infoHash := seed.infoHash
+	// Reuse the worker if another peer already loaded the file
+	worker, err := acquireWorker(seed)
 	if err != nil {
 		fmt.Printf("Error creating file worker: %v\n", err)
 		conn.Write([]byte("ERROR: Unable to process file\n"))
 		return "", nil
 	}
+	if pc.worker != nil {
+		releaseWorker(pc.worker)
+	}
+
+	pc.infoHash = infoHash
+	pc.worker = worker
+	pc.private = seed.private
+	if len(fields) < 2 {
+		// Legacy peers do not take part in choking
+		conn.Write([]byte("OK\n"))
+		return infoHash, worker
+	}
 
-	conn.Write([]byte("OK\n"))
+	pc.reserved = peer.LocalReserved().Intersect(remote)
+	pc.send("OK:%s", peer.LocalReserved())
+	if pc.reserved.SupportsFast() {
+		sendFastIntro(pc)
+	}
+	if pc.reserved.SupportsExtended() {
+		startExtendedSession(pc)
+	}
 	return infoHash, worker
 }
 
-func handlePieceRequest(conn net.Conn, message string, worker *FileWorker) {
+// sendFastIntro sends the Fast Extension messages that follow a handshake:
+// the compact bitfield, the allowed fast set, cached piece suggestions, and
+// the initial choke state.
+func sendFastIntro(pc *peerConn) {
+	worker := pc.worker
+	if worker.complete() {
+		pc.send(peer.MsgHaveAll)
+	} else {
+		pc.send(peer.MsgHaveNone)
+	}
+
+	var infoHash [20]byte
+	if b, err := hex.DecodeString(pc.infoHash); err == nil && len(b) == len(infoHash) {
+		copy(infoHash[:], b)
+	}
+	pc.allowedFast = make(map[int]bool)
+	if ip := peer.RemoteIP(pc.conn.RemoteAddr()); ip != nil {
+		for _, index := range peer.AllowedFastSet(ip, infoHash, worker.numPieces, peer.AllowedFastCount) {
+			pc.allowedFast[index] = true
+			pc.send("%s:%d", peer.MsgAllowedFast, index)
+		}
+	}
+
+	for _, index := range worker.suggestions() {
+		pc.send("%s:%d", peer.MsgSuggest, index)
+	}
+
+	if acquireSlot(pc) {
+		pc.send(peer.MsgUnchoke)
+	} else {
+		pc.send(peer.MsgChoke)
+	}
+}
+
+// handlePieceRequest sends a requested piece. Errors writing to the peer
+// are returned, which closes the connection.
+func handlePieceRequest(pc *peerConn, message string, worker *FileWorker) error {
+	conn := pc.conn
+	fast := pc.reserved.SupportsFast()
 	parts := strings.Split(message, ":")
 	if len(parts) != 3 {
 		conn.Write([]byte("ERROR: Invalid request format\n"))
-		return
+		return nil
 	}
 
 	index := strings.TrimSpace(parts[2])
 	pieceIndex, err := strconv.Atoi(index)
 	if err != nil || pieceIndex < 0 || pieceIndex >= worker.numPieces {
+		if fast {
+			pc.send("%s:%s:%s", peer.MsgReject, parts[1], index)
+			return nil
+		}
 		conn.Write([]byte("ERROR: Invalid piece index\n"))
-		return
+		return nil
 	}
 
-	// First send the piece size as a fixed-length header (8 bytes)
-	pieceSize := len(worker.pieces[pieceIndex])
-	sizeHeader := make([]byte, 8)
-	binary.BigEndian.PutUint64(sizeHeader, uint64(pieceSize))
+	if !worker.store.Completed(pieceIndex) {
+		if fast {
+			pc.send("%s:%s:%d", peer.MsgReject, parts[1], pieceIndex)
+			return nil
+		}
+		conn.Write([]byte("ERROR: Piece not available\n"))
+		return nil
+	}
+
+	if fast && isChoked(pc) && !pc.allowedFast[pieceIndex] {
+		pc.send("%s:%s:%d", peer.MsgReject, parts[1], pieceIndex)
+		return nil
+	}
+	worker.touch(pieceIndex)
 
-	// Send size header followed by piece data
-	conn.Write(sizeHeader)
-	conn.Write(worker.pieces[pieceIndex])
+	data, err := worker.readPiece(pieceIndex)
+	if err != nil {
+		fmt.Printf("Error reading piece %d: %v\n", pieceIndex, err)
+		if fast {
+			pc.send("%s:%s:%d", peer.MsgReject, parts[1], pieceIndex)
+			return nil
+		}
+		conn.Write([]byte("ERROR: Unable to read piece\n"))
+		return nil
+	}
+	throttleUpload(len(data))
+
+	var header []byte
+	if fast {
+		header = []byte(fmt.Sprintf("%s:%d:%d\n", peer.MsgPiece, pieceIndex, len(data)))
+	} else {
+		// Legacy peers get the piece size as a fixed-length header (8 bytes)
+		header = binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	}
+	if err := pc.sendPiece(header, data); err != nil {
+		return fmt.Errorf("error sending piece %d: %v", pieceIndex, err)
+	}
+	sent(pc.infoHash, len(data))
+	return nil
 }
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Bytes of piece data sent per torrent, keyed by hex info hash, since the
+// process started, and when data was last sent
+var (
+	statsMu       sync.Mutex
+	uploadedBytes = make(map[string]int64)
+	lastUpload    = make(map[string]time.Time)
+)
+
+// Uploaded returns the data sent to peers and web seed clients for a
+// torrent since the process started
+func Uploaded(infoHash [20]byte) int64 {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return uploadedBytes[hex.EncodeToString(infoHash[:])]
+}
+
+// LastUpload returns when piece data was last sent for a torrent, or the
+// zero time if nothing was sent since the process started
+func LastUpload(infoHash [20]byte) time.Time {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return lastUpload[hex.EncodeToString(infoHash[:])]
+}
+
+// throttleUpload waits until the upload rate limit allows sending n bytes
+func throttleUpload(n int) {
+	uploadLimiter.Wait(n)
+}
+
+// sent accounts for n bytes of piece data that were sent for a torrent
+func sent(infoHash string, n int) {
+	if n <= 0 {
+		return
+	}
+	statsMu.Lock()
+	uploadedBytes[infoHash] += int64(n)
+	lastUpload[infoHash] = time.Now()
+	statsMu.Unlock()
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tcp-app/torrent"
+)
+
+// newTestWorker seeds size random bytes and returns their worker
+func newTestWorker(t *testing.T, size int) (*FileWorker, torrent.TorrentFile) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.bin")
+	data := make([]byte, size)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	torrentPath, err := torrent.CreateContext(context.Background(), path, torrent.CreateOptions{PieceLength: torrent.MinPieceLength})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrent.Open(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewFileWorker(path, &tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.store.Close() })
+	return w, tf
+}
+
+func TestPieceUploadCountedAfterWrite(t *testing.T) {
+	w, tf := newTestWorker(t, torrent.MinPieceLength)
+	key := hex.EncodeToString(tf.InfoHash[:])
+	request := fmt.Sprintf("Requesting:%s:0", key)
+
+	tests := []struct {
+		name     string
+		peerGone bool
+		want     int64
+	}{
+		{"peer reads the piece", false, torrent.MinPieceLength},
+		{"peer hung up", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := Uploaded(tf.InfoHash)
+			local, remote := net.Pipe()
+			defer local.Close()
+			if tt.peerGone {
+				remote.Close()
+			} else {
+				go io.Copy(io.Discard, remote)
+				defer remote.Close()
+			}
+			pc := &peerConn{conn: local, infoHash: key, worker: w}
+
+			err := handlePieceRequest(pc, request, w)
+			if tt.peerGone && err == nil {
+				t.Error("failed send was not reported")
+			}
+			if !tt.peerGone && err != nil {
+				t.Fatal(err)
+			}
+			if got := Uploaded(tf.InfoHash) - before; got != tt.want {
+				t.Errorf("counted %d bytes, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingWriter drops every write
+type failingWriter struct {
+	http.ResponseWriter
+}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWebSeedUploadCountedAfterWrite(t *testing.T) {
+	var infoHash [20]byte
+	rand.Read(infoHash[:])
+	key := hex.EncodeToString(infoHash[:])
+
+	if _, err := (countingWriter{failingWriter{httptest.NewRecorder()}, key}).Write([]byte("data")); err == nil {
+		t.Error("failed write was not reported")
+	}
+	if got := Uploaded(infoHash); got != 0 {
+		t.Errorf("counted %d bytes of a failed write", got)
+	}
+	if _, err := (countingWriter{httptest.NewRecorder(), key}).Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if got := Uploaded(infoHash); got != 4 {
+		t.Errorf("counted %d bytes, want 4", got)
+	}
+}
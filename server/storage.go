@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+
+	"tcp-app/storage"
+)
+
+// storageKind is the backend seeded data is read through
+var storageKind = storage.KindFile
+
+// completionDB remembers which seeded pieces were verified, so they are not
+// hashed again every time the server starts
+var completionDB *storage.CompletionDB
+
+// SetCompletionDB sets the database verified pieces are recorded in
+func SetCompletionDB(db *storage.CompletionDB) {
+	completionDB = db
+}
+
+// SetStorage selects the storage backend for torrents seeded from now on.
+// Memory storage loads the whole torrent into memory up front.
+func SetStorage(kind storage.Kind) {
+	storageKind = kind
+}
+
+func openStorage(layout storage.Layout, infoHash [20]byte) (storage.Storage, error) {
+	if storageKind != storage.KindMemory {
+		store, err := storage.New(storageKind, "", layout)
+		if err != nil {
+			return nil, err
+		}
+		return storage.WithCompletionDB(store, completionDB, infoHash, "", layout), nil
+	}
+
+	files, err := storage.NewFile("", layout)
+	if err != nil {
+		return nil, err
+	}
+	defer files.Close()
+	mem := storage.NewMemory(layout)
+	for i := 0; i < layout.NumPieces(); i++ {
+		data := make([]byte, layout.PieceSize(i))
+		if _, err := files.ReadAt(i, data, 0); err != nil {
+			return nil, fmt.Errorf("error loading piece %d: %v", i, err)
+		}
+		mem.WriteAt(i, data, 0)
+	}
+	return mem, nil
+}
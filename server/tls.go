@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+
+	"tcp-app/tlsauth"
+)
+
+// tlsCredentials enables the private swarm mode when set: every accepted
+// connection must complete mutual TLS against the configured CA
+var tlsCredentials *tlsauth.Credentials
+
+// SetTLS enables mutual TLS for accepted connections, or disables it when
+// creds is nil. TLS replaces Message Stream Encryption.
+func SetTLS(creds *tlsauth.Credentials) {
+	tlsCredentials = creds
+}
+
+// secureConn applies TLS or stream encryption to an accepted connection
+// and returns the peer identity when TLS was used
+func secureConn(conn net.Conn) (net.Conn, string, error) {
+	if creds := tlsCredentials; creds != nil {
+		tlsConn, err := creds.Server(conn)
+		if err != nil {
+			return nil, "", err
+		}
+		id, err := tlsauth.PeerIdentity(tlsConn)
+		if err != nil {
+			return nil, "", err
+		}
+		return tlsConn, id.String(), nil
+	}
+	encrypted, err := acceptEncrypted(conn)
+	return encrypted, "", err
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// StartWebSeed serves the seeded content over HTTP so that torrents can
+// list this host in their url-list. Files are served at /<name>, or at
+// /<name>/<path> for directories, matching the BEP 19 URL layout.
+func StartWebSeed(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveWebSeed)
+	fmt.Printf("Web seed listening on %s\n", address)
+	return http.ListenAndServe(address, mux)
+}
+
+// serveWebSeed serves a seeded file. http.ServeContent takes care of
+// Range, If-Range, conditional requests, HEAD and Content-Length once the
+// ETag is set.
+func serveWebSeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var seed seedEntry
+	found := false
+	rest := ""
+	for _, e := range seedEntries() {
+		name := "/" + e.name
+		if r.URL.Path == name {
+			seed, found = e, true
+			break
+		}
+		if strings.HasPrefix(r.URL.Path, name+"/") {
+			seed, found = e, true
+			rest = path.Clean(strings.TrimPrefix(r.URL.Path, name))
+			break
+		}
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	// http.Dir keeps the request path below the seeded directory
+	var file http.File
+	var err error
+	if rest == "" {
+		file, err = os.Open(seed.filePath)
+	} else {
+		file, err = http.Dir(seed.filePath).Open(rest)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%x-%x"`, seed.infoHash, info.Size(), info.ModTime().UnixNano()))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(countingWriter{w, seed.infoHash}, r, info.Name(), info.ModTime(), file)
+}
+
+// countingWriter counts the file data served over HTTP as uploaded, like
+// pieces sent to peers, so share ratios include web seed clients
+type countingWriter struct {
+	http.ResponseWriter
+	infoHash string
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	throttleUpload(len(p))
+	n, err := w.ResponseWriter.Write(p)
+	sent(w.infoHash, n)
+	return n, err
+}
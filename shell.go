@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"tcp-app/client"
+	"tcp-app/dht"
+	"tcp-app/mse"
+	"tcp-app/server"
+	"tcp-app/storage"
+	"tcp-app/tlsauth"
+	"tcp-app/torrent"
+)
+
+// runShell runs the interactive prompt. Like before the subcommands
+// existed, it serves peers on the listen address and joins the DHT and
+// local service discovery.
+func runShell(args []string) int {
+	node, rest, err := parseNodeFlags(args)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unexpected argument %q", rest[0])
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if node.listen == "" {
+		node.listen = ":8080"
+	}
+	node.dht = true
+	node.lsd = true
+	stop, err := node.start()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer stop()
+	go func() {
+		if err := server.StartServer(node.listen); err != nil {
+			fmt.Printf("Server stopped: %v\n", err)
+		}
+	}()
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("Torrent Simulation App")
+	fmt.Println("Commands:")
+	fmt.Println("  download [torrent-file]  - Start downloading a torrent file")
+	fmt.Println("           [--sequential] [--first-last] [--file index=skip|low|normal|high ...]")
+	fmt.Println("           [--storage file|memory|mmap] [--output dir] [--peer address ...]")
+	fmt.Println("  seed [torrent-file] [path] - Serve a torrent's data to peers")
+	fmt.Println("  test [ip:port]          - Test connection to a peer")
+	fmt.Println("  exit                     - Exit the program")
+	fmt.Println("  clear                    - Clear the terminal")
+	fmt.Println("  create [file] [url...]   - Create a torrent file, optionally listing web seed URLs")
+	fmt.Println("         [--piece-length size]  (power of two, e.g. 256k; picked from the size by default)")
+	fmt.Println("         [--align]  (pad the files of a directory to piece boundaries)")
+	fmt.Println("         [--tracker url]")
+	fmt.Println("  open [torrent-file]      - Open and display torrent file contents")
+	fmt.Println("  info [torrent-file]      - Show torrent metadata (--json for tooling)")
+	fmt.Println("  edit [torrent-file]      - Change trackers, web seeds or comment without rehashing")
+	fmt.Println("  check-file [filename]    - Test split and merge functionality")
+	fmt.Println("  verify [torrent] [path]  - Check local data against a torrent file")
+	fmt.Println("  lsd [on|off]             - Toggle local peer discovery")
+	fmt.Println("  encryption [policy]      - Set encryption to prefer, require or disable")
+	fmt.Println("  tls [ca] [cert] [key]    - Require mutual TLS with peers (tls off to disable)")
+	fmt.Println("  webseed [address]        - Serve the seeded files over HTTP")
+	fmt.Println("  stream [address]         - Stream running downloads over HTTP")
+	fmt.Println("  storage [kind]           - Read seeded data from file, memory or mmap storage")
+	for {
+		fmt.Print("> ") // CLI prompt
+		commandLine, err := reader.ReadString('\n')
+		if err != nil && commandLine == "" {
+			// End of input behaves like exit
+			return 0
+		}
+		args := strings.Fields(commandLine)
+		if len(args) == 0 {
+			continue
+		}
+
+		// Handle commands by their exact name
+		switch args[0] {
+		case "seed":
+			if len(args) < 2 {
+				fmt.Println("Usage: seed [torrent-file] [path]")
+				continue
+			}
+			dataPath := ""
+			if len(args) > 2 {
+				dataPath = args[2]
+			}
+			if _, err := server.Seed(args[1], dataPath); err != nil {
+				fmt.Println(err)
+			}
+
+		case "download":
+			if len(args) < 2 {
+				fmt.Println("Usage: download [torrent-file] [--sequential] [--first-last] [--file index=priority ...]")
+				continue
+			}
+			torrentFile := args[1]
+			opts, err := parseDownloadOptions(args[2:])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if err := client.StartDownloadWithOptions(torrentFile, opts); err != nil {
+				fmt.Println(err)
+			}
+
+		case "test":
+			if len(args) < 2 {
+				fmt.Println("Usage: test [ip:port]")
+				continue
+			}
+			peerAddress := args[1]
+			if err := client.TestConnection(peerAddress); err != nil {
+				fmt.Printf("Connection failed: %v\n", err)
+			} else {
+				fmt.Printf("Successfully connected to %s\n", peerAddress)
+			}
+
+		case "lsd":
+			if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+				fmt.Println("Usage: lsd [on|off]")
+				continue
+			}
+			if err := enableLSD(args[1] == "on"); err != nil {
+				fmt.Printf("Failed to switch local service discovery: %v\n", err)
+			} else {
+				fmt.Printf("Local service discovery %s\n", args[1])
+			}
+
+		case "encryption":
+			if len(args) < 2 {
+				fmt.Println("Usage: encryption [prefer|require|disable]")
+				continue
+			}
+			policy, err := mse.ParsePolicy(args[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			server.SetEncryptionPolicy(policy)
+			client.SetEncryptionPolicy(policy)
+			fmt.Printf("Encryption policy set to %s\n", policy)
+
+		case "tls":
+			if len(args) == 2 && args[1] == "off" {
+				server.SetTLS(nil)
+				client.SetTLS(nil)
+				fmt.Println("TLS disabled")
+				continue
+			}
+			if len(args) < 4 {
+				fmt.Println("Usage: tls [ca-file] [cert-file] [key-file] | tls off")
+				continue
+			}
+			creds, err := tlsauth.Load(args[1], args[2], args[3])
+			if err != nil {
+				fmt.Printf("Failed to load TLS credentials: %v\n", err)
+				continue
+			}
+			server.SetTLS(creds)
+			client.SetTLS(creds)
+			fmt.Println("TLS enabled; peers must present a certificate from the configured CA")
+
+		case "webseed":
+			if len(args) < 2 {
+				fmt.Println("Usage: webseed [address]")
+				continue
+			}
+			go func() {
+				if err := server.StartWebSeed(args[1]); err != nil {
+					fmt.Printf("Web seed stopped: %v\n", err)
+				}
+			}()
+
+		case "verify":
+			runVerify(args[1:])
+
+		case "info":
+			runInfo(args[1:])
+
+		case "edit":
+			runEdit(args[1:])
+
+		case "storage":
+			if len(args) < 2 {
+				fmt.Println("Usage: storage [file|memory|mmap]")
+				continue
+			}
+			kind, err := storage.ParseKind(args[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			server.SetStorage(kind)
+			fmt.Printf("Seeding from %s storage\n", kind)
+
+		case "stream":
+			if len(args) < 2 {
+				fmt.Println("Usage: stream [address]")
+				continue
+			}
+			go func() {
+				if err := client.StartStreamServer(args[1]); err != nil {
+					fmt.Printf("Stream server stopped: %v\n", err)
+				}
+			}()
+
+		case "exit":
+			fmt.Println("Exiting...")
+			return 0
+
+		case "clear":
+			fmt.Println("\033[H\033[2J") // Clear the terminal
+
+		case "create":
+			if len(args) < 2 {
+				fmt.Println("Usage: create [file]")
+				continue
+			}
+			sourceFile := args[1]
+			opts, err := parseCreateOptions(args[2:])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			opts.Progress = hashProgressPrinter()
+			// Ctrl-C aborts hashing instead of exiting the program
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			torrentFileName, err := torrent.CreateContext(ctx, sourceFile, opts)
+			stop()
+			fmt.Println()
+			if err != nil {
+				fmt.Printf("Failed to create torrent file: %v\n", err)
+			} else {
+				fmt.Printf("Torrent file created successfully: %s\n", torrentFileName)
+				// The shell seeds what it creates
+				if _, err := server.Seed(torrentFileName, sourceFile); err != nil {
+					fmt.Println(err)
+				}
+			}
+
+		case "open":
+			if len(args) < 2 {
+				fmt.Println("Usage: open [torrent-file]")
+				continue
+			}
+			runInfo(args[1:2])
+
+		case "check-file", "test-file":
+			if len(args) < 2 {
+				fmt.Println("Usage: check-file <filename>")
+				continue
+			}
+			if err := torrent.TestSplitAndMerge(args[1]); err != nil {
+				fmt.Printf("Test failed: %v\n", err)
+			}
+
+		default:
+			fmt.Println("Unknown command. Try again.")
+		}
+	}
+}
+
+// joinDHT starts a DHT node for client lookups and returns a function that
+// stops it. The routing table is kept in stateDir, or not at all if empty.
+func joinDHT(stateDir string) func() {
+	var stateFile string
+	if stateDir != "" {
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			fmt.Printf("DHT routing table will not be saved: %v\n", err)
+		} else {
+			stateFile = filepath.Join(stateDir, "dht_state.json")
+		}
+	}
+	node, err := dht.New(dht.Config{
+		Addr:           ":6881",
+		BootstrapNodes: dht.DefaultBootstrapNodes,
+		StateFile:      stateFile,
+	})
+	if err != nil {
+		fmt.Printf("DHT disabled: %v\n", err)
+		return func() {}
+	}
+	client.SetDHT(node)
+	go func() {
+		if err := node.Bootstrap(); err != nil {
+			fmt.Printf("DHT bootstrap failed: %v\n", err)
+		}
+	}()
+	return func() { node.Close() }
+}
+
+// enableLSD switches local service discovery on or off for both downloads
+// and seeds
+func enableLSD(enable bool) error {
+	svc, err := client.EnableLSD(enable)
+	if err != nil {
+		return err
+	}
+	server.SetLSD(svc)
+	return nil
+}
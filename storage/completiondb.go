@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"tcp-app/internal/atomicfile"
+)
+
+// CompletionDB remembers which pieces of each torrent have been verified,
+// so restarts do not need to hash everything again. Every torrent has a
+// small JSON file holding a bitfield and the absolute path, size and
+// modification time of its files; pieces of files that changed or moved
+// since are forgotten on load. Keying files by absolute path lets the
+// client and server share records although they address the files
+// relative to different directories.
+type CompletionDB struct {
+	dir string
+	mu  sync.Mutex
+}
+
+type savedFile struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+type savedCompletion struct {
+	Pieces []byte      `json:"pieces"`
+	Files  []savedFile `json:"files"`
+}
+
+// OpenCompletionDB opens the database kept in dir, creating it if needed
+func OpenCompletionDB(dir string) (*CompletionDB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create completion database: %v", err)
+	}
+	return &CompletionDB{dir: dir}, nil
+}
+
+func (db *CompletionDB) path(infoHash [20]byte) string {
+	return filepath.Join(db.dir, hex.EncodeToString(infoHash[:])+".json")
+}
+
+// load returns the pieces recorded as complete for a torrent whose files
+// are currently in the state files. It returns nil if nothing was recorded.
+func (db *CompletionDB) load(infoHash [20]byte, layout Layout, files []savedFile) map[int]bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	data, err := os.ReadFile(db.path(infoHash))
+	if err != nil {
+		return nil
+	}
+	var saved savedCompletion
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved.Files) != len(layout.Files) {
+		return nil
+	}
+
+	done := make(map[int]bool)
+	for index := 0; index < layout.NumPieces(); index++ {
+		if index/8 < len(saved.Pieces) && saved.Pieces[index/8]&(0x80>>(index%8)) != 0 {
+			done[index] = true
+		}
+	}
+
+	// Forget the pieces of files that were changed behind our back
+	for i, f := range saved.Files {
+		if f == files[i] {
+			continue
+		}
+		first, last, ok := layout.filePieces(i)
+		for index := first; ok && index <= last; index++ {
+			delete(done, index)
+		}
+	}
+	return done
+}
+
+// save records the complete pieces of a torrent together with the state
+// of its files, replacing the old record atomically
+func (db *CompletionDB) save(infoHash [20]byte, layout Layout, done map[int]bool, files []savedFile) error {
+	saved := savedCompletion{
+		Pieces: make([]byte, (layout.NumPieces()+7)/8),
+		Files:  files,
+	}
+	for index := range done {
+		saved.Pieces[index/8] |= 0x80 >> (index % 8)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return atomicfile.Write(db.path(infoHash), data, 0600)
+}
+
+// statFiles returns the absolute path, size and modification time of
+// every file. Missing files are recorded with a negative size so they
+// never match.
+func statFiles(dir string, layout Layout) []savedFile {
+	files := make([]savedFile, len(layout.Files))
+	for i := range layout.Files {
+		files[i] = statFile(dir, layout.Files[i])
+	}
+	return files
+}
+
+func statFile(dir string, f File) savedFile {
+	path := filepath.Join(dir, f.Path)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	saved := savedFile{Path: path, Size: -1}
+	if info, err := os.Stat(path); err == nil {
+		saved.Size = info.Size()
+		saved.ModTime = info.ModTime().UnixNano()
+	}
+	return saved
+}
+
+// flushDelay is how long completed pieces are collected before the record
+// is written, so a download does not rewrite it for every piece
+const flushDelay = 5 * time.Second
+
+// persistentStorage records completed pieces in a CompletionDB. Files are
+// stat'ed once when opened; a flush only looks again at the files written
+// since the previous one.
+type persistentStorage struct {
+	Storage
+	db       *CompletionDB
+	infoHash [20]byte
+	dir      string
+	layout   Layout
+
+	mu    sync.Mutex
+	done  map[int]bool
+	files []savedFile
+	// dirty holds the files written since the last flush
+	dirty   map[int]bool
+	pending bool
+	timer   *time.Timer
+}
+
+// WithCompletionDB wraps storage whose files live below dir so that its
+// completed pieces are loaded from and saved to db. Memory storage is
+// returned unchanged since its data does not outlive the process.
+func WithCompletionDB(st Storage, db *CompletionDB, infoHash [20]byte, dir string, layout Layout) Storage {
+	if _, ok := st.(*memoryStorage); ok || db == nil {
+		return st
+	}
+	files := statFiles(dir, layout)
+	done := db.load(infoHash, layout, files)
+	if done == nil {
+		done = make(map[int]bool)
+	}
+	return &persistentStorage{
+		Storage:  st,
+		db:       db,
+		infoHash: infoHash,
+		dir:      dir,
+		layout:   layout,
+		done:     done,
+		files:    files,
+		dirty:    make(map[int]bool),
+	}
+}
+
+// WriteAt writes through to the storage, remembering which files changed.
+// They are marked afterwards so a flush cannot stat them mid-write.
+func (s *persistentStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	n, err := s.Storage.WriteAt(index, p, off)
+	if spans, spanErr := s.layout.spans(index, off, int64(len(p))); spanErr == nil {
+		s.mu.Lock()
+		for _, sp := range spans {
+			s.dirty[sp.file] = true
+		}
+		s.mu.Unlock()
+	}
+	return n, err
+}
+
+// MarkComplete records the piece and schedules a flush
+func (s *persistentStorage) MarkComplete(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done[index] = true
+	s.pending = true
+	if s.timer == nil {
+		s.timer = time.AfterFunc(flushDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err := s.flush(); err != nil {
+				fmt.Printf("Error saving completed pieces: %v\n", err)
+			}
+		})
+	}
+	return nil
+}
+
+func (s *persistentStorage) Completed(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[index]
+}
+
+// Close closes the storage and saves pieces completed since the last flush
+func (s *persistentStorage) Close() error {
+	err := s.Storage.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if flushErr := s.flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// flush saves the record, looking again at the files written since the
+// last one. Callers hold s.mu.
+func (s *persistentStorage) flush() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !s.pending && len(s.dirty) == 0 {
+		return nil
+	}
+	for i := range s.dirty {
+		s.files[i] = statFile(s.dir, s.layout.Files[i])
+	}
+	clear(s.dirty)
+	s.pending = false
+	return s.db.save(s.infoHash, s.layout, s.done, s.files)
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// completedPieces returns the pieces reopened storage reports complete
+func completedPieces(t *testing.T, db *CompletionDB, infoHash [20]byte, dir string, layout Layout) []int {
+	t.Helper()
+	st, err := NewFile(dir, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = WithCompletionDB(st, db, infoHash, dir, layout)
+	defer st.Close()
+	var done []int
+	for index := 0; index < layout.NumPieces(); index++ {
+		if st.Completed(index) {
+			done = append(done, index)
+		}
+	}
+	return done
+}
+
+func TestCompletionDBInvalidation(t *testing.T) {
+	// Two files of two pieces each, piece 2 spanning both
+	layout := Layout{PieceLength: 4, Files: []File{
+		{Path: "a", Length: 10},
+		{Path: "b", Length: 6},
+	}}
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string)
+		want   []int
+	}{
+		{"unchanged", func(*testing.T, string) {}, []int{0, 1, 2, 3}},
+		{"file rewritten", func(t *testing.T, dir string) {
+			path := filepath.Join(dir, "b")
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}, []int{0, 1}},
+		{"file truncated", func(t *testing.T, dir string) {
+			if err := os.Truncate(filepath.Join(dir, "a"), 3); err != nil {
+				t.Fatal(err)
+			}
+		}, []int{3}},
+		{"file removed", func(t *testing.T, dir string) {
+			if err := os.Remove(filepath.Join(dir, "a")); err != nil {
+				t.Fatal(err)
+			}
+		}, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := OpenCompletionDB(filepath.Join(dir, "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			infoHash := [20]byte{1}
+			st, err := NewFile(dir, layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st = WithCompletionDB(st, db, infoHash, dir, layout)
+			for index := 0; index < layout.NumPieces(); index++ {
+				data := make([]byte, layout.PieceSize(index))
+				if _, err := st.WriteAt(index, data, 0); err != nil {
+					t.Fatal(err)
+				}
+				st.MarkComplete(index)
+			}
+			if err := st.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.change(t, dir)
+			if got := completedPieces(t, db, infoHash, dir, layout); !equalInts(got, tt.want) {
+				t.Errorf("complete pieces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletionDBBatchesSaves(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenCompletionDB(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := Layout{PieceLength: 4, Files: []File{{Path: "a", Length: 8}}}
+	infoHash := [20]byte{2}
+	st, err := NewFile(dir, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = WithCompletionDB(st, db, infoHash, dir, layout)
+	for index := 0; index < 2; index++ {
+		st.WriteAt(index, []byte("data"), 0)
+		st.MarkComplete(index)
+	}
+	if _, err := os.Stat(db.path(infoHash)); !os.IsNotExist(err) {
+		t.Errorf("record written before the flush: %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := completedPieces(t, db, infoHash, dir, layout); !equalInts(got, []int{0, 1}) {
+		t.Errorf("complete pieces after close %v, want [0 1]", got)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStorage reads and writes plain files. Files are opened on first use,
+// read-only until something is written to them.
+type fileStorage struct {
+	completion
+	dir      string
+	layout   Layout
+	readOnly bool
+
+	mu       sync.Mutex
+	files    map[int]*os.File
+	writable map[int]bool
+	// retired holds read-only handles replaced by writable ones. They may
+	// still be in use, so they are only closed with the storage.
+	retired []*os.File
+}
+
+// NewFile creates storage backed by the layout's files below dir. Empty
+// files are created right away since no piece covers them.
+func NewFile(dir string, layout Layout) (Storage, error) {
+	for _, f := range layout.Files {
+		if f.Length != 0 || f.Virtual {
+			continue
+		}
+		path := filepath.Join(dir, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %v", err)
+		}
+		file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file: %v", err)
+		}
+		file.Close()
+	}
+	return &fileStorage{
+		dir:      dir,
+		layout:   layout,
+		files:    make(map[int]*os.File),
+		writable: make(map[int]bool),
+	}, nil
+}
+
+// OpenFile opens the layout's existing files below dir for reading only.
+// Unlike NewFile nothing is created; reads that need a missing file fail.
+func OpenFile(dir string, layout Layout) Storage {
+	return &fileStorage{
+		dir:      dir,
+		layout:   layout,
+		readOnly: true,
+		files:    make(map[int]*os.File),
+		writable: make(map[int]bool),
+	}
+}
+
+// open returns the handle of a file, reopening it for writing if needed
+func (s *fileStorage) open(index int, write bool) (*os.File, error) {
+	if write && s.readOnly {
+		return nil, fmt.Errorf("storage opened read-only")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[index]; ok && (!write || s.writable[index]) {
+		return f, nil
+	}
+
+	path := filepath.Join(s.dir, s.layout.Files[index].Path)
+	var f *os.File
+	var err error
+	if write {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %v", err)
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if old, ok := s.files[index]; ok {
+		s.retired = append(s.retired, old)
+	}
+	s.files[index] = f
+	s.writable[index] = write
+	return f, nil
+}
+
+func (s *fileStorage) ReadAt(index int, p []byte, off int64) (int, error) {
+	spans, err := s.layout.spans(index, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, sp := range spans {
+		if s.layout.Files[sp.file].Virtual {
+			clear(p[n : n+int(sp.length)])
+			n += int(sp.length)
+			continue
+		}
+		f, err := s.open(sp.file, false)
+		if err != nil {
+			return n, err
+		}
+		read, err := f.ReadAt(p[n:n+int(sp.length)], sp.offset)
+		n += read
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	spans, err := s.layout.spans(index, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, sp := range spans {
+		if s.layout.Files[sp.file].Virtual {
+			n += int(sp.length)
+			continue
+		}
+		f, err := s.open(sp.file, true)
+		if err != nil {
+			return n, err
+		}
+		written, err := f.WriteAt(p[n:n+int(sp.length)], sp.offset)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for index, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, index)
+	}
+	for _, f := range s.retired {
+		f.Close()
+	}
+	s.retired = nil
+	return firstErr
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"sync"
+)
+
+// memoryStorage keeps all data in memory, which is handy for tests and
+// for data that is only streamed
+type memoryStorage struct {
+	completion
+	layout Layout
+	mu     sync.RWMutex
+	data   []byte
+}
+
+// NewMemory creates storage backed by a byte slice
+func NewMemory(layout Layout) Storage {
+	return &memoryStorage{layout: layout, data: make([]byte, layout.Length())}
+}
+
+func (m *memoryStorage) ReadAt(index int, p []byte, off int64) (int, error) {
+	if _, err := m.layout.spans(index, off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	start := int64(index)*m.layout.PieceLength + off
+	return copy(p, m.data[start:]), nil
+}
+
+func (m *memoryStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	if _, err := m.layout.spans(index, off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := int64(index)*m.layout.PieceLength + off
+	return copy(m.data[start:], p), nil
+}
+
+func (m *memoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,151 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// mmapStorage maps every file into memory. Files are created and grown to
+// their full size when the storage is opened; read-only files are mapped
+// read-only, so seeding works without write permission.
+type mmapStorage struct {
+	completion
+	layout Layout
+	mu     sync.RWMutex
+	maps   [][]byte
+	// readOnly marks mappings of files that could not be opened for writing
+	readOnly []bool
+	closed   bool
+}
+
+// NewMmap creates storage backed by memory-mapped files below dir
+func NewMmap(dir string, layout Layout) (Storage, error) {
+	s := &mmapStorage{
+		layout:   layout,
+		maps:     make([][]byte, len(layout.Files)),
+		readOnly: make([]bool, len(layout.Files)),
+	}
+	for i, f := range layout.Files {
+		if f.Virtual {
+			continue
+		}
+		m, readOnly, err := mapFile(filepath.Join(dir, f.Path), f.Length)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.maps[i] = m
+		s.readOnly[i] = readOnly
+	}
+	return s, nil
+}
+
+func mapFile(path string, length int64) ([]byte, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create directory: %v", err)
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if errors.Is(err, os.ErrPermission) {
+		prot = syscall.PROT_READ
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	readOnly := prot == syscall.PROT_READ
+	if length == 0 {
+		return nil, readOnly, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() < length {
+		if readOnly {
+			return nil, false, fmt.Errorf("%s is shorter than expected", path)
+		}
+		if err := file.Truncate(length); err != nil {
+			return nil, false, fmt.Errorf("failed to allocate %s: %v", path, err)
+		}
+	}
+	m, err := syscall.Mmap(int(file.Fd()), 0, int(length), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to map %s: %v", path, err)
+	}
+	return m, readOnly, nil
+}
+
+func (s *mmapStorage) ReadAt(index int, p []byte, off int64) (int, error) {
+	spans, err := s.layout.spans(index, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for _, sp := range spans {
+		if s.layout.Files[sp.file].Virtual {
+			clear(p[n : n+int(sp.length)])
+			n += int(sp.length)
+			continue
+		}
+		n += copy(p[n:n+int(sp.length)], s.maps[sp.file][sp.offset:])
+	}
+	return n, nil
+}
+
+func (s *mmapStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	spans, err := s.layout.spans(index, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for _, sp := range spans {
+		if s.layout.Files[sp.file].Virtual {
+			n += int(sp.length)
+			continue
+		}
+		// Writing to a read-only mapping would fault
+		if s.readOnly[sp.file] {
+			return n, fmt.Errorf("file %d is read-only: %w", sp.file, os.ErrPermission)
+		}
+		n += copy(s.maps[sp.file][sp.offset:], p[n:n+int(sp.length)])
+	}
+	return n, nil
+}
+
+func (s *mmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var firstErr error
+	for _, m := range s.maps {
+		if m == nil {
+			continue
+		}
+		if err := syscall.Munmap(m); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package storage
+
+// NewMmap falls back to plain files where memory mapping is unavailable
+func NewMmap(dir string, layout Layout) (Storage, error) {
+	return NewFile(dir, layout)
+}
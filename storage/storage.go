@@ -0,0 +1,163 @@
+// Package storage keeps the data of a torrent. Pieces are addressed by
+// index and mapped onto the torrent's files by a Layout, so the server and
+// the client read and write torrent data the same way whatever the backend.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Storage holds the pieces of one torrent
+type Storage interface {
+	// ReadAt reads len(p) bytes of a piece starting at off within the piece
+	ReadAt(index int, p []byte, off int64) (int, error)
+	// WriteAt writes p into a piece starting at off within the piece
+	WriteAt(index int, p []byte, off int64) (int, error)
+	// MarkComplete records that a piece has been written and verified
+	MarkComplete(index int) error
+	// Completed reports whether a piece was marked complete
+	Completed(index int) bool
+	Close() error
+}
+
+// Kind selects a storage backend
+type Kind string
+
+const (
+	KindFile   Kind = "file"
+	KindMemory Kind = "memory"
+	KindMmap   Kind = "mmap"
+)
+
+// ParseKind parses file, memory or mmap
+func ParseKind(s string) (Kind, error) {
+	switch k := Kind(s); k {
+	case KindFile, KindMemory, KindMmap:
+		return k, nil
+	}
+	return "", fmt.Errorf("unknown storage %q, expected file, memory or mmap", s)
+}
+
+// New opens storage of the given kind. File paths in the layout are
+// relative to dir; memory storage ignores it.
+func New(kind Kind, dir string, layout Layout) (Storage, error) {
+	switch kind {
+	case KindFile, "":
+		return NewFile(dir, layout)
+	case KindMemory:
+		return NewMemory(layout), nil
+	case KindMmap:
+		return NewMmap(dir, layout)
+	}
+	return nil, fmt.Errorf("unknown storage %q", kind)
+}
+
+// ErrOutOfRange is returned for accesses past the end of a piece
+var ErrOutOfRange = errors.New("access outside of piece")
+
+// File is one file of a torrent's data
+type File struct {
+	Path   string
+	Length int64
+	// Virtual files have no data on disk, such as BEP 47 padding: they read
+	// as zeros, writes to them are dropped, and they are never created
+	Virtual bool
+}
+
+// Layout describes how pieces map onto files. The torrent's data is the
+// concatenation of its files, cut into pieces of PieceLength bytes.
+type Layout struct {
+	PieceLength int64
+	Files       []File
+}
+
+// Length returns the total size of the data
+func (l Layout) Length() int64 {
+	var n int64
+	for _, f := range l.Files {
+		n += f.Length
+	}
+	return n
+}
+
+// NumPieces returns the number of pieces
+func (l Layout) NumPieces() int {
+	if l.PieceLength == 0 {
+		return 0
+	}
+	return int((l.Length() + l.PieceLength - 1) / l.PieceLength)
+}
+
+// PieceSize returns the length of a piece, which is shorter for the last one
+func (l Layout) PieceSize(index int) int64 {
+	start := int64(index) * l.PieceLength
+	return max(0, min(l.PieceLength, l.Length()-start))
+}
+
+// filePieces returns the first and last piece overlapping a file, with ok
+// false for empty files
+func (l Layout) filePieces(file int) (first, last int, ok bool) {
+	if l.Files[file].Length == 0 || l.PieceLength == 0 {
+		return 0, 0, false
+	}
+	var start int64
+	for _, f := range l.Files[:file] {
+		start += f.Length
+	}
+	end := start + l.Files[file].Length - 1
+	return int(start / l.PieceLength), int(end / l.PieceLength), true
+}
+
+// span is the part of a file covered by a byte range
+type span struct {
+	file   int
+	offset int64
+	length int64
+}
+
+// spans maps a range within a piece onto the files it covers. Empty files
+// cover nothing.
+func (l Layout) spans(index int, off, length int64) ([]span, error) {
+	if index < 0 || off < 0 || off+length > l.PieceSize(index) {
+		return nil, ErrOutOfRange
+	}
+	start := int64(index)*l.PieceLength + off
+	end := start + length
+	var spans []span
+	var fileStart int64
+	for i, f := range l.Files {
+		fileEnd := fileStart + f.Length
+		if f.Length > 0 && fileEnd > start && fileStart < end {
+			from := max(start, fileStart)
+			to := min(end, fileEnd)
+			spans = append(spans, span{file: i, offset: from - fileStart, length: to - from})
+		}
+		fileStart = fileEnd
+	}
+	return spans, nil
+}
+
+// completion is the in-memory record of completed pieces every backend
+// shares
+type completion struct {
+	mu   sync.Mutex
+	done map[int]bool
+}
+
+func (c *completion) MarkComplete(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		c.done = make(map[int]bool)
+	}
+	c.done[index] = true
+	return nil
+}
+
+func (c *completion) Completed(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[index]
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLayout has pieces spanning files, an empty file and padding
+var testLayout = Layout{PieceLength: 8, Files: []File{
+	{Path: "a", Length: 5},
+	{Path: "empty", Length: 0},
+	{Path: "pad", Length: 3, Virtual: true},
+	{Path: filepath.Join("sub", "b"), Length: 12},
+}}
+
+func TestBackends(t *testing.T) {
+	for _, kind := range []Kind{KindFile, KindMemory, KindMmap} {
+		t.Run(string(kind), func(t *testing.T) {
+			dir := t.TempDir()
+			st, err := New(kind, dir, testLayout)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Piece data, zeros where the padding goes
+			data := []byte("abcde\x00\x00\x00fghijklmnopq")
+			for index := 0; index < testLayout.NumPieces(); index++ {
+				piece := data[int64(index)*testLayout.PieceLength:][:testLayout.PieceSize(index)]
+				// Write the second half first to check offsets
+				half := len(piece) / 2
+				if _, err := st.WriteAt(index, piece[half:], int64(half)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := st.WriteAt(index, piece[:half], 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for index := 0; index < testLayout.NumPieces(); index++ {
+				want := data[int64(index)*testLayout.PieceLength:][:testLayout.PieceSize(index)]
+				got := make([]byte, len(want))
+				if _, err := st.ReadAt(index, got, 0); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("piece %d reads %q, want %q", index, got, want)
+				}
+			}
+			if _, err := st.ReadAt(2, make([]byte, 5), 0); !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("read past the last piece returned %v", err)
+			}
+			if _, err := st.WriteAt(3, []byte("x"), 0); !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("write to a missing piece returned %v", err)
+			}
+
+			if st.Completed(1) {
+				t.Error("piece complete before being marked")
+			}
+			st.MarkComplete(1)
+			if !st.Completed(1) || st.Completed(0) {
+				t.Error("completion not tracked per piece")
+			}
+			if err := st.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if kind == KindMemory {
+				return
+			}
+			for path, want := range map[string]string{"a": "abcde", "empty": "", filepath.Join("sub", "b"): "fghijklmnopq"} {
+				got, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil || string(got) != want {
+					t.Errorf("%s holds %q, %v, want %q", path, got, err, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "pad")); !os.IsNotExist(err) {
+				t.Errorf("padding file created: %v", err)
+			}
+		})
+	}
+}
+
+func TestSpans(t *testing.T) {
+	tests := []struct {
+		index       int
+		off, length int64
+		want        []span
+	}{
+		{0, 0, 8, []span{{0, 0, 5}, {2, 0, 3}}},
+		{0, 5, 3, []span{{2, 0, 3}}},
+		{1, 0, 8, []span{{3, 0, 8}}},
+		{2, 2, 2, []span{{3, 10, 2}}},
+	}
+	for _, tt := range tests {
+		got, err := testLayout.spans(tt.index, tt.off, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("spans(%d, %d, %d) = %v, want %v", tt.index, tt.off, tt.length, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("spans(%d, %d, %d) = %v, want %v", tt.index, tt.off, tt.length, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	for _, s := range []string{"file", "memory", "mmap"} {
+		if kind, err := ParseKind(s); err != nil || string(kind) != s {
+			t.Errorf("ParseKind(%q) = %q, %v", s, kind, err)
+		}
+	}
+	if _, err := ParseKind("tape"); err == nil {
+		t.Error("unknown storage kind accepted")
+	}
+}
@@ -0,0 +1,154 @@
+// Package tlsauth provides mutual TLS for private swarms: every peer
+// presents a certificate signed by a shared CA and is identified by it.
+package tlsauth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// handshakeTimeout bounds the TLS handshake on new connections
+const handshakeTimeout = 10 * time.Second
+
+// Credentials hold this node's certificate and the CA that peers' and
+// clients' certificates must chain to
+type Credentials struct {
+	Certificate tls.Certificate
+	CAs         *x509.CertPool
+}
+
+// Load reads a PEM CA bundle, certificate and private key from disk
+func Load(caFile, certFile, keyFile string) (*Credentials, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %v", err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %v", err)
+	}
+	return FromPEM(caPEM, certPEM, keyPEM)
+}
+
+// FromPEM builds credentials from PEM encoded CA, certificate and key
+func FromPEM(caPEM, certPEM, keyPEM []byte) (*Credentials, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no CA certificates found")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+	return &Credentials{Certificate: cert, CAs: pool}, nil
+}
+
+// ServerConfig returns a TLS configuration that requires clients to
+// present a certificate signed by the CA. It is used by the peer listener
+// and can be used by any HTTP server such as a tracker.
+func (c *Credentials) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{c.Certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    c.CAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ClientConfig returns a TLS configuration that presents our certificate
+// and accepts any server certificate signed by the CA. Peers are dialed by
+// address, so host names are not checked; the CA is what establishes trust.
+func (c *Credentials) ClientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{c.Certificate},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return c.verifyChain(rawCerts)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+func (c *Credentials) verifyChain(rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.CAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// Server wraps an accepted connection in TLS and completes the handshake
+func (c *Credentials) Server(conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, c.ServerConfig())
+	return tlsConn, handshake(tlsConn)
+}
+
+// Client wraps a dialed connection in TLS and completes the handshake
+func (c *Credentials) Client(conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, c.ClientConfig())
+	return tlsConn, handshake(tlsConn)
+}
+
+func handshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("tls handshake failed: %v", err)
+	}
+	return nil
+}
+
+// Identity is who a peer is according to its certificate
+type Identity struct {
+	// Name is the certificate's common name
+	Name string
+	// Fingerprint is the hex SHA-256 of the certificate
+	Fingerprint string
+}
+
+func (id Identity) String() string {
+	return fmt.Sprintf("%s (%s)", id.Name, id.Fingerprint[:16])
+}
+
+// PeerIdentity returns the identity of the remote side of a completed
+// TLS connection
+func PeerIdentity(conn *tls.Conn) (Identity, error) {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return Identity{}, errors.New("peer presented no certificate")
+	}
+	return IdentityOf(certs[0]), nil
+}
+
+// IdentityOf derives an identity from a certificate
+func IdentityOf(cert *x509.Certificate) Identity {
+	sum := sha256.Sum256(cert.Raw)
+	return Identity{Name: cert.Subject.CommonName, Fingerprint: hex.EncodeToString(sum[:])}
+}
@@ -0,0 +1,165 @@
+package tlsauth
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCredentials(t *testing.T, ca *CA, name string) *Credentials {
+	t.Helper()
+	creds, err := ca.Credentials(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func newCA(t *testing.T, name string) *CA {
+	t.Helper()
+	ca, err := NewCA(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// handshakePair runs the server side of a TLS handshake with server on a
+// loopback connection while the client side is set up by dial. It returns
+// the server's result.
+func handshakePair(t *testing.T, server *Credentials, dial func(net.Conn) (*tls.Conn, error)) (*tls.Conn, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		tlsConn, err := dial(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer tlsConn.Close()
+		// Echo one message so the server can check the connection works
+		io.CopyN(tlsConn, tlsConn, 5)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		<-clientDone
+	})
+	return server.Server(conn)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCA(t, "swarm")
+	server := newCredentials(t, ca, "seed")
+	client := newCredentials(t, ca, "downloader")
+
+	clientIdentity := make(chan Identity, 1)
+	conn, err := handshakePair(t, server, func(conn net.Conn) (*tls.Conn, error) {
+		tlsConn, err := client.Client(conn)
+		id, _ := PeerIdentity(tlsConn)
+		clientIdentity <- id
+		return tlsConn, err
+	})
+	if err != nil {
+		t.Fatalf("handshake between certificates of one CA failed: %v", err)
+	}
+
+	id, err := PeerIdentity(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Name != "downloader" || len(id.Fingerprint) != 64 {
+		t.Errorf("server sees client as %+v", id)
+	}
+	if id := <-clientIdentity; id.Name != "seed" {
+		t.Errorf("client sees server as %+v", id)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("echo returned %q, %v", buf, err)
+	}
+}
+
+func TestClientWithoutCertificateRejected(t *testing.T) {
+	server := newCredentials(t, newCA(t, "swarm"), "seed")
+	_, err := handshakePair(t, server, func(conn net.Conn) (*tls.Conn, error) {
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12})
+		return tlsConn, tlsConn.Handshake()
+	})
+	if err == nil {
+		t.Fatal("server accepted a client without a certificate")
+	}
+}
+
+func TestCertificateFromOtherCARejected(t *testing.T) {
+	ca := newCA(t, "swarm")
+	server := newCredentials(t, ca, "seed")
+	outsider := newCredentials(t, newCA(t, "other"), "outsider")
+
+	_, err := handshakePair(t, server, func(conn net.Conn) (*tls.Conn, error) {
+		return outsider.Client(conn)
+	})
+	if err == nil {
+		t.Error("server accepted a client certificate from another CA")
+	}
+
+	// The client refuses a server from another CA just the same
+	client := newCredentials(t, ca, "downloader")
+	clientErr := make(chan error, 1)
+	handshakePair(t, outsider, func(conn net.Conn) (*tls.Conn, error) {
+		tlsConn, err := client.Client(conn)
+		clientErr <- err
+		return tlsConn, err
+	})
+	if err := <-clientErr; err == nil {
+		t.Error("client accepted a server certificate from another CA")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ca := newCA(t, "swarm")
+	certPEM, keyPEM, err := ca.Issue("seed", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := map[string][]byte{"ca.pem": ca.CertPEM, "cert.pem": certPEM, "key.pem": keyPEM}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	creds, err := Load(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Certificate.Leaf == nil && len(creds.Certificate.Certificate) == 0 {
+		t.Error("loaded credentials hold no certificate")
+	}
+	if _, err := Load(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("loading a missing CA file succeeded")
+	}
+}
@@ -0,0 +1,209 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sourceFile is a file found while creating a torrent
+type sourceFile struct {
+	// diskPath is empty for padding and symlinks, which are not hashed
+	diskPath string
+	file     File
+}
+
+// collectFiles lists the files below root in path order. Symlinks pointing
+// inside root are recorded as BEP 47 symlinks; others are followed.
+func collectFiles(root string) ([]sourceFile, error) {
+	var files []sourceFile
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		components := strings.Split(filepath.ToSlash(rel), "/")
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if target, ok := symlinkTarget(root, path); ok {
+				attr := "l"
+				if strings.HasPrefix(d.Name(), ".") {
+					attr += "h"
+				}
+				files = append(files, sourceFile{file: File{Path: components, Attr: attr, SymlinkPath: target}})
+				return nil
+			}
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		files = append(files, sourceFile{
+			diskPath: path,
+			file:     File{Path: components, Length: int(info.Size()), Attr: fileAttr(info)},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s contains no files", root)
+	}
+	return files, nil
+}
+
+// symlinkTarget returns the target of a symlink as path components below
+// root, or false if it points outside of root
+func symlinkTarget(root, path string) ([]string, bool) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, false
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return nil, false
+	}
+	rel, err := filepath.Rel(absRoot, absTarget)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	return strings.Split(filepath.ToSlash(rel), "/"), true
+}
+
+// fileAttr returns the BEP 47 attributes of a regular file
+func fileAttr(info fs.FileInfo) string {
+	attr := ""
+	if info.Mode()&0111 != 0 {
+		attr += "x"
+	}
+	if strings.HasPrefix(info.Name(), ".") {
+		attr += "h"
+	}
+	return attr
+}
+
+// alignFiles inserts padding after every file that does not end on a
+// piece boundary, except the last one
+func alignFiles(files []sourceFile, pieceLength int) []sourceFile {
+	var aligned []sourceFile
+	offset := 0
+	for i, f := range files {
+		aligned = append(aligned, f)
+		offset += f.file.Length
+		if i == len(files)-1 || offset%pieceLength == 0 {
+			continue
+		}
+		pad := pieceLength - offset%pieceLength
+		aligned = append(aligned, sourceFile{file: File{
+			Path:   []string{".pad", strconv.Itoa(pad)},
+			Length: pad,
+			Attr:   "p",
+		}})
+		offset += pad
+	}
+	return aligned
+}
+
+func contentLength(files []sourceFile) int64 {
+	var n int64
+	for _, f := range files {
+		n += int64(f.file.Length)
+	}
+	return n
+}
+
+// contentReader concatenates the files of a torrent, opening one file at a
+// time. Padding reads as zeros.
+func contentReader(files []sourceFile) (io.Reader, func()) {
+	var readers []io.Reader
+	var opened []*lazyFile
+	for _, f := range files {
+		switch {
+		case f.file.Length == 0:
+		case f.diskPath == "":
+			readers = append(readers, io.LimitReader(zeros{}, int64(f.file.Length)))
+		default:
+			lf := &lazyFile{path: f.diskPath, remaining: int64(f.file.Length)}
+			opened = append(opened, lf)
+			readers = append(readers, lf)
+		}
+	}
+	closeAll := func() {
+		for _, lf := range opened {
+			lf.close()
+		}
+	}
+	return io.MultiReader(readers...), closeAll
+}
+
+// lazyFile reads the expected number of bytes from a file, opening it on
+// the first read and closing it once they were read. Reading no more than
+// expected keeps a file that grew from shifting the ones after it.
+type lazyFile struct {
+	path      string
+	remaining int64
+	file      *os.File
+	done      bool
+}
+
+func (l *lazyFile) Read(p []byte) (int, error) {
+	if l.done || l.remaining == 0 {
+		l.close()
+		return 0, io.EOF
+	}
+	if l.file == nil {
+		f, err := os.Open(l.path)
+		if err != nil {
+			return 0, err
+		}
+		l.file = f
+	}
+	n, err := l.file.Read(p[:min(int64(len(p)), l.remaining)])
+	l.remaining -= int64(n)
+	if err == io.EOF {
+		// The file shrank since it was listed
+		l.close()
+		return n, io.ErrUnexpectedEOF
+	}
+	if l.remaining == 0 {
+		l.close()
+	}
+	return n, err
+}
+
+func (l *lazyFile) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	l.done = true
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+
+	"tcp-app/internal/atomicfile"
+)
+
+// ErrInfoHashChange is returned by Edit when the requested edits touch the
+// info dictionary and EditOptions.AllowInfoHashChange is not set
+var ErrInfoHashChange = errors.New("edit would change the info hash")
+
+// EditOptions lists the changes Edit makes. Nil fields are left as they
+// are; an empty non-nil slice or empty string removes the key.
+type EditOptions struct {
+	// Trackers replaces announce and announce-list. Each inner slice is a
+	// BEP 12 tier; the first tracker becomes the announce URL.
+	Trackers [][]string
+	// WebSeeds replaces the BEP 19 url-list
+	WebSeeds []string
+	Comment  *string
+
+	// Source and Private live in the info dictionary, so changing them
+	// gives the torrent a new info hash
+	Source  *string
+	Private *bool
+	// AllowInfoHashChange permits edits that change the info hash
+	AllowInfoHashChange bool
+}
+
+// EditResult describes what Edit did
+type EditResult struct {
+	OldInfoHash [20]byte
+	NewInfoHash [20]byte
+	// InfoFields names the requested info dictionary fields that differ
+	// from the current ones
+	InfoFields []string
+}
+
+// InfoHashChanged reports whether the edit produced a new info hash
+func (r EditResult) InfoHashChanged() bool {
+	return r.OldInfoHash != r.NewInfoHash
+}
+
+// Edit rewrites the torrent at path in place. Everything outside the info
+// dictionary may change freely; the info dictionary is copied byte for
+// byte unless Source or Private request a change, which fails with
+// ErrInfoHashChange unless opts allow it.
+func Edit(path string, opts EditOptions) (EditResult, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return EditResult{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return EditResult{}, err
+	}
+	dict, err := rawDict(data)
+	if err != nil {
+		return EditResult{}, fmt.Errorf("error parsing torrent: %v", err)
+	}
+	if dict["info"] == nil {
+		return EditResult{}, fmt.Errorf("torrent has no info dictionary")
+	}
+	result := EditResult{OldInfoHash: sha1.Sum(dict["info"])}
+
+	info, fields, err := editInfo(dict["info"], opts)
+	if err != nil {
+		return result, err
+	}
+	result.InfoFields = fields
+	if len(fields) > 0 && !opts.AllowInfoHashChange {
+		return result, fmt.Errorf("%w: %s", ErrInfoHashChange, strings.Join(fields, ", "))
+	}
+	dict["info"] = info
+	result.NewInfoHash = sha1.Sum(info)
+
+	if opts.Trackers != nil {
+		var tiers [][]string
+		for _, tier := range opts.Trackers {
+			if len(tier) > 0 {
+				tiers = append(tiers, tier)
+			}
+		}
+		delete(dict, "announce")
+		delete(dict, "announce-list")
+		if len(tiers) > 0 {
+			if err := setRaw(dict, "announce", tiers[0][0]); err != nil {
+				return result, err
+			}
+		}
+		// A lone tracker needs no announce-list
+		if len(tiers) > 1 || (len(tiers) == 1 && len(tiers[0]) > 1) {
+			if err := setRaw(dict, "announce-list", tiers); err != nil {
+				return result, err
+			}
+		}
+	}
+	if opts.WebSeeds != nil {
+		delete(dict, "url-list")
+		if len(opts.WebSeeds) > 0 {
+			if err := setRaw(dict, "url-list", opts.WebSeeds); err != nil {
+				return result, err
+			}
+		}
+	}
+	if opts.Comment != nil {
+		delete(dict, "comment")
+		if *opts.Comment != "" {
+			if err := setRaw(dict, "comment", *opts.Comment); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, atomicfile.Write(path, encodeRawDict(dict), stat.Mode().Perm())
+}
+
+// editInfo applies the info dictionary edits and returns the new bytes
+// with the names of the fields that actually changed. Untouched info
+// dictionaries are returned unchanged.
+func editInfo(raw []byte, opts EditOptions) ([]byte, []string, error) {
+	info, err := rawDict(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing info dictionary: %v", err)
+	}
+
+	var fields []string
+	if opts.Source != nil {
+		current := ""
+		if v, ok := info["source"]; ok {
+			current, _, _ = rawString(v, 0)
+		}
+		if current != *opts.Source {
+			fields = append(fields, "source")
+			delete(info, "source")
+			if *opts.Source != "" {
+				if err := setRaw(info, "source", *opts.Source); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if opts.Private != nil {
+		current := string(info["private"]) == "i1e"
+		if current != *opts.Private {
+			fields = append(fields, "private")
+			delete(info, "private")
+			if *opts.Private {
+				info["private"] = []byte("i1e")
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return raw, nil, nil
+	}
+	return encodeRawDict(info), fields, nil
+}
+
+// setRaw bencodes v and stores it under key
+func setRaw(dict map[string][]byte, key string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, v); err != nil {
+		return fmt.Errorf("error encoding %s: %v", key, err)
+	}
+	dict[key] = buf.Bytes()
+	return nil
+}
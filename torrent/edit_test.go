@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testInfo is an info dictionary holding keys the TorrentFile struct does
+// not know, which a decode and re-encode would drop
+const testInfo = "d6:lengthi10e4:name5:a.bin12:piece lengthi16384e6:pieces20:" +
+	"01234567890123456789" + "7:x-extrald1:ai1eei2ee" + "e"
+
+func writeEditTorrent(t *testing.T, extra string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "a.torrent")
+	data := "d8:announce15:http://old/anno" + extra + "4:info" + testInfo + "e"
+	if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEditKeepsInfo(t *testing.T) {
+	comment := "new comment"
+	empty := ""
+	tests := []struct {
+		name  string
+		extra string
+		opts  EditOptions
+		want  map[string]string
+	}{
+		{"single tracker", "", EditOptions{Trackers: [][]string{{"http://a/announce"}}},
+			map[string]string{"announce": "17:http://a/announce", "announce-list": ""}},
+		{"tiers", "", EditOptions{Trackers: [][]string{{"http://a/x", "http://b/x"}, {}, {"http://c/x"}}},
+			map[string]string{"announce": "10:http://a/x", "announce-list": "ll10:http://a/x10:http://b/xel10:http://c/xee"}},
+		{"no trackers", "", EditOptions{Trackers: [][]string{}},
+			map[string]string{"announce": "", "announce-list": ""}},
+		{"web seeds", "", EditOptions{WebSeeds: []string{"http://seed/"}},
+			map[string]string{"url-list": "l12:http://seed/e", "announce": "15:http://old/anno"}},
+		{"comment", "", EditOptions{Comment: &comment},
+			map[string]string{"comment": "11:new comment"}},
+		{"comment removed", "7:comment3:old", EditOptions{Comment: &empty},
+			map[string]string{"comment": ""}},
+		{"same source", "", EditOptions{Source: &empty},
+			map[string]string{"announce": "15:http://old/anno"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEditTorrent(t, tt.extra)
+			result, err := Edit(path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.InfoHashChanged() || result.OldInfoHash != sha1.Sum([]byte(testInfo)) {
+				t.Error("info hash changed")
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dict, err := rawDict(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dict["info"], []byte(testInfo)) {
+				t.Errorf("info dictionary rewritten:\n%s\nwant\n%s", dict["info"], testInfo)
+			}
+			for key, want := range tt.want {
+				if got := string(dict[key]); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+			if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+				t.Errorf("mode %v, want 0640", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestEditInfoHashChange(t *testing.T) {
+	source := "tracker.example"
+	private := true
+
+	path := writeEditTorrent(t, "")
+	before, _ := os.ReadFile(path)
+	_, err := Edit(path, EditOptions{Source: &source, Private: &private})
+	if !errors.Is(err, ErrInfoHashChange) || !strings.Contains(err.Error(), "source, private") {
+		t.Fatalf("edit of info fields returned %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("refused edit modified the torrent")
+	}
+
+	result, err := Edit(path, EditOptions{Source: &source, Private: &private, AllowInfoHashChange: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.InfoHashChanged() {
+		t.Fatal("info hash kept although the info dictionary changed")
+	}
+	data, _ := os.ReadFile(path)
+	dict, _ := rawDict(data)
+	info, err := rawDict(dict["info"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(info["private"]) != "i1e" || string(info["source"]) != "15:tracker.example" || string(info["x-extra"]) != "ld1:ai1eei2ee" {
+		t.Errorf("info dictionary after edit: %s", dict["info"])
+	}
+	if result.NewInfoHash != sha1.Sum(dict["info"]) {
+		t.Error("reported info hash does not match the file")
+	}
+}
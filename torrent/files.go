@@ -0,0 +1,191 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tcp-app/storage"
+)
+
+// FileSpan is the part of one file covered by a byte range of the torrent
+type FileSpan struct {
+	FileIndex int
+	// Path is the file's location relative to the download directory
+	Path string
+	// Offset is the position of the span within the file
+	Offset int64
+	Length int64
+}
+
+// Layout returns the files of the torrent. Single-file torrents report one
+// file without path components.
+func (t *TorrentFile) Layout() []File {
+	if len(t.Files) > 0 {
+		return t.Files
+	}
+	return []File{{Length: t.Length, Attr: t.Attr}}
+}
+
+// IsPadding reports whether a file only aligns the next one to a piece
+// boundary. Padding is all zeros and never written to disk.
+func (f File) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// IsExecutable reports whether a file should be made executable
+func (f File) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+// IsHidden reports whether a file should be hidden
+func (f File) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// IsSymlink reports whether a file is a symlink to SymlinkPath
+func (f File) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// FilePath returns where a file of the torrent lives relative to the
+// download directory. Open rejects path components that could escape the
+// torrent's root directory.
+func (t *TorrentFile) FilePath(f File) string {
+	if len(t.Files) == 0 {
+		return t.Name
+	}
+	return joinPath(t.Name, f.Path)
+}
+
+// joinPath places path components below root
+func joinPath(root string, components []string) string {
+	return filepath.Join(append([]string{root}, components...)...)
+}
+
+// validPathComponent reports whether a file name from a torrent stays in
+// the directory it is placed in
+func validPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// PieceSize returns the length of a piece, which is shorter for the last one
+func (t *TorrentFile) PieceSize(index int) int {
+	start := index * t.PieceLength
+	if start+t.PieceLength > t.Length {
+		return t.Length - start
+	}
+	return t.PieceLength
+}
+
+// FileSpans maps a byte range of the torrent's data onto file ranges
+func (t *TorrentFile) FileSpans(offset, length int64) []FileSpan {
+	var spans []FileSpan
+	end := offset + length
+	for i, f := range t.Layout() {
+		fileStart := int64(f.Offset)
+		fileEnd := fileStart + int64(f.Length)
+		if fileEnd <= offset || fileStart >= end || f.Length == 0 {
+			continue
+		}
+		start := max(offset, fileStart)
+		stop := min(end, fileEnd)
+		spans = append(spans, FileSpan{
+			FileIndex: i,
+			Path:      t.FilePath(f),
+			Offset:    start - fileStart,
+			Length:    stop - start,
+		})
+	}
+	return spans
+}
+
+// PieceSpans maps a piece onto the file ranges it covers
+func (t *TorrentFile) PieceSpans(index int) []FileSpan {
+	return t.FileSpans(int64(index)*int64(t.PieceLength), int64(t.PieceSize(index)))
+}
+
+// StorageLayout maps the torrent's pieces onto its files, placing them at
+// root: the file itself for single-file torrents, or the directory the
+// files go below
+func (t *TorrentFile) StorageLayout(root string) storage.Layout {
+	layout := storage.Layout{PieceLength: int64(t.PieceLength)}
+	for _, f := range t.Layout() {
+		path := root
+		if len(t.Files) > 0 {
+			path = joinPath(root, f.Path)
+		}
+		layout.Files = append(layout.Files, storage.File{
+			Path:    path,
+			Length:  int64(f.Length),
+			Virtual: f.IsPadding() || f.IsSymlink(),
+		})
+	}
+	return layout
+}
+
+// ApplyAttributes creates the symlinks of a torrent written below root and
+// marks its executable files as such. Files for which wanted is false are
+// left alone.
+func (t *TorrentFile) ApplyAttributes(root string, wanted func(index int) bool) error {
+	layout := t.StorageLayout(root)
+	for i, f := range t.Layout() {
+		if wanted != nil && !wanted(i) {
+			continue
+		}
+		path := layout.Files[i].Path
+		switch {
+		case f.IsSymlink():
+			target := joinPath(root, f.SymlinkPath)
+			rel, err := filepath.Rel(filepath.Dir(path), target)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %v", err)
+			}
+			// Replace the link left by an earlier download, but nothing else
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(path)
+			}
+			if err := os.Symlink(rel, path); err != nil {
+				return fmt.Errorf("failed to create symlink: %v", err)
+			}
+		case f.IsExecutable() && !f.IsPadding():
+			if err := os.Chmod(path, 0755); err != nil {
+				return fmt.Errorf("failed to make %s executable: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MergeFiles writes the files marked in wanted, leaving out the others.
+// Only the pieces covering wanted files need to be present.
+func (t *TorrentFile) MergeFiles(outputPath string, pieces map[int]string, wanted []bool) error {
+	st, err := storage.NewFile("", t.StorageLayout(outputPath))
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	for i := range t.PieceHashes {
+		var pos int64
+		for _, span := range t.PieceSpans(i) {
+			if span.FileIndex < len(wanted) && !wanted[span.FileIndex] {
+				pos += span.Length
+				continue
+			}
+			data, exists := pieces[i]
+			if !exists {
+				return fmt.Errorf("missing piece %d", i)
+			}
+			if _, err := st.WriteAt(i, []byte(data[pos:pos+span.Length]), pos); err != nil {
+				return fmt.Errorf("failed to write piece %d: %v", i, err)
+			}
+			pos += span.Length
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// ProgressFunc is called as pieces are hashed with the number of bytes
+// hashed so far and the total. Calls never overlap.
+type ProgressFunc func(done, total int64)
+
+type hashJob struct {
+	index int
+	buf   []byte
+	n     int
+}
+
+// HashPieces reads length bytes from r and returns the SHA-1 of every
+// piece. Reading is sequential while hashing is spread over workers
+// goroutines (one per CPU if workers is 0); only a couple of piece buffers
+// per worker are ever allocated. It stops early when ctx is cancelled.
+func HashPieces(ctx context.Context, r io.Reader, length int64, pieceLength, workers int, progress ProgressFunc) ([][20]byte, error) {
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", pieceLength)
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	numPieces := int((length + int64(pieceLength) - 1) / int64(pieceLength))
+	hashes := make([][20]byte, numPieces)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	free := make(chan []byte, 2*workers)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, pieceLength)
+	}
+	jobs := make(chan hashJob)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		hashed   int64
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				hashes[job.index] = sha1.Sum(job.buf[:job.n])
+				free <- job.buf
+
+				if progress != nil {
+					mu.Lock()
+					hashed += int64(job.n)
+					progress(hashed, length)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Read pieces in order, handing each buffer to a worker
+read:
+	for index := 0; index < numPieces; index++ {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-ctx.Done():
+			break read
+		}
+		size := int(min(int64(pieceLength), length-int64(index)*int64(pieceLength)))
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			fail(fmt.Errorf("error reading piece %d: %v", index, err))
+			break
+		}
+		select {
+		case jobs <- hashJob{index: index, buf: buf, n: size}:
+		case <-ctx.Done():
+			break read
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
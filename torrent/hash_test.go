@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"testing"
+)
+
+// serialHashes hashes data one piece after another
+func serialHashes(data []byte, pieceLength int) [][20]byte {
+	var hashes [][20]byte
+	for len(data) > 0 {
+		n := min(pieceLength, len(data))
+		hashes = append(hashes, sha1.Sum(data[:n]))
+		data = data[n:]
+	}
+	return hashes
+}
+
+func TestHashPieces(t *testing.T) {
+	tests := []struct {
+		name        string
+		length      int
+		pieceLength int
+		workers     int
+	}{
+		{"empty", 0, 16, 4},
+		{"short last piece", 1000, 64, 4},
+		{"exact pieces", 1024, 64, 3},
+		{"single worker", 1000, 64, 1},
+		{"one CPU each", 5000, 128, 0},
+		{"more workers than pieces", 100, 64, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.length)
+			rand.Read(data)
+			var last, calls int64
+			progress := func(done, total int64) {
+				if done < last || total != int64(tt.length) {
+					t.Errorf("progress went from %d to %d of %d", last, done, total)
+				}
+				last = done
+				calls++
+			}
+
+			got, err := HashPieces(context.Background(), bytes.NewReader(data), int64(tt.length), tt.pieceLength, tt.workers, progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := serialHashes(data, tt.pieceLength)
+			if len(got) != len(want) {
+				t.Fatalf("%d hashes, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("piece %d hash differs from serial hashing", i)
+				}
+			}
+			if last != int64(tt.length) || calls != int64(len(want)) {
+				t.Errorf("progress ended at %d after %d calls, want %d after %d", last, calls, tt.length, len(want))
+			}
+		})
+	}
+}
+
+func TestHashPiecesErrors(t *testing.T) {
+	data := make([]byte, 1000)
+	if _, err := HashPieces(context.Background(), bytes.NewReader(data[:500]), 1000, 64, 2, nil); err == nil {
+		t.Error("short input accepted")
+	}
+	if _, err := HashPieces(context.Background(), bytes.NewReader(data), 1000, 0, 2, nil); err == nil {
+		t.Error("zero piece length accepted")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := HashPieces(ctx, bytes.NewReader(data), 1000, 64, 2, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled hashing returned %v", err)
+	}
+}
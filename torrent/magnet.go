@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net/url"
+)
+
+// InfoHashHex returns the info hash in hexadecimal
+func (t *TorrentFile) InfoHashHex() string {
+	return hex.EncodeToString(t.InfoHash[:])
+}
+
+// InfoHashBase32 returns the info hash in the base32 form some magnet
+// links use
+func (t *TorrentFile) InfoHashBase32() string {
+	return base32.StdEncoding.EncodeToString(t.InfoHash[:])
+}
+
+// Trackers returns every tracker of the torrent once, announce-list tiers
+// first as BEP 12 asks clients to prefer them
+func (t *TorrentFile) Trackers() []string {
+	seen := make(map[string]bool)
+	var trackers []string
+	add := func(tracker string) {
+		if tracker != "" && !seen[tracker] {
+			seen[tracker] = true
+			trackers = append(trackers, tracker)
+		}
+	}
+	for _, tier := range t.AnnounceList {
+		for _, tracker := range tier {
+			add(tracker)
+		}
+	}
+	add(t.Announce)
+	return trackers
+}
+
+// Magnet returns a magnet link for the torrent with its name, trackers and
+// web seeds
+func (t *TorrentFile) Magnet() string {
+	link := "magnet:?xt=urn:btih:" + t.InfoHashHex()
+	if t.Name != "" {
+		link += "&dn=" + url.QueryEscape(t.Name)
+	}
+	for _, tracker := range t.Trackers() {
+		link += "&tr=" + url.QueryEscape(tracker)
+	}
+	for _, seed := range t.URLList {
+		link += "&ws=" + url.QueryEscape(seed)
+	}
+	return link
+}
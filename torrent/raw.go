@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// rawDict splits a bencoded dictionary into its keys and the undecoded
+// bytes of each value, so values can be kept byte for byte
+func rawDict(data []byte) (map[string][]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("not a bencoded dictionary")
+	}
+	dict := make(map[string][]byte)
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		key, next, err := rawString(data, pos)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dictionary key: %v", err)
+		}
+		end, err := skipValue(data, next)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %v", key, err)
+		}
+		dict[key] = data[next:end]
+		pos = end
+	}
+	if pos >= len(data) {
+		return nil, fmt.Errorf("unterminated dictionary")
+	}
+	return dict, nil
+}
+
+// rawString parses the bencoded string at pos and returns it with the
+// position after it
+func rawString(data []byte, pos int) (string, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 1 {
+		return "", 0, fmt.Errorf("malformed string at %d", pos)
+	}
+	n, err := strconv.Atoi(string(data[pos : pos+colon]))
+	start := pos + colon + 1
+	if err != nil || n < 0 || start+n > len(data) {
+		return "", 0, fmt.Errorf("malformed string length at %d", pos)
+	}
+	return string(data[start : start+n]), start + n, nil
+}
+
+// skipValue returns the position just after the bencoded value at pos
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			end, err := skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = end
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("unterminated %c at %d", c, pos)
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := rawString(data, pos)
+		return end, err
+	default:
+		return 0, fmt.Errorf("unexpected byte %q at %d", c, pos)
+	}
+}
+
+// encodeRawDict writes a dictionary from undecoded values with its keys
+// in the sorted order bencoding requires
+func encodeRawDict(dict map[string][]byte) []byte {
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteByte('d')
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%d:%s", len(key), key)
+		buf.Write(dict[key])
+	}
+	buf.WriteByte('e')
+	return buf.Bytes()
+}
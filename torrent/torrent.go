@@ -1,15 +1,19 @@
 package torrent
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/jackpal/bencode-go"
+
+	"tcp-app/storage"
 )
 
 // TorrentFile encodes the metadata from a .torrent file
@@ -20,35 +24,117 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Private     bool
+	// Source is the info dictionary's source tag, which private trackers
+	// use to give a torrent a distinct info hash
+	Source string
+	// Files is set for multi-file torrents, in which case Name is the
+	// root directory and Length the total size of all files
+	Files []File
+	// URLList holds BEP 19 web seeds and HTTPSeeds BEP 17 seeds
+	URLList   []string
+	HTTPSeeds []string
+	// Attr holds the BEP 47 attributes of a single-file torrent
+	Attr string
+	// AnnounceList holds BEP 12 tracker tiers
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+}
+
+// File is one file of a multi-file torrent
+type File struct {
+	// Path holds the path components below the torrent's root directory
+	Path   []string
+	Length int
+	// Offset is where the file starts in the torrent's concatenated data
+	Offset int
+	// Attr holds BEP 47 attributes: p(adding), x(ecutable), h(idden) and
+	// l (symlink, pointing at SymlinkPath below the root directory)
+	Attr        string
+	SymlinkPath []string
+}
+
+type bencodeFile struct {
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private,omitempty"`
+	Attr        string        `bencode:"attr,omitempty"`
+	Source      string        `bencode:"source,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	Info         bencodeInfo `bencode:"info"`
+	URLList      []string    `bencode:"url-list,omitempty"`
+	HTTPSeeds    []string    `bencode:"httpseeds,omitempty"`
 }
 
 // Open parses a torrent file
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
 
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	fmt.Println(bto.toTorrentFile())
-	return bto.toTorrentFile()
+	// url-list may be a single string or a list, which the struct
+	// decoder cannot express
+	if raw, err := bencode.Decode(bytes.NewReader(data)); err == nil {
+		if dict, ok := raw.(map[string]interface{}); ok {
+			bto.URLList = stringOrList(dict["url-list"])
+			bto.HTTPSeeds = stringOrList(dict["httpseeds"])
+		}
+	}
+	t, err := bto.toTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	// Hash the info dictionary as stored, since re-encoding the decoded
+	// struct drops keys it does not know about
+	if dict, err := rawDict(data); err == nil && dict["info"] != nil {
+		t.InfoHash = sha1.Sum(dict["info"])
+	}
+	return t, nil
+}
+
+// stringOrList converts a bencoded string or list of strings to a slice
+func stringOrList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
 }
 
 func (i *bencodeInfo) hash() ([20]byte, error) {
@@ -87,68 +173,212 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 		return TorrentFile{}, err
 	}
 	t := TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       bto.Info.Length,
+		Name:         bto.Info.Name,
+		Private:      bto.Info.Private == 1,
+		URLList:      bto.URLList,
+		HTTPSeeds:    bto.HTTPSeeds,
+		Attr:         bto.Info.Attr,
+		Source:       bto.Info.Source,
+		AnnounceList: bto.AnnounceList,
+		Comment:      bto.Comment,
+		CreatedBy:    bto.CreatedBy,
+	}
+	if bto.CreationDate > 0 {
+		t.CreationDate = time.Unix(bto.CreationDate, 0)
+	}
+	if !validPathComponent(t.Name) {
+		return TorrentFile{}, fmt.Errorf("invalid torrent name %q", t.Name)
+	}
+	if len(bto.Info.Files) > 0 {
+		offset := 0
+		for _, f := range bto.Info.Files {
+			if err := validatePath(f.Path); err != nil {
+				return TorrentFile{}, err
+			}
+			if f.Length < 0 {
+				return TorrentFile{}, fmt.Errorf("negative length for file %q", strings.Join(f.Path, "/"))
+			}
+			if strings.Contains(f.Attr, "l") {
+				if err := validatePath(f.SymlinkPath); err != nil {
+					return TorrentFile{}, fmt.Errorf("invalid symlink target: %v", err)
+				}
+			}
+			t.Files = append(t.Files, File{
+				Path:        f.Path,
+				Length:      f.Length,
+				Offset:      offset,
+				Attr:        f.Attr,
+				SymlinkPath: f.SymlinkPath,
+			})
+			offset += f.Length
+		}
+		t.Length = offset
+	}
+	if err := t.validatePieces(); err != nil {
+		return TorrentFile{}, err
 	}
 	return t, nil
 }
 
-// splitFileIntoPieces reads a file and splits it into pieces of the given length.
-func splitFileIntoPieces(file *os.File, pieceLength int) ([][]byte, error) {
-	var pieces [][]byte
-	buf := make([]byte, pieceLength)
-	for {
-		n, err := file.Read(buf)
-		if n == 0 {
-			break
-		}
-		if err != nil && err != io.EOF {
-			return nil, err
+// validatePieces checks that the piece hashes cover exactly the torrent's
+// data, so every piece index maps onto a valid range
+func (t *TorrentFile) validatePieces() error {
+	if t.PieceLength <= 0 {
+		return fmt.Errorf("invalid piece length %d", t.PieceLength)
+	}
+	if t.Length < 0 {
+		return fmt.Errorf("invalid length %d", t.Length)
+	}
+	want := (t.Length + t.PieceLength - 1) / t.PieceLength
+	if len(t.PieceHashes) != want {
+		return fmt.Errorf("torrent has %d piece hashes, %d bytes need %d", len(t.PieceHashes), t.Length, want)
+	}
+	return nil
+}
+
+// validatePath checks the path of a file in a multi-file torrent, so that
+// it cannot be empty or point outside the torrent's root directory
+func validatePath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("empty file path")
+	}
+	for _, p := range path {
+		if !validPathComponent(p) {
+			return fmt.Errorf("invalid file path %q", strings.Join(path, "/"))
 		}
-		piece := make([]byte, n)
-		copy(piece, buf[:n])
-		pieces = append(pieces, piece)
 	}
-	return pieces, nil
+	return nil
+}
+
+// CreateOptions controls how a torrent is created
+type CreateOptions struct {
+	// WebSeeds are listed in the torrent's url-list
+	WebSeeds []string
+	// Workers is the number of hashing goroutines, one per CPU if zero
+	Workers int
+	// Progress is called as pieces are hashed
+	Progress ProgressFunc
+	// Align pads every file of a directory to a piece boundary with BEP 47
+	// padding files, so identical files always hash to identical pieces
+	Align bool
+	// PieceLength overrides the piece length picked from the content size.
+	// It must be a power of two of at least MinPieceLength.
+	PieceLength int
+	// Tracker is the announce URL written by CreateContext, DefaultTracker
+	// if empty
+	Tracker string
+}
+
+// CreatedBy is recorded in the torrents we create
+const CreatedBy = "tcp-app 0.1"
+
+// DefaultTracker is announced to by torrents created without a tracker
+const DefaultTracker = "http://localhost:8080/announce"
+
+const (
+	// MinPieceLength is the smallest piece length torrents are created with
+	MinPieceLength = 16 * 1024
+	// maxAutoPieceLength caps the piece length picked automatically
+	maxAutoPieceLength = 16 * 1024 * 1024
+	// targetPieceCount is roughly how many pieces automatic selection aims for
+	targetPieceCount = 1500
+)
+
+// AutoPieceLength picks a power-of-two piece length for content of the
+// given size, aiming for about targetPieceCount pieces
+func AutoPieceLength(size int64) int {
+	pieceLength := MinPieceLength
+	for pieceLength < maxAutoPieceLength && size/int64(pieceLength) > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// ValidatePieceLength checks that a piece length is a power of two of at
+// least MinPieceLength
+func ValidatePieceLength(pieceLength int) error {
+	if pieceLength < MinPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("piece length %d must be a power of two of at least %d", pieceLength, MinPieceLength)
+	}
+	return nil
 }
 
 // CreateTorrent builds a TorrentFile from a file path and tracker URL
 func CreateTorrent(path string, trackerURL string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	return CreateTorrentContext(context.Background(), path, trackerURL, CreateOptions{})
+}
+
+// CreateTorrentContext builds a TorrentFile like CreateTorrent, hashing the
+// file in parallel while it is read. Cancelling ctx aborts the hashing.
+func CreateTorrentContext(ctx context.Context, path string, trackerURL string, opts CreateOptions) (TorrentFile, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
+	abs, err := filepath.Abs(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
+	var files []sourceFile
+	if info.IsDir() {
+		files, err = collectFiles(path)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	} else {
+		files = []sourceFile{{diskPath: path, file: File{Length: int(info.Size()), Attr: fileAttr(info)}}}
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = AutoPieceLength(contentLength(files))
+	} else if err := ValidatePieceLength(pieceLength); err != nil {
+		return TorrentFile{}, err
+	}
+	if info.IsDir() && opts.Align {
+		files = alignFiles(files, pieceLength)
+	}
+
 	// Create bencode structs
 	bto := bencodeTorrent{
 		Announce: trackerURL,
 		Info: bencodeInfo{
-			PieceLength: 262144, // Standard piece length of 256KB
-			Name:        fileInfo.Name(),
-			Length:      int(fileInfo.Size()),
+			PieceLength: pieceLength,
+			Name:        filepath.Base(abs),
 		},
+		URLList:      opts.WebSeeds,
+		CreatedBy:    CreatedBy,
+		CreationDate: time.Now().Unix(),
+	}
+	if info.IsDir() {
+		for _, f := range files {
+			bto.Info.Files = append(bto.Info.Files, bencodeFile{
+				Length:      f.file.Length,
+				Path:        f.file.Path,
+				Attr:        f.file.Attr,
+				SymlinkPath: f.file.SymlinkPath,
+			})
+		}
+	} else {
+		bto.Info.Length = files[0].file.Length
+		bto.Info.Attr = files[0].file.Attr
 	}
 
-	// Use the new function to split the file into pieces
-	pieces, err := splitFileIntoPieces(file, bto.Info.PieceLength)
+	content, closeContent := contentReader(files)
+	defer closeContent()
+	length := contentLength(files)
+	hashes, err := HashPieces(ctx, bufio.NewReaderSize(content, 1<<20), length, pieceLength, opts.Workers, opts.Progress)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-
-	// Calculate pieces hashes
-	var piecesHashes []byte
-	for _, piece := range pieces {
-		hash := sha1.Sum(piece)
+	piecesHashes := make([]byte, 0, len(hashes)*20)
+	for _, hash := range hashes {
 		piecesHashes = append(piecesHashes, hash[:]...)
 	}
 	bto.Info.Pieces = string(piecesHashes)
@@ -158,14 +388,28 @@ func CreateTorrent(path string, trackerURL string) (TorrentFile, error) {
 
 // StreamFilePieces streams file pieces to a client without hashing
 func StreamFilePieces(filePath string, pieceLength int) ([][]byte, error) {
-	file, err := os.Open(filePath)
+	info, err := os.Stat(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	layout := storage.Layout{
+		PieceLength: int64(pieceLength),
+		Files:       []storage.File{{Path: filePath, Length: info.Size()}},
+	}
+	st, err := storage.NewFile("", layout)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
 
-	// Use the same function to split the file into pieces
-	return splitFileIntoPieces(file, pieceLength)
+	pieces := make([][]byte, layout.NumPieces())
+	for i := range pieces {
+		pieces[i] = make([]byte, layout.PieceSize(i))
+		if _, err := st.ReadAt(i, pieces[i], 0); err != nil {
+			return nil, err
+		}
+	}
+	return pieces, nil
 }
 
 // Create saves a TorrentFile as a .torrent file
@@ -189,117 +433,100 @@ func (t *TorrentFile) createTorrentFile(path string) error {
 			PieceLength: t.PieceLength,
 			Length:      t.Length,
 			Name:        t.Name,
+			Attr:        t.Attr,
+			Source:      t.Source,
 		},
+		URLList:      t.URLList,
+		HTTPSeeds:    t.HTTPSeeds,
+		AnnounceList: t.AnnounceList,
+		Comment:      t.Comment,
+		CreatedBy:    t.CreatedBy,
+	}
+	if !t.CreationDate.IsZero() {
+		bto.CreationDate = t.CreationDate.Unix()
+	}
+	if len(t.Files) > 0 {
+		bto.Info.Length = 0
+		bto.Info.Attr = ""
+		for _, f := range t.Files {
+			bto.Info.Files = append(bto.Info.Files, bencodeFile{
+				Length:      f.Length,
+				Path:        f.Path,
+				Attr:        f.Attr,
+				SymlinkPath: f.SymlinkPath,
+			})
+		}
+	}
+	if t.Private {
+		bto.Info.Private = 1
 	}
 
 	return bencode.Marshal(file, bto)
 }
 
-func Create(path string) (torrentPath string, err error) {
-	trackerURL := "http://localhost:8080/announce"
-	torrentFile, err := CreateTorrent(path, trackerURL)
-	if err != nil {
-		return "", err
-	}
-	torrentFileName := fmt.Sprintf("%s.torrent", path)
-	err = torrentFile.createTorrentFile(torrentFileName)
-	if err != nil {
-		return "", err
-	}
+// Create writes a .torrent for path, listing webSeeds in its url-list
+func Create(path string, webSeeds ...string) (torrentPath string, err error) {
+	return CreateContext(context.Background(), path, CreateOptions{WebSeeds: webSeeds})
+}
 
-	torrentInfo := map[string]string{
-		"FilePath": path,
-		"FileName": torrentFile.Name,
-		"InfoHash": fmt.Sprintf("%x", torrentFile.InfoHash),
-		// Print the list of piece hashes
-		"PieceHashes": fmt.Sprintf("%x", torrentFile.PieceHashes),
+// CreateContext writes a .torrent for path next to it. Seeding it is up to
+// the caller.
+func CreateContext(ctx context.Context, path string, opts CreateOptions) (torrentPath string, err error) {
+	trackerURL := opts.Tracker
+	if trackerURL == "" {
+		trackerURL = DefaultTracker
 	}
-	jsonData, err := json.Marshal(torrentInfo)
+	torrentFile, err := CreateTorrentContext(ctx, path, trackerURL, opts)
 	if err != nil {
 		return "", err
 	}
-	err = os.WriteFile("torrent_info.json", jsonData, 0644)
+	torrentFileName := fmt.Sprintf("%s.torrent", filepath.Clean(path))
+	err = torrentFile.createTorrentFile(torrentFileName)
 	if err != nil {
 		return "", err
 	}
 	return torrentFileName, nil
 }
 
+// ReadPiece reads a piece from the downloaded files and verifies its hash
 func (t *TorrentFile) ReadPiece(index int) ([]byte, error) {
 	// Validate piece index
 	if index < 0 || index >= len(t.PieceHashes) {
 		return nil, fmt.Errorf("invalid piece index %d", index)
 	}
 
-	// Open the underlying file
-	file, err := os.Open(t.Name)
+	st, err := storage.NewFile("", t.StorageLayout(t.Name))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	// Calculate piece size and offset
-	pieceOffset := int64(index * t.PieceLength)
-	pieceSize := t.PieceLength
+	defer st.Close()
 
-	// Handle last piece, which might be smaller
-	if index == len(t.PieceHashes)-1 {
-		lastPieceSize := t.Length - (index * t.PieceLength)
-		if lastPieceSize < pieceSize {
-			pieceSize = lastPieceSize
-		}
-	}
-
-	// Seek to the piece location
-	_, err = file.Seek(pieceOffset, io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read the piece
-	piece := make([]byte, pieceSize)
-	n, err := io.ReadFull(file, piece)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+	piece := make([]byte, t.PieceSize(index))
+	if _, err := st.ReadAt(index, piece, 0); err != nil {
 		return nil, err
 	}
 
 	// Verify piece hash
-	hash := sha1.Sum(piece[:n])
+	hash := sha1.Sum(piece)
 	if !bytes.Equal(hash[:], t.PieceHashes[index][:]) {
 		return nil, fmt.Errorf("piece %d failed hash verification", index)
 	}
 
-	return piece[:n], nil
+	return piece, nil
 }
 
-// MergePieces combines pieces into a single file
+// MergePieces combines pieces into a single file. For multi-file torrents
+// outputPath is the root directory the files are written below.
 func (t *TorrentFile) MergePieces(outputPath string, pieces map[int]string) error {
-	file, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
-	}
-	defer file.Close()
-
-	// Write pieces in order
-	for i := 0; i < len(t.PieceHashes); i++ {
-		data, exists := pieces[i]
-		if !exists {
-			return fmt.Errorf("missing piece %d", i)
-		}
-		if _, err := file.WriteString(data); err != nil {
-			return fmt.Errorf("failed to write piece %d: %v", i, err)
-		}
-	}
-
-	return nil
+	return t.MergeFiles(outputPath, pieces, nil)
 }
 
 // TestSplitAndMerge tests the split and merge functionality
 func TestSplitAndMerge(filepath string) error {
-	// Create a temporary torrent file structure
-	t := &TorrentFile{
-		PieceLength: 256 * 1024, // 256KB pieces
-		Name:        filepath,
+	// Describe the file the way create would, including its piece length
+	t, err := CreateTorrent(filepath, "")
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %v", err)
 	}
 
 	// Use StreamFilePieces to split the file
@@ -308,12 +535,13 @@ func TestSplitAndMerge(filepath string) error {
 		return fmt.Errorf("failed to split file: %v", err)
 	}
 
-	// Convert pieces to map and calculate hashes
+	// Convert pieces to map and check them against the hashes
 	pieces := make(map[int]string)
 	for i, piece := range pieceBytes {
 		pieces[i] = string(piece)
-		pieceHash := sha1.Sum(piece)
-		t.PieceHashes = append(t.PieceHashes, pieceHash)
+		if sha1.Sum(piece) != t.PieceHashes[i] {
+			return fmt.Errorf("piece %d does not match its hash", i)
+		}
 	}
 
 	// Get extension by splitting on dots and taking the last part
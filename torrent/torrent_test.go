@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutoPieceLength(t *testing.T) {
+	const (
+		KiB = 1024
+		MiB = 1024 * KiB
+		GiB = 1024 * MiB
+	)
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MinPieceLength},
+		{MiB, MinPieceLength},
+		{targetPieceCount * MinPieceLength, MinPieceLength},
+		{targetPieceCount*MinPieceLength + MinPieceLength, 32 * KiB},
+		{700 * MiB, 512 * KiB},
+		{10 * GiB, 8 * MiB},
+		{1024 * GiB, maxAutoPieceLength},
+	}
+	for _, tt := range tests {
+		got := AutoPieceLength(tt.size)
+		if got != tt.want {
+			t.Errorf("AutoPieceLength(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+		if err := ValidatePieceLength(got); err != nil {
+			t.Errorf("AutoPieceLength(%d) = %d is invalid: %v", tt.size, got, err)
+		}
+	}
+}
+
+func TestValidatePieceLength(t *testing.T) {
+	tests := []struct {
+		pieceLength int
+		ok          bool
+	}{
+		{MinPieceLength, true},
+		{4 * 1024 * 1024, true},
+		{MinPieceLength / 2, false},
+		{0, false},
+		{-MinPieceLength, false},
+		{3 * MinPieceLength, false},
+	}
+	for _, tt := range tests {
+		if err := ValidatePieceLength(tt.pieceLength); (err == nil) != tt.ok {
+			t.Errorf("ValidatePieceLength(%d) = %v", tt.pieceLength, err)
+		}
+	}
+}
+
+func TestCreatePieceLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, make([]byte, 100*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		override int
+		want     int
+	}{
+		{0, MinPieceLength},
+		{64 * 1024, 64 * 1024},
+		{3000, 0},
+	}
+	for _, tt := range tests {
+		tf, err := CreateTorrentContext(context.Background(), path, "", CreateOptions{PieceLength: tt.override})
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("piece length %d accepted", tt.override)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tf.PieceLength != tt.want || len(tf.PieceHashes) != (100*1024+tt.want-1)/tt.want {
+			t.Errorf("override %d: piece length %d with %d pieces", tt.override, tf.PieceLength, len(tf.PieceHashes))
+		}
+	}
+}
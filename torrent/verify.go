@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"runtime"
+	"sort"
+	"sync"
+
+	"tcp-app/storage"
+)
+
+// VerifyOptions controls how local data is checked
+type VerifyOptions struct {
+	// Workers is the number of hashing goroutines, one per CPU if zero
+	Workers int
+	// Progress is called as pieces are checked
+	Progress ProgressFunc
+}
+
+// VerifyResult describes how local data compares to a torrent
+type VerifyResult struct {
+	Pieces int
+	// Missing pieces could not be read, because files are absent or short
+	Missing []int
+	// Corrupt pieces were read but do not match their hash
+	Corrupt []int
+	// Damaged lists the file ranges covered by missing and corrupt pieces
+	Damaged []DamagedRange
+}
+
+// DamagedRange is a byte range of a file that failed verification
+type DamagedRange struct {
+	Path    string
+	Start   int64
+	End     int64 // exclusive
+	Missing bool
+}
+
+// OK reports whether every piece was found and matched its hash
+func (r VerifyResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// Verify hash-checks the data of t stored at path: the file itself for
+// single-file torrents, or the directory holding the files. Pieces are
+// checked in parallel. The data is only read, so missing files are
+// reported as missing pieces rather than created.
+func Verify(ctx context.Context, t *TorrentFile, path string, opts VerifyOptions) (VerifyResult, error) {
+	result := VerifyResult{Pieces: len(t.PieceHashes)}
+	st := storage.OpenFile("", t.StorageLayout(path))
+	defer st.Close()
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	indexes := make(chan int)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		checked int64
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, t.PieceLength)
+			for index := range indexes {
+				data := buf[:t.PieceSize(index)]
+				_, err := st.ReadAt(index, data, 0)
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					result.Missing = append(result.Missing, index)
+				case sha1.Sum(data) != t.PieceHashes[index]:
+					result.Corrupt = append(result.Corrupt, index)
+				}
+				checked += int64(len(data))
+				if opts.Progress != nil {
+					opts.Progress(checked, int64(t.Length))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for index := range t.PieceHashes {
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	sort.Ints(result.Missing)
+	sort.Ints(result.Corrupt)
+	result.Damaged = t.damagedRanges(path, result.Missing, result.Corrupt)
+	return result, nil
+}
+
+// damagedRanges maps bad pieces onto file ranges, merging adjacent ones
+func (t *TorrentFile) damagedRanges(root string, missing, corrupt []int) []DamagedRange {
+	type badPiece struct {
+		index   int
+		missing bool
+	}
+	var bad []badPiece
+	for _, index := range missing {
+		bad = append(bad, badPiece{index, true})
+	}
+	for _, index := range corrupt {
+		bad = append(bad, badPiece{index, false})
+	}
+	sort.Slice(bad, func(i, j int) bool { return bad[i].index < bad[j].index })
+
+	layout := t.Layout()
+	paths := t.StorageLayout(root).Files
+	var ranges []DamagedRange
+	for _, piece := range bad {
+		for _, span := range t.PieceSpans(piece.index) {
+			if layout[span.FileIndex].IsPadding() {
+				continue
+			}
+			r := DamagedRange{
+				Path:    paths[span.FileIndex].Path,
+				Start:   span.Offset,
+				End:     span.Offset + span.Length,
+				Missing: piece.missing,
+			}
+			if n := len(ranges); n > 0 {
+				last := &ranges[n-1]
+				if last.Path == r.Path && last.End == r.Start && last.Missing == r.Missing {
+					last.End = r.End
+					continue
+				}
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTree writes files of the given sizes below root
+func writeTree(t *testing.T, root string, sizes map[string]int) {
+	t.Helper()
+	for name, size := range sizes {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func createTestTorrent(t *testing.T, path string) TorrentFile {
+	t.Helper()
+	tf, err := CreateTorrentContext(context.Background(), path, "", CreateOptions{PieceLength: MinPieceLength})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(root string) error
+		missing []int
+		corrupt []int
+	}{
+		{"intact", func(string) error { return nil }, nil, nil},
+		{"missing file", func(root string) error {
+			return os.Remove(filepath.Join(root, "b.bin"))
+		}, []int{1, 2}, nil},
+		{"truncated file", func(root string) error {
+			return os.Truncate(filepath.Join(root, "b.bin"), 100)
+		}, []int{1, 2}, nil},
+		{"flipped byte", func(root string) error {
+			f, err := os.OpenFile(filepath.Join(root, "b.bin"), os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteAt([]byte{'x'}, MinPieceLength)
+			return err
+		}, nil, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "release")
+			// Piece 1 spans both files, piece 2 is the rest of b.bin
+			writeTree(t, root, map[string]int{"a.bin": MinPieceLength + 10, "b.bin": MinPieceLength + 10})
+			tf := createTestTorrent(t, root)
+			if err := tt.damage(root); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := Verify(context.Background(), &tf, root, VerifyOptions{Workers: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Pieces != 3 || !equalInts(result.Missing, tt.missing) || !equalInts(result.Corrupt, tt.corrupt) {
+				t.Errorf("got %d pieces, missing %v, corrupt %v; want missing %v, corrupt %v",
+					result.Pieces, result.Missing, result.Corrupt, tt.missing, tt.corrupt)
+			}
+			if result.OK() != (tt.missing == nil && tt.corrupt == nil) {
+				t.Errorf("OK() = %v", result.OK())
+			}
+		})
+	}
+}
+
+func TestVerifyCreatesNothing(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	writeTree(t, root, map[string]int{"a.bin": 100, "sub/b.bin": 200, "empty": 0})
+	tf := createTestTorrent(t, root)
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Verify(context.Background(), &tf, root, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Missing) != result.Pieces {
+		t.Errorf("%d of %d pieces missing", len(result.Missing), result.Pieces)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("verify created %s: %v", root, err)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Announce events
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// AnnounceRequest describes this client to a tracker
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	// Event is one of the Event constants, or empty for regular announces
+	Event string
+}
+
+// AnnounceResponse holds what the tracker answered
+type AnnounceResponse struct {
+	Interval time.Duration
+	Peers    []*net.TCPAddr
+}
+
+// NewPeerID returns a random Azureus-style peer ID
+func NewPeerID() [20]byte {
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+	var id [20]byte
+	copy(id[:], "-TA0001-")
+	rand.Read(id[8:])
+	for i := 8; i < len(id); i++ {
+		id[i] = alphabet[int(id[i])%len(alphabet)]
+	}
+	return id
+}
+
+// announceClient is shared by announces without their own TLS
+// configuration, so connections to a tracker are reused between announces
+var announceClient = &http.Client{}
+
+// Announce sends a request to an HTTP(S) tracker. tlsConfig is used for
+// https trackers and may be nil.
+func Announce(ctx context.Context, trackerURL string, req AnnounceRequest, tlsConfig *tls.Config) (*AnnounceResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+	// info_hash and peer_id are raw bytes, escaped one by one; any query
+	// the tracker URL already has is kept
+	query := u.RawQuery
+	if query != "" {
+		query += "&"
+	}
+	query += "info_hash=" + url.QueryEscape(string(req.InfoHash[:])) +
+		"&peer_id=" + url.QueryEscape(string(req.PeerID[:])) +
+		"&port=" + strconv.Itoa(req.Port) +
+		"&uploaded=" + strconv.FormatInt(req.Uploaded, 10) +
+		"&downloaded=" + strconv.FormatInt(req.Downloaded, 10) +
+		"&left=" + strconv.FormatInt(req.Left, 10) +
+		"&compact=1"
+	if req.Event != "" {
+		query += "&event=" + req.Event
+	}
+	u.RawQuery = query
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := announceClient
+	if tlsConfig != nil {
+		// A transport of its own must not keep connections open once done
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		defer transport.CloseIdleConnections()
+		httpClient = &http.Client{Transport: transport}
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("announce failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("announce failed: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading announce response: %v", err)
+	}
+	return parseAnnounceResponse(body)
+}
+
+func parseAnnounceResponse(body []byte) (*AnnounceResponse, error) {
+	raw, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce response: %v", err)
+	}
+	dict, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid announce response")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker refused announce: %s", reason)
+	}
+
+	resp := &AnnounceResponse{Interval: DefaultInterval}
+	if interval, ok := dict["interval"].(int64); ok && interval > 0 {
+		resp.Interval = time.Duration(interval) * time.Second
+	}
+	switch peers := dict["peers"].(type) {
+	case string:
+		resp.Peers = append(resp.Peers, compactPeers([]byte(peers), net.IPv4len)...)
+	case []interface{}:
+		for _, item := range peers {
+			p, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ipStr, _ := p["ip"].(string)
+			port, _ := p["port"].(int64)
+			if ip := net.ParseIP(ipStr); ip != nil && port > 0 {
+				resp.Peers = append(resp.Peers, &net.TCPAddr{IP: ip, Port: int(port)})
+			}
+		}
+	}
+	if peers6, ok := dict["peers6"].(string); ok {
+		resp.Peers = append(resp.Peers, compactPeers([]byte(peers6), net.IPv6len)...)
+	}
+	return resp, nil
+}
+
+// compactPeers decodes addresses packed as IP followed by a 2-byte port
+func compactPeers(data []byte, ipLen int) []*net.TCPAddr {
+	var peers []*net.TCPAddr
+	for i := 0; i+ipLen+2 <= len(data); i += ipLen + 2 {
+		ip := make(net.IP, ipLen)
+		copy(ip, data[i:i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen:])
+		peers = append(peers, &net.TCPAddr{IP: ip, Port: int(port)})
+	}
+	return peers
+}
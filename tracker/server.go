@@ -0,0 +1,217 @@
+// Package tracker implements a minimal HTTP tracker and the client side of
+// announcing to one (BEP 3, with compact peer lists from BEP 23 and BEP 7)
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+
+	"tcp-app/tlsauth"
+)
+
+// DefaultInterval is how often peers are asked to announce again
+const DefaultInterval = 30 * time.Minute
+
+// maxPeers bounds the number of peers returned per announce
+const maxPeers = 50
+
+// Server tracks the peers of every torrent announced to it. Peers that do
+// not announce again within two intervals are forgotten.
+type Server struct {
+	Interval time.Duration
+	// TrustedProxies may report a peer's address with the ip parameter.
+	// Other clients are registered at the address they connect from,
+	// unless both it and the reported one are private.
+	TrustedProxies []*net.IPNet
+
+	mu     sync.Mutex
+	swarms map[[20]byte]map[string]*swarmPeer
+}
+
+type swarmPeer struct {
+	addr   *net.TCPAddr
+	peerID string
+	left   int64
+	seen   time.Time
+}
+
+type failureResponse struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+type compactResponse struct {
+	Interval   int    `bencode:"interval"`
+	Complete   int    `bencode:"complete"`
+	Incomplete int    `bencode:"incomplete"`
+	Peers      string `bencode:"peers"`
+	Peers6     string `bencode:"peers6,omitempty"`
+}
+
+type dictPeer struct {
+	IP     string `bencode:"ip"`
+	PeerID string `bencode:"peer id"`
+	Port   int    `bencode:"port"`
+}
+
+type dictResponse struct {
+	Interval   int        `bencode:"interval"`
+	Complete   int        `bencode:"complete"`
+	Incomplete int        `bencode:"incomplete"`
+	Peers      []dictPeer `bencode:"peers"`
+}
+
+// NewServer creates a tracker with the default announce interval
+func NewServer() *Server {
+	return &Server{
+		Interval: DefaultInterval,
+		swarms:   make(map[[20]byte]map[string]*swarmPeer),
+	}
+}
+
+// ListenAndServe runs a tracker on address, serving /announce. With creds
+// the tracker speaks HTTPS and requires client certificates signed by the
+// CA, like the peers of a private swarm. trustedProxies are the networks
+// allowed to set a peer's address, see Server.TrustedProxies.
+func ListenAndServe(address string, creds *tlsauth.Credentials, trustedProxies []*net.IPNet) error {
+	tracker := NewServer()
+	tracker.TrustedProxies = trustedProxies
+	mux := http.NewServeMux()
+	mux.Handle("/announce", tracker)
+	srv := &http.Server{Addr: address, Handler: mux}
+	fmt.Printf("Tracker listening on %s\n", address)
+	if creds == nil {
+		return srv.ListenAndServe()
+	}
+	srv.TLSConfig = creds.ServerConfig()
+	return srv.ListenAndServeTLS("", "")
+}
+
+// ServeHTTP handles an announce request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != 20 {
+		writeBencode(w, failureResponse{"invalid info_hash"})
+		return
+	}
+	// Port 0 is a client that does not accept connections; it gets peers
+	// but is not handed out
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port < 0 || port > 65535 {
+		writeBencode(w, failureResponse{"invalid port"})
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeBencode(w, failureResponse{"unknown remote address"})
+		return
+	}
+	ip := net.ParseIP(host)
+	if v := net.ParseIP(query.Get("ip")); v != nil && s.acceptIP(ip, v) {
+		ip = v
+	}
+	left, _ := strconv.ParseInt(query.Get("left"), 10, 64)
+	numWant := maxPeers
+	if n, err := strconv.Atoi(query.Get("numwant")); err == nil && n >= 0 && n < numWant {
+		numWant = n
+	}
+
+	var hash [20]byte
+	copy(hash[:], infoHash)
+	addr := &net.TCPAddr{IP: ip, Port: port}
+	peers, complete, incomplete := s.announce(hash, addr, query.Get("peer_id"), left, query.Get("event"), numWant)
+
+	interval := int(s.Interval / time.Second)
+	if query.Get("compact") == "0" {
+		resp := dictResponse{Interval: interval, Complete: complete, Incomplete: incomplete, Peers: []dictPeer{}}
+		for _, p := range peers {
+			resp.Peers = append(resp.Peers, dictPeer{IP: p.addr.IP.String(), PeerID: p.peerID, Port: p.addr.Port})
+		}
+		writeBencode(w, resp)
+		return
+	}
+	resp := compactResponse{Interval: interval, Complete: complete, Incomplete: incomplete}
+	var peers4, peers6 []byte
+	for _, p := range peers {
+		if ip4 := p.addr.IP.To4(); ip4 != nil {
+			peers4 = binary.BigEndian.AppendUint16(append(peers4, ip4...), uint16(p.addr.Port))
+		} else {
+			peers6 = binary.BigEndian.AppendUint16(append(peers6, p.addr.IP.To16()...), uint16(p.addr.Port))
+		}
+	}
+	resp.Peers = string(peers4)
+	resp.Peers6 = string(peers6)
+	writeBencode(w, resp)
+}
+
+// acceptIP reports whether a client connecting from remote may register
+// the address claimed instead. Otherwise anyone could add third parties to
+// a swarm.
+func (s *Server) acceptIP(remote, claimed net.IP) bool {
+	for _, network := range s.TrustedProxies {
+		if network.Contains(remote) {
+			return true
+		}
+	}
+	// A peer on the LAN may report its LAN address, for example when it
+	// reaches the tracker through a local gateway
+	private := func(ip net.IP) bool { return ip.IsPrivate() || ip.IsLoopback() }
+	return private(remote) && private(claimed)
+}
+
+// announce records a peer and returns up to numWant other peers of the
+// swarm with the number of seeders and leechers
+func (s *Server) announce(infoHash [20]byte, addr *net.TCPAddr, peerID string, left int64, event string, numWant int) (peers []*swarmPeer, complete, incomplete int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	swarm := s.swarms[infoHash]
+	if swarm == nil {
+		swarm = make(map[string]*swarmPeer)
+		s.swarms[infoHash] = swarm
+	}
+
+	now := time.Now()
+	key := addr.String()
+	if event == "stopped" || addr.Port == 0 {
+		delete(swarm, key)
+	} else {
+		swarm[key] = &swarmPeer{addr: addr, peerID: peerID, left: left, seen: now}
+	}
+
+	for k, p := range swarm {
+		if now.Sub(p.seen) > 2*s.Interval {
+			delete(swarm, k)
+			continue
+		}
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+		if k != key && len(peers) < numWant {
+			peers = append(peers, p)
+		}
+	}
+	if len(swarm) == 0 {
+		delete(s.swarms, infoHash)
+	}
+	return peers, complete, incomplete
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,47 @@
+package tracker
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAnnouncedAddress(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("203.0.113.0/24")
+	tests := []struct {
+		name, remote, ip, want string
+	}{
+		{"no ip parameter", "198.51.100.7", "", "198.51.100.7"},
+		{"public client claims another address", "198.51.100.7", "192.0.2.1", "198.51.100.7"},
+		{"public client claims a private address", "198.51.100.7", "10.0.0.5", "198.51.100.7"},
+		{"private client claims a public address", "10.0.0.5", "192.0.2.1", "10.0.0.5"},
+		{"LAN client reports its LAN address", "127.0.0.1", "192.168.1.20", "192.168.1.20"},
+		{"trusted proxy", "203.0.113.9", "192.0.2.1", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			s.TrustedProxies = []*net.IPNet{proxies}
+			query := url.Values{
+				"info_hash": {"aaaaaaaaaaaaaaaaaaaa"},
+				"peer_id":   {"bbbbbbbbbbbbbbbbbbbb"},
+				"port":      {"6881"},
+				"ip":        {tt.ip},
+			}
+			req := httptest.NewRequest("GET", "/announce?"+query.Encode(), nil)
+			req.RemoteAddr = net.JoinHostPort(tt.remote, "40000")
+			s.ServeHTTP(httptest.NewRecorder(), req)
+
+			var hash [20]byte
+			copy(hash[:], "aaaaaaaaaaaaaaaaaaaa")
+			for key := range s.swarms[hash] {
+				if want := net.JoinHostPort(tt.want, "6881"); key != want {
+					t.Errorf("registered %s, want %s", key, want)
+				}
+				return
+			}
+			t.Error("nothing registered")
+		})
+	}
+}
@@ -0,0 +1,604 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// mss is the largest payload carried by one packet
+	mss = 1200
+	// recvWindow is the receive buffer advertised to the peer
+	recvWindow = 1 << 20
+	// maxWindowLimit caps the congestion window
+	maxWindowLimit = 4 << 20
+	// initialWindow is the congestion window of a new connection
+	initialWindow = 8 * mss
+
+	minRTO         = 500 * time.Millisecond
+	maxRTO         = 8 * time.Second
+	maxRetransmits = 10
+	keepAlive      = 15 * time.Second
+	idleTimeout    = 60 * time.Second
+	lingerTimeout  = 10 * time.Second
+	dupAckLimit    = 3
+	maxFastResends = 4
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+// timeoutError is returned when a deadline expires
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "utp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errReset = errors.New("utp: connection reset by peer")
+
+// outPacket is a sent packet waiting to be acknowledged
+type outPacket struct {
+	typ       byte
+	seq       uint16
+	payload   []byte
+	sentAt    time.Time
+	transmits int
+}
+
+// Conn is a single uTP connection. It implements net.Conn.
+type Conn struct {
+	sock   *Socket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     int
+	err       error
+	connected chan struct{}
+	done      chan struct{}
+
+	// Send side
+	seqNr     uint16
+	unacked   []*outPacket
+	inFlight  int
+	lastAck   uint16
+	dupAcks   int
+	peerWnd   int
+	finQueued bool
+	finAcked  bool
+	lastSend  time.Time
+
+	// Congestion control
+	maxWindow  float64
+	lastDecay  time.Time
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	delayHist  [2]uint32
+	delayStart time.Time
+
+	// Receive side
+	ackNr      uint16
+	ooo        map[uint16]*packet
+	readBuf    bytes.Buffer
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+	replyMicro uint32
+	lastRecv   time.Time
+
+	closing       bool
+	closedAt      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		sock:      s,
+		raddr:     raddr,
+		recvID:    recvID,
+		sendID:    sendID,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		peerWnd:   recvWindow,
+		maxWindow: initialWindow,
+		rto:       time.Second,
+		ooo:       make(map[uint16]*packet),
+		lastRecv:  time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Read reads in-order data from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.readBuf.Len() > 0 {
+			n, _ := c.readBuf.Read(b)
+			// Reopen the window if it had shrunk
+			if c.readBuf.Len() == 0 {
+				c.sendState()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.closing {
+			return 0, ErrClosed
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+}
+
+// Write queues data for reliable delivery, blocking while the congestion
+// or receive window is full
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.closing || c.finQueued {
+			return written, ErrClosed
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return written, timeoutError{}
+		}
+		size := len(b) - written
+		if size > mss {
+			size = mss
+		}
+		if !c.windowAllows(size) {
+			c.cond.Wait()
+			continue
+		}
+		payload := append([]byte(nil), b[written:written+size]...)
+		c.queuePacket(stData, payload)
+		written += size
+	}
+	return written, nil
+}
+
+// windowAllows reports whether size more bytes may be put in flight. One
+// packet is always allowed so a shrunken window cannot stall forever.
+func (c *Conn) windowAllows(size int) bool {
+	if c.inFlight == 0 {
+		return true
+	}
+	window := int(c.maxWindow)
+	if c.peerWnd < window {
+		window = c.peerWnd
+	}
+	return c.inFlight+size <= window
+}
+
+// Close sends FIN once all queued data is out and releases the connection
+// when the FIN is acknowledged or the linger timeout expires
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	c.closedAt = time.Now()
+	if c.err == nil && c.state == stateConnected && !c.finQueued {
+		c.finQueued = true
+		c.queuePacket(stFin, nil)
+	}
+	c.cond.Broadcast()
+	c.maybeRelease()
+	return nil
+}
+
+// LocalAddr returns the local UDP address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+// RemoteAddr returns the remote UDP address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets both the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future reads
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending and future writes
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+// resetTimer wakes up blocked readers and writers when a deadline expires
+func (c *Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+func (c *Conn) terminalError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		return ErrClosed
+	}
+	return c.err
+}
+
+// fail tears the connection down with err
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	close(c.done)
+	c.cond.Broadcast()
+	go c.sock.remove(c)
+}
+
+// maybeRelease removes a closed connection once both directions finished
+func (c *Conn) maybeRelease() {
+	if !c.closing || c.state == stateClosed {
+		return
+	}
+	if (c.finAcked && c.gotFin) || c.err != nil || c.state == stateSynSent {
+		c.failLocked(ErrClosed)
+	}
+}
+
+// now returns the current time in microseconds as sent on the wire
+func now() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// queuePacket assigns the next sequence number to a packet and sends it
+func (c *Conn) queuePacket(typ byte, payload []byte) {
+	op := &outPacket{typ: typ, seq: c.seqNr, payload: payload}
+	c.seqNr++
+	c.unacked = append(c.unacked, op)
+	c.inFlight += len(payload)
+	c.transmit(op)
+}
+
+func (c *Conn) transmit(op *outPacket) {
+	op.sentAt = time.Now()
+	op.transmits++
+	p := &packet{
+		typ:     op.typ,
+		connID:  c.sendID,
+		seq:     op.seq,
+		ack:     c.ackNr,
+		payload: op.payload,
+	}
+	if op.typ == stSyn {
+		p.connID = c.recvID
+	}
+	c.send(p)
+}
+
+// sendState sends a bare acknowledgement
+func (c *Conn) sendState() {
+	c.send(&packet{typ: stState, connID: c.sendID, seq: c.seqNr, ack: c.ackNr})
+}
+
+func (c *Conn) send(p *packet) {
+	p.ts = now()
+	p.tsDiff = c.replyMicro
+	wnd := recvWindow - c.readBuf.Len()
+	if wnd < 0 {
+		wnd = 0
+	}
+	p.wnd = uint32(wnd)
+	if p.typ == stState || p.typ == stData {
+		p.sack = c.selectiveAck()
+	}
+	c.lastSend = time.Now()
+	c.sock.sendRaw(p, c.raddr)
+}
+
+// selectiveAck builds the SACK bitmask for out-of-order packets
+func (c *Conn) selectiveAck() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	var mask [maxSackBits / 8]byte
+	highest := -1
+	for seq := range c.ooo {
+		bit := int(seq - c.ackNr - 2)
+		if bit < 0 || bit >= maxSackBits {
+			continue
+		}
+		mask[bit/8] |= 1 << (bit % 8)
+		if bit > highest {
+			highest = bit
+		}
+	}
+	if highest < 0 {
+		return nil
+	}
+	length := (highest/8 + 4) / 4 * 4
+	return mask[:length]
+}
+
+// recordReceive updates timing state from any received packet
+func (c *Conn) recordReceive(p *packet) {
+	c.lastRecv = time.Now()
+	c.replyMicro = now() - p.ts
+}
+
+// handlePacket processes a packet addressed to this connection
+func (c *Conn) handlePacket(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if p.typ == stReset {
+		c.failLocked(errReset)
+		return
+	}
+	c.recordReceive(p)
+	c.peerWnd = int(p.wnd)
+
+	if c.state == stateSynSent {
+		if p.typ != stState {
+			return
+		}
+		// The SYN-ACK tells us where the acceptor's sequence starts
+		c.ackNr = p.seq - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.processAck(p)
+
+	switch p.typ {
+	case stData, stFin:
+		c.receiveData(p)
+	}
+	c.cond.Broadcast()
+	c.maybeRelease()
+}
+
+// processAck removes acknowledged packets and updates congestion state
+func (c *Conn) processAck(p *packet) {
+	ackedBytes := 0
+	var rttSample time.Duration
+	kept := c.unacked[:0]
+	for _, op := range c.unacked {
+		acked := !seqLess(p.ack, op.seq) || c.sacked(p, op.seq)
+		if !acked {
+			kept = append(kept, op)
+			continue
+		}
+		ackedBytes += len(op.payload)
+		c.inFlight -= len(op.payload)
+		if op.transmits == 1 {
+			rttSample = time.Since(op.sentAt)
+		}
+		if op.typ == stFin {
+			c.finAcked = true
+		}
+	}
+	for i := len(kept); i < len(c.unacked); i++ {
+		c.unacked[i] = nil
+	}
+	c.unacked = kept
+
+	if rttSample > 0 {
+		c.updateRTT(rttSample)
+	}
+	if ackedBytes > 0 {
+		c.dupAcks = 0
+		c.updateWindow(ackedBytes, p.tsDiff)
+	} else if p.typ == stState && p.ack == c.lastAck && len(c.unacked) > 0 {
+		c.dupAcks++
+	}
+	c.lastAck = p.ack
+
+	// Fast retransmit after repeated duplicate acks, or when the peer
+	// selectively acknowledged packets beyond missing ones
+	if len(c.unacked) == 0 {
+		return
+	}
+	if c.dupAcks >= dupAckLimit {
+		c.dupAcks = 0
+		if first := c.unacked[0]; time.Since(first.sentAt) > c.rtt {
+			c.onLoss()
+			c.transmit(first)
+		}
+	}
+	if c.sackCount(p) >= dupAckLimit {
+		highest := p.ack + 1 + uint16(c.highestSacked(p))
+		resent := 0
+		for _, op := range c.unacked {
+			if !seqLess(op.seq, highest) || resent == maxFastResends {
+				break
+			}
+			if time.Since(op.sentAt) > c.rtt {
+				if resent == 0 {
+					c.onLoss()
+				}
+				c.transmit(op)
+				resent++
+			}
+		}
+	}
+}
+
+// highestSacked returns the position of the last set bit in the SACK mask
+func (c *Conn) highestSacked(p *packet) int {
+	for i := len(p.sack)*8 - 1; i >= 0; i-- {
+		if p.sack[i/8]&(1<<(i%8)) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (c *Conn) sacked(p *packet, seq uint16) bool {
+	bit := int(seq - p.ack - 2)
+	if bit < 0 || bit >= len(p.sack)*8 {
+		return false
+	}
+	return p.sack[bit/8]&(1<<(bit%8)) != 0
+}
+
+func (c *Conn) sackCount(p *packet) int {
+	n := 0
+	for _, b := range p.sack {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// receiveData delivers in-order payloads and buffers out-of-order ones
+func (c *Conn) receiveData(p *packet) {
+	if p.typ == stFin && !c.gotFin {
+		c.gotFin = true
+		c.finSeq = p.seq
+	}
+	if !seqLess(c.ackNr, p.seq) {
+		// Duplicate; the ack was probably lost
+		c.sendState()
+		return
+	}
+	if int(p.seq-c.ackNr) > maxSackBits {
+		// Too far ahead of what we can acknowledge selectively
+		return
+	}
+	c.ooo[p.seq] = p
+	for {
+		next, ok := c.ooo[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ackNr+1)
+		c.ackNr++
+		c.readBuf.Write(next.payload)
+	}
+	if c.gotFin && c.ackNr == c.finSeq {
+		c.eof = true
+	}
+	c.sendState()
+}
+
+// tick runs retransmission timeouts, keep-alives and idle detection
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if c.closing && time.Since(c.closedAt) > lingerTimeout {
+		c.failLocked(ErrClosed)
+		return
+	}
+	if time.Since(c.lastRecv) > idleTimeout {
+		c.failLocked(timeoutError{})
+		return
+	}
+
+	if len(c.unacked) > 0 {
+		first := c.unacked[0]
+		if time.Since(first.sentAt) > c.rto {
+			if first.transmits >= maxRetransmits {
+				c.failLocked(timeoutError{})
+				return
+			}
+			// A timeout means heavy congestion: fall back to one packet
+			c.maxWindow = mss
+			c.rto *= 2
+			if c.rto > maxRTO {
+				c.rto = maxRTO
+			}
+			c.transmit(first)
+		}
+		return
+	}
+	if c.state == stateConnected && time.Since(c.lastSend) > keepAlive {
+		c.sendState()
+	}
+}
@@ -0,0 +1,69 @@
+package utp
+
+import "time"
+
+const (
+	// targetDelay is the queuing delay LEDBAT aims for, in microseconds
+	targetDelay = 100000
+	// maxCwndIncrease is the most the window grows per round trip
+	maxCwndIncrease = 3000
+	// delayHistoryPeriod is how long one base delay sample bucket lasts
+	delayHistoryPeriod = time.Minute
+)
+
+// updateWindow applies the LEDBAT controller for ackedBytes newly
+// acknowledged bytes. delay is the one-way delay the peer measured for
+// our packets; it includes the clock offset between the hosts, which
+// cancels out against the base delay.
+func (c *Conn) updateWindow(ackedBytes int, delay uint32) {
+	if delay == 0 {
+		return
+	}
+	base := c.baseDelay(delay)
+	queuing := float64(delay - base)
+
+	offTarget := (targetDelay - queuing) / targetDelay
+	windowFactor := float64(ackedBytes) / c.maxWindow
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	c.maxWindow += maxCwndIncrease * offTarget * windowFactor
+	if c.maxWindow < mss {
+		c.maxWindow = mss
+	}
+	if c.maxWindow > maxWindowLimit {
+		c.maxWindow = maxWindowLimit
+	}
+}
+
+// baseDelay records a delay sample and returns the minimum delay seen over
+// the last two history periods
+func (c *Conn) baseDelay(sample uint32) uint32 {
+	if c.delayStart.IsZero() || time.Since(c.delayStart) > delayHistoryPeriod {
+		c.delayHist[1] = c.delayHist[0]
+		c.delayHist[0] = sample
+		c.delayStart = time.Now()
+	} else if sample < c.delayHist[0] {
+		c.delayHist[0] = sample
+	}
+	base := c.delayHist[0]
+	if c.delayHist[1] != 0 && c.delayHist[1] < base {
+		base = c.delayHist[1]
+	}
+	if sample < base {
+		base = sample
+	}
+	return base
+}
+
+// onLoss halves the window at most once per round trip
+func (c *Conn) onLoss() {
+	if time.Since(c.lastDecay) < c.rtt {
+		return
+	}
+	c.lastDecay = time.Now()
+	c.maxWindow /= 2
+	if c.maxWindow < mss {
+		c.maxWindow = mss
+	}
+}
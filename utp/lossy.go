@@ -0,0 +1,62 @@
+package utp
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LossyPacketConn wraps a packet connection and delays or drops outgoing
+// datagrams. It lets a loopback uTP setup behave like a congested link.
+// Datagrams that are not dropped are delivered in order.
+type LossyPacketConn struct {
+	net.PacketConn
+	// Delay is added to every datagram, plus up to Jitter extra
+	Delay  time.Duration
+	Jitter time.Duration
+	// Loss is the probability in [0, 1] that a datagram is dropped
+	Loss float64
+
+	once  sync.Once
+	queue chan delayedPacket
+}
+
+type delayedPacket struct {
+	due  time.Time
+	data []byte
+	addr net.Addr
+}
+
+// NewLossyPacketConn wraps pc with the given delay, jitter and loss rate
+func NewLossyPacketConn(pc net.PacketConn, delay, jitter time.Duration, loss float64) *LossyPacketConn {
+	return &LossyPacketConn{PacketConn: pc, Delay: delay, Jitter: jitter, Loss: loss}
+}
+
+// WriteTo sends b after the configured delay unless it is dropped
+func (l *LossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if l.Loss > 0 && rand.Float64() < l.Loss {
+		return len(b), nil
+	}
+	delay := l.Delay
+	if l.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(l.Jitter)))
+	}
+	if delay <= 0 {
+		return l.PacketConn.WriteTo(b, addr)
+	}
+	l.once.Do(func() {
+		l.queue = make(chan delayedPacket, 4096)
+		go l.deliver()
+	})
+	l.queue <- delayedPacket{due: time.Now().Add(delay), data: append([]byte(nil), b...), addr: addr}
+	return len(b), nil
+}
+
+// deliver writes queued datagrams once they are due, never reordering them
+func (l *LossyPacketConn) deliver() {
+	for p := range l.queue {
+		time.Sleep(time.Until(p.due))
+		l.PacketConn.WriteTo(p.data, p.addr)
+	}
+}
@@ -0,0 +1,111 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version     = 1
+	headerSize  = 20
+	extNone     = 0
+	extSelAck   = 1
+	maxSackBits = 256
+)
+
+// packet is a single uTP datagram as described in BEP 29
+type packet struct {
+	typ    byte
+	connID uint16
+	ts     uint32
+	tsDiff uint32
+	wnd    uint32
+	seq    uint16
+	ack    uint16
+	// sack is the selective ACK bitmask; bit i refers to ack+2+i
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	ext := byte(extNone)
+	if len(p.sack) > 0 {
+		ext = extSelAck
+	}
+	size := headerSize + len(p.payload)
+	if ext == extSelAck {
+		size += 2 + len(p.sack)
+	}
+	b := make([]byte, headerSize, size)
+	b[0] = p.typ<<4 | version
+	b[1] = ext
+	binary.BigEndian.PutUint16(b[2:], p.connID)
+	binary.BigEndian.PutUint32(b[4:], p.ts)
+	binary.BigEndian.PutUint32(b[8:], p.tsDiff)
+	binary.BigEndian.PutUint32(b[12:], p.wnd)
+	binary.BigEndian.PutUint16(b[16:], p.seq)
+	binary.BigEndian.PutUint16(b[18:], p.ack)
+	if ext == extSelAck {
+		b = append(b, extNone, byte(len(p.sack)))
+		b = append(b, p.sack...)
+	}
+	return append(b, p.payload...)
+}
+
+func unmarshalPacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("short utp packet of %d bytes", len(b))
+	}
+	if b[0]&0x0f != version {
+		return nil, fmt.Errorf("unsupported utp version %d", b[0]&0x0f)
+	}
+	p := &packet{
+		typ:    b[0] >> 4,
+		connID: binary.BigEndian.Uint16(b[2:]),
+		ts:     binary.BigEndian.Uint32(b[4:]),
+		tsDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:    binary.BigEndian.Uint32(b[12:]),
+		seq:    binary.BigEndian.Uint16(b[16:]),
+		ack:    binary.BigEndian.Uint16(b[18:]),
+	}
+	if p.typ > stSyn {
+		return nil, fmt.Errorf("unknown utp packet type %d", p.typ)
+	}
+
+	// Walk the extension chain
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != extNone {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("truncated utp extension")
+		}
+		next, length := rest[0], int(rest[1])
+		if len(rest) < 2+length {
+			return nil, fmt.Errorf("truncated utp extension")
+		}
+		if ext == extSelAck {
+			if length%4 != 0 || length == 0 {
+				return nil, fmt.Errorf("invalid selective ack length %d", length)
+			}
+			p.sack = append([]byte(nil), rest[2:2+length]...)
+		}
+		ext = next
+		rest = rest[2+length:]
+	}
+	p.payload = rest
+	return p, nil
+}
+
+// seqLess compares sequence numbers with wrap-around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,305 @@
+// Package utp implements the Micro Transport Protocol (BEP 29): reliable,
+// ordered streams over UDP with LEDBAT congestion control so that peer
+// traffic yields to other traffic on the same link.
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// tickInterval drives retransmissions, keep-alives and timeouts
+const tickInterval = 50 * time.Millisecond
+
+// ErrClosed is returned by operations on a closed socket or connection
+var ErrClosed = errors.New("utp: use of closed connection")
+
+type connKey struct {
+	addr   string
+	recvID uint16
+}
+
+// Socket multiplexes any number of uTP connections over one UDP socket.
+// A Socket returned by Listen also implements net.Listener.
+type Socket struct {
+	pc net.PacketConn
+
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	listening bool
+	// ephemeral sockets are closed once their only connection goes away
+	ephemeral bool
+
+	accept chan *Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Listen opens a UDP socket that accepts incoming uTP connections and can
+// also dial outgoing ones.
+func Listen(address string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newSocket(pc, true, false), nil
+}
+
+// NewSocket runs uTP over an existing packet connection. The socket only
+// dials unless it was created by Listen. Wrapping the packet connection is
+// how tests inject delay and loss, see NewLossyPacketConn.
+func NewSocket(pc net.PacketConn) *Socket {
+	return newSocket(pc, false, false)
+}
+
+// newSocket starts the read and tick loops, so the mode of the socket is
+// fixed here rather than set afterwards
+func newSocket(pc net.PacketConn, listening, ephemeral bool) *Socket {
+	s := &Socket{
+		pc:        pc,
+		conns:     make(map[connKey]*Conn),
+		listening: listening,
+		ephemeral: ephemeral,
+		accept:    make(chan *Conn, 32),
+		closed:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// NewListener wraps an existing packet connection in a socket that accepts
+// incoming connections
+func NewListener(pc net.PacketConn) *Socket {
+	return newSocket(pc, true, false)
+}
+
+// Dial opens a uTP connection from a new ephemeral socket
+func Dial(address string) (net.Conn, error) {
+	return DialTimeout(address, 0)
+}
+
+// DialTimeout opens a uTP connection from a new ephemeral socket, giving
+// up after timeout when it is non-zero
+func DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s := newSocket(pc, false, true)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := s.DialContext(ctx, address)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Addr returns the local UDP address of the socket
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket and every connection multiplexed on it
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(ErrClosed)
+		}
+		err = s.pc.Close()
+	})
+	return err
+}
+
+// DialContext opens a uTP connection to address over this socket
+func (s *Socket) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var recvID uint16
+	for {
+		recvID = randomUint16()
+		if _, taken := s.conns[connKey{raddr.String(), recvID}]; !taken {
+			break
+		}
+	}
+	c := newConn(s, raddr, recvID, recvID+1)
+	s.conns[connKey{raddr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.seqNr = 1
+	c.state = stateSynSent
+	c.queuePacket(stSyn, nil)
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, c.terminalError()
+	case <-ctx.Done():
+		c.fail(fmt.Errorf("utp dial %s: %v", address, ctx.Err()))
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		p, err := unmarshalPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		p.payload = append([]byte(nil), p.payload...)
+		s.dispatch(p, addr)
+	}
+}
+
+// dispatch routes a packet to its connection, creating one for new SYNs
+func (s *Socket) dispatch(p *packet, addr net.Addr) {
+	if p.typ == stSyn {
+		s.handleSyn(p, addr)
+		return
+	}
+	s.mu.Lock()
+	c := s.conns[connKey{addr.String(), p.connID}]
+	s.mu.Unlock()
+	if c == nil {
+		if p.typ != stReset {
+			s.sendRaw(&packet{typ: stReset, connID: p.connID, ack: p.seq}, addr)
+		}
+		return
+	}
+	c.handlePacket(p)
+}
+
+func (s *Socket) handleSyn(p *packet, addr net.Addr) {
+	key := connKey{addr.String(), p.connID + 1}
+	s.mu.Lock()
+	if c, ok := s.conns[key]; ok {
+		// Our SYN-ACK was lost; answer the retransmitted SYN again
+		s.mu.Unlock()
+		c.mu.Lock()
+		c.sendState()
+		c.mu.Unlock()
+		return
+	}
+	if !s.listening {
+		s.mu.Unlock()
+		s.sendRaw(&packet{typ: stReset, connID: p.connID, ack: p.seq}, addr)
+		return
+	}
+	c := newConn(s, addr, p.connID+1, p.connID)
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.seqNr = randomUint16()
+	c.ackNr = p.seq
+	c.state = stateConnected
+	c.peerWnd = int(p.wnd)
+	c.recordReceive(p)
+	c.sendState()
+	close(c.connected)
+	c.mu.Unlock()
+
+	select {
+	case s.accept <- c:
+	default:
+		// Nobody is accepting fast enough; refuse the connection
+		c.fail(errors.New("utp: accept queue full"))
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+	empty := len(s.conns) == 0
+	s.mu.Unlock()
+	if s.ephemeral && empty {
+		s.Close()
+	}
+}
+
+func (s *Socket) sendRaw(p *packet, addr net.Addr) error {
+	_, err := s.pc.WriteTo(p.marshal(), addr)
+	return err
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick()
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func randomUint16() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,155 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// lossyPair returns a listening socket and a dialing socket on loopback
+// whose outgoing datagrams are delayed and dropped as given
+func lossyPair(t *testing.T, delay, jitter time.Duration, loss float64) (*Socket, *Socket) {
+	t.Helper()
+	open := func() *LossyPacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewLossyPacketConn(pc, delay, jitter, loss)
+	}
+	listener := NewListener(open())
+	dialer := NewSocket(open())
+	t.Cleanup(func() {
+		dialer.Close()
+		listener.Close()
+	})
+	return listener, dialer
+}
+
+// transfer sends size random bytes from the dialing side and checks that
+// the listening side echoes them back unchanged
+func transfer(t *testing.T, listener, dialer *Socket, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, io.LimitReader(conn, int64(size)))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errs <- err
+	}()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed data differs from what was sent")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	listener, dialer := lossyPair(t, 0, 0, 0)
+	transfer(t, listener, dialer, 1<<20)
+}
+
+func TestTransferWithDelay(t *testing.T) {
+	listener, dialer := lossyPair(t, 20*time.Millisecond, 10*time.Millisecond, 0)
+	transfer(t, listener, dialer, 256<<10)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	listener, dialer := lossyPair(t, 5*time.Millisecond, 5*time.Millisecond, 0.05)
+	transfer(t, listener, dialer, 256<<10)
+}
+
+func TestMultiplexedConns(t *testing.T) {
+	listener, dialer := lossyPair(t, 0, 0, 0)
+	const conns = 4
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < conns; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, io.LimitReader(conn, 64<<10))
+			}()
+		}
+		close(done)
+	}()
+
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			conn, err := dialer.DialContext(context.Background(), listener.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			data := make([]byte, 64<<10)
+			rand.Read(data)
+			go conn.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- io.ErrUnexpectedEOF
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < conns; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("connection %d: %v", i, err)
+		}
+	}
+	<-done
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Nothing answers on this socket, so the SYN is never acknowledged
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	start := time.Now()
+	if _, err := DialTimeout(pc.LocalAddr().String(), 300*time.Millisecond); err == nil {
+		t.Fatal("dial to a silent address succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial gave up after %v", elapsed)
+	}
+}